@@ -1,24 +1,86 @@
 package client
 
 import (
+	"DistributedFileSystem/erasure"
 	"DistributedFileSystem/protocol"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"slices"
+	"time"
 )
 
 type Client struct {
-	mainAddress string
+	main   *protocol.Cluster // Leader among the main servers
+	config Config
+	pool   *protocol.Pool // Multiplexed connections to the main servers
 }
 
-func NewClient(mainAddress string) *Client {
-	return &Client{mainAddress: mainAddress}
+type Config struct {
+	MainAddrs []string // Main server addresses, all of them if they replicate each other
+
+	// How long connecting to a server, waiting for the main server's reply or
+	// any single read or write of a chunk transfer may take before the call
+	// fails. 0 waits forever.
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// A failed call is attempted up to Attempts times in all, waiting Backoff
+	// before the first retry and twice as long before each further one.
+	// Calls that only read are retried whenever the connection fails, others
+	// only when it could not be established. Zero uses the defaults below.
+	Attempts int
+	Backoff  time.Duration
 }
 
-func (c *Client) Upload(filename string) error {
-	file, err := os.Open(filename)
+const (
+	defaultAttempts = 4
+	defaultBackoff  = time.Second
+)
+
+func NewClient(config Config) *Client {
+	if config.Attempts <= 0 {
+		config.Attempts = defaultAttempts
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = defaultBackoff
+	}
+	pool := &protocol.Pool{DialTimeout: config.DialTimeout, WriteTimeout: config.WriteTimeout}
+	return &Client{
+		main:   protocol.NewCluster(pool, config.MainAddrs),
+		config: config,
+		pool:   pool,
+	}
+}
+
+// Upload stores the local file at localPath under remote in the file system's
+// namespace. An empty remote uses the local file's base name, so local
+// directories never leak into the remote name.
+func (c *Client) Upload(ctx context.Context, localPath string, remote string) error {
+	return c.upload(ctx, localPath, remote, nil)
+}
+
+// UploadErasure is Upload for a file stored erasure-coded with scheme
+// instead of replicated
+func (c *Client) UploadErasure(ctx context.Context, localPath string, remote string, scheme protocol.Erasure) error {
+	return c.upload(ctx, localPath, remote, &scheme)
+}
+
+func (c *Client) upload(ctx context.Context, localPath string, remote string, scheme *protocol.Erasure) error {
+	if remote == "" {
+		remote = filepath.Base(localPath)
+	}
+	file, err := os.Open(localPath)
 	if err != nil {
 		return err
 	}
@@ -29,69 +91,258 @@ func (c *Client) Upload(filename string) error {
 	if err != nil {
 		return err
 	}
-	fmt.Println("Uploading", fileinfo.Name(), ", Size:", fileinfo.Size())
+	fmt.Println("Uploading", fileinfo.Name(), "as", remote, ", Size:", fileinfo.Size())
 
-	// Connect to Main Server
-	conn, err := net.Dial("tcp", c.mainAddress)
+	// Checksum the whole file
+	checksum, err := hashSection(io.NewSectionReader(file, 0, fileinfo.Size()))
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
 
-	// Construct Request
+	// Ask the main server for a lease and where to place the chunks
+	var resp protocol.Upload_Response
 	req := protocol.Upload_Request{
-		Filename: filename,
+		Filename: remote,
 		Size:     fileinfo.Size(),
+		Checksum: checksum,
+		Erasure:  scheme,
 	}
-
-	payload, err := json.Marshal(req)
-	if err != nil {
+	if err := c.call(ctx, protocol.UploadReq, req, protocol.UploadResp, &resp); err != nil {
 		return err
 	}
 
-	// Create encoder and decoder
-	encoder := json.NewEncoder(conn)
-	decoder := json.NewDecoder(conn)
-
-	// Send message
-	err = encoder.Encode(protocol.Message{
-		Type:    protocol.UploadReq,
-		Payload: payload,
+	// Send a copy of every chunk to each of its replicas
+	return c.send(ctx, localPath, file, &uploadState{
+		Remote:   remote,
+		Size:     fileinfo.Size(),
+		Checksum: checksum,
+		Lease:    resp.Lease,
+		Chunks:   resp.Chunks,
+		Stored:   make(map[string]bool),
 	})
+}
+
+// Resume continues an interrupted upload of localPath, sending only the
+// chunk replicas, and the parts of them, that the storage servers do not
+// hold yet. It fails if the lease has expired in the meantime.
+func (c *Client) Resume(ctx context.Context, localPath string) error {
+	state, err := loadState(localPath + stateSuffix)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no interrupted upload of %s", localPath)
+	}
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(localPath)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
-	// Receive message
-	var msg protocol.Message
-	err = decoder.Decode(&msg)
+	// The chunks must be cut from the same data
+	checksum, err := hashSection(io.NewSectionReader(file, 0, state.Size))
 	if err != nil {
 		return err
 	}
-	if msg.Type != protocol.UploadResp {
-		return fmt.Errorf("UploadResp expected")
+	if fileinfo, err := file.Stat(); err != nil || fileinfo.Size() != state.Size || checksum != state.Checksum {
+		return fmt.Errorf("%s changed since its upload was interrupted", localPath)
 	}
-	var resp protocol.Upload_Response
+	fmt.Println("Resuming upload of", localPath, "as", state.Remote, ",", len(state.Stored), "chunk replicas already stored")
+	return c.send(ctx, localPath, file, state)
+}
 
-	err = json.Unmarshal(msg.Payload, &resp)
+// uploadState is what an interrupted upload needs to resume, kept in a file
+// next to the local file until the upload is committed or aborted
+type uploadState struct {
+	Remote   string               `json:"remote"`
+	Size     int64                `json:"size"`
+	Checksum string               `json:"checksum"`
+	Lease    string               `json:"lease"`
+	Chunks   []protocol.Chunkinfo `json:"chunks"`
+	Stored   map[string]bool      `json:"stored"` // Chunk or shard ID@address of every replica stored
+}
+
+const (
+	// An interrupted upload's state is kept in the local file's name with this suffix
+	stateSuffix = ".upload"
+)
+
+func loadState(path string) (*uploadState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state uploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// saveState replaces the state file, so a crash leaves either the old or new state
+func saveState(path string, state *uploadState) error {
+	data, err := json.Marshal(state)
 	if err != nil {
 		return err
 	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// send uploads every chunk replica not stored yet and commits the lease.
+// If a connection fails the state is kept so the upload can be resumed,
+// any other failure aborts the upload.
+func (c *Client) send(ctx context.Context, localPath string, file *os.File, state *uploadState) error {
+	statePath := localPath + stateSuffix
+	if err := saveState(statePath, state); err != nil {
+		return err
+	}
+
+	err := c.sendChunks(ctx, file, state, statePath)
+	if err == nil {
+		// Make the file visible
+		err = c.commit(ctx, state.Lease, "")
+	} else if protocol.CodeOf(err) != protocol.ErrInternal {
+		// Abort now rather than leaving the lease to expire
+		c.abort(ctx, state.Lease)
+	}
+	if protocol.CodeOf(err) == protocol.ErrInternal {
+		return fmt.Errorf("upload interrupted, progress kept in %s: %w", statePath, err)
+	}
+	os.Remove(statePath)
+	return err
+}
+
+func (c *Client) sendChunks(ctx context.Context, file *os.File, state *uploadState, statePath string) error {
+	var offset int64
+	for _, chunk := range state.Chunks {
+		section := io.NewSectionReader(file, offset, chunk.Size)
+		var err error
+		if chunk.Coded() {
+			err = c.sendShards(ctx, chunk, section, state, statePath)
+		} else {
+			err = c.sendReplicas(ctx, chunk, section, state, statePath)
+		}
+		if err != nil {
+			return err
+		}
+		offset += chunk.Size
+	}
+	return nil
+}
+
+// sendReplicas sends every replica of a chunk that is not stored yet, reading
+// the chunk from data
+func (c *Client) sendReplicas(ctx context.Context, chunk protocol.Chunkinfo, data io.ReaderAt, state *uploadState, statePath string) error {
+	var payload json.RawMessage
+	for _, addr := range chunk.Locations {
+		replica := chunk.ID + "@" + addr
+		if state.Stored[replica] {
+			continue
+		}
+		if payload == nil {
+			checksum, err := hashSection(io.NewSectionReader(data, 0, chunk.Size))
+			if err != nil {
+				return err
+			}
+			if payload, err = c.chunkRequest(state.Lease, chunk, checksum); err != nil {
+				return err
+			}
+		}
+		section := io.NewSectionReader(data, 0, chunk.Size)
+		if err := c.uploadReplica(ctx, addr, payload, section); err != nil {
+			return fmt.Errorf("upload of chunk %s to %s failed: %w", chunk.ID, addr, err)
+		}
+		state.Stored[replica] = true
+		if err := saveState(statePath, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendShards encodes an erasure-coded chunk and sends every shard of it that
+// is not stored yet
+func (c *Client) sendShards(ctx context.Context, chunk protocol.Chunkinfo, data *io.SectionReader, state *uploadState, statePath string) error {
+	if !slices.ContainsFunc(chunk.Shards, func(shard protocol.Chunkinfo) bool {
+		return slices.ContainsFunc(shard.Locations, func(addr string) bool {
+			return !state.Stored[shard.ID+"@"+addr]
+		})
+	}) {
+		return nil
+	}
 
-	if resp.StorageAddr == "" {
-		return fmt.Errorf("No Storage Available or File Already Exists")
+	code, err := erasure.New(chunk.DataShards, len(chunk.Shards)-chunk.DataShards)
+	if err != nil {
+		return err
 	}
+	buf := make([]byte, chunk.Size)
+	if _, err := io.ReadFull(data, buf); err != nil {
+		return err
+	}
+	shards := code.Split(buf)
+	if err := code.Encode(shards); err != nil {
+		return err
+	}
+	for i, shard := range chunk.Shards {
+		if err := c.sendReplicas(ctx, shard, bytes.NewReader(shards[i]), state, statePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// chunkRequest builds the request that sends a chunk of a leased upload to its replicas
+func (c *Client) chunkRequest(lease string, chunk protocol.Chunkinfo, checksum string) (json.RawMessage, error) {
+	return json.Marshal(protocol.Upload_Request{
+		Filename: chunk.ID,
+		Size:     chunk.Size,
+		Checksum: checksum,
+		Lease:    lease,
+		Session:  lease + "-" + chunk.ID,
+	})
+}
+
+// uploadReplica sends a chunk to one of its replicas. Sending it again is
+// harmless, so if the connection fails, or the node still holds the session
+// of the failed connection, it reconnects and continues from what the node
+// already stored.
+func (c *Client) uploadReplica(ctx context.Context, addr string, payload json.RawMessage, section *io.SectionReader) error {
+	return c.retry(ctx, resumable, func() error {
+		return c.uploadTo(ctx, addr, payload, section)
+	})
+}
+
+// commit ends an upload's lease, which succeeds once every chunk replica is
+// stored. checksum is only given for streamed uploads.
+func (c *Client) commit(ctx context.Context, lease string, checksum string) error {
+	var resp protocol.Commit_Response
+	req := protocol.Upload_Commit{Lease: lease, Checksum: checksum}
+	return c.call(ctx, protocol.UploadCommitReq, req, protocol.UploadCommitResp, &resp)
+}
+
+// abort gives an upload up, the main server deletes whatever chunks were stored
+func (c *Client) abort(ctx context.Context, lease string) error {
+	var resp protocol.Commit_Response
+	req := protocol.Upload_Commit{Lease: lease, Abort: true}
+	return c.call(ctx, protocol.UploadCommitReq, req, protocol.UploadCommitResp, &resp)
+}
+
+// uploadTo sends a chunk to a node, skipping whatever the node reports it
+// already holds of the session
+func (c *Client) uploadTo(ctx context.Context, addr string, payload json.RawMessage, section *io.SectionReader) error {
 	// Connect to storage server
-	storageConn, err := net.Dial("tcp", resp.StorageAddr)
+	storageConn, err := c.dial(ctx, addr)
 	if err != nil {
 		return err
 	}
 	defer storageConn.Close()
 
 	// Send file data
-	encoder = json.NewEncoder(storageConn)
-	decoder = json.NewDecoder(storageConn)
+	encoder := json.NewEncoder(storageConn)
+	decoder := json.NewDecoder(storageConn)
 	err = encoder.Encode(protocol.Message{
 		Type:    protocol.UploadReq,
 		Payload: payload,
@@ -100,153 +351,342 @@ func (c *Client) Upload(filename string) error {
 		return err
 	}
 
+	var msg protocol.Message
 	err = decoder.Decode(&msg)
 	if err != nil {
 		return err
 	}
-
+	if err := msg.Err(); err != nil {
+		return err
+	}
 	if msg.Type != protocol.UploadAck {
 		return fmt.Errorf("UploadAck expected")
-	} else {
-		// Send file data
-		_, err = io.Copy(storageConn, file)
+	}
+	var ack protocol.Upload_Ack
+	if err := json.Unmarshal(msg.Payload, &ack); err != nil {
 		return err
 	}
-}
+	if ack.Offset > 0 {
+		fmt.Println("Node", addr, "already holds", ack.Offset, "bytes, resuming")
+	}
 
-func (c *Client) Download(filename string, outputpath string) error {
-	// Request storage address from main server
-	conn, err := net.Dial("tcp", c.mainAddress)
-	if err != nil {
+	// Send file data
+	if _, err := section.Seek(ack.Offset, io.SeekStart); err != nil {
 		return err
 	}
-	defer conn.Close()
-	encoder := json.NewEncoder(conn)
-	decoder := json.NewDecoder(conn)
-
-	// Build Request
-	req := protocol.Download_Request{
-		Filename: filename,
+	if _, err = io.Copy(storageConn, section); err != nil {
+		return err
 	}
 
-	payload, err := json.Marshal(req)
-	if err != nil {
+	// Wait for the node to verify and store it
+	if err := decoder.Decode(&msg); err != nil {
+		return err
+	}
+	if err := msg.Err(); err != nil {
 		return err
 	}
+	if msg.Type != protocol.UploadDone {
+		return fmt.Errorf("UploadDone expected")
+	}
+	var done protocol.Upload_Done
+	if err := json.Unmarshal(msg.Payload, &done); err != nil {
+		return err
+	}
+	if !done.Success {
+		return fmt.Errorf("storage server rejected the data")
+	}
+	return nil
+}
 
-	// Send Request
-	err = encoder.Encode(protocol.Message{
-		Type:    protocol.DownloadReq,
-		Payload: payload,
-	})
+// hashSection returns the hex SHA-256 of everything in section
+func hashSection(section io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, section); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (c *Client) Download(ctx context.Context, filename string, outputpath string) error {
+	return c.DownloadRange(ctx, filename, outputpath, 0, 0)
+}
 
+// DownloadRange saves length bytes of filename starting at offset to
+// outputpath, fetching only the chunks the range falls in. A zero length,
+// or one past the end of the file, reads to the end.
+func (c *Client) DownloadRange(ctx context.Context, filename string, outputpath string, offset int64, length int64) error {
+	resp, err := c.locate(ctx, filename)
 	if err != nil {
 		return err
 	}
+	size := fileSize(resp.Chunks)
+	if offset < 0 || length < 0 || offset > size {
+		return fmt.Errorf("range at %d of length %d is outside %s of size %d", offset, length, filename, size)
+	}
+	if length == 0 || length > size-offset {
+		length = size - offset
+	}
 
-	var msg protocol.Message
-	err = decoder.Decode(&msg)
+	// Save file
+	f, err := os.Create(outputpath)
 	if err != nil {
 		return err
 	}
-	if msg.Type != protocol.DownloadResp {
-		return fmt.Errorf("DownloadResp expected")
+	defer f.Close()
+
+	// Reassemble the chunks in order
+	if err := c.readRange(ctx, resp.Chunks, offset, length, f); err != nil {
+		return err
 	}
-	var resp protocol.Download_Response
-	err = json.Unmarshal(msg.Payload, &resp)
+
+	// Verify the reassembled file, if it is all of it
+	if resp.Checksum == "" || length != size {
+		return nil
+	}
+	checksum, err := hashSection(io.NewSectionReader(f, 0, size))
 	if err != nil {
 		return err
 	}
-	if resp.StorageAddr == "" {
-		return fmt.Errorf("File Not Found")
+	if checksum != resp.Checksum {
+		return fmt.Errorf("checksum mismatch, expected %s, received %s", resp.Checksum, checksum)
 	}
+	return nil
+}
 
-	// Connect to storage server
-	storageConn, err := net.Dial("tcp", resp.StorageAddr)
-	if err != nil {
-		return err
+// locate asks the main server for the chunks of a file
+func (c *Client) locate(ctx context.Context, filename string) (protocol.Download_Response, error) {
+	var resp protocol.Download_Response
+	err := c.call(ctx, protocol.DownloadReq, protocol.Download_Request{Filename: filename}, protocol.DownloadResp, &resp)
+	return resp, err
+}
+
+func fileSize(chunks []protocol.Chunkinfo) int64 {
+	var size int64
+	for _, chunk := range chunks {
+		size += chunk.Size
 	}
+	return size
+}
 
-	// Send download request
-	defer storageConn.Close()
-	encoder = json.NewEncoder(storageConn)
-	decoder = json.NewDecoder(storageConn)
-	err = encoder.Encode(protocol.Message{
-		Type:    protocol.DownloadReq,
-		Payload: payload,
-	})
+// FileReader reads any part of a remote file, fetching only the chunks the
+// part falls in. It is safe for concurrent use.
+type FileReader struct {
+	c      *Client
+	ctx    context.Context
+	chunks []protocol.Chunkinfo
+	size   int64
+}
 
-	err = decoder.Decode(&msg)
+// OpenReaderAt returns a FileReader for filename. Its chunks are looked up
+// once, so the reader keeps reading the file as it was when opened. Every
+// read is made under ctx.
+func (c *Client) OpenReaderAt(ctx context.Context, filename string) (*FileReader, error) {
+	resp, err := c.locate(ctx, filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &FileReader{c: c, ctx: ctx, chunks: resp.Chunks, size: fileSize(resp.Chunks)}, nil
+}
 
-	if msg.Type != protocol.DownloadAck {
-		return fmt.Errorf("DownloadAck expected")
-	} else {
-		// Save file
-		f, err := os.Create(outputpath)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		_, err = io.Copy(f, storageConn)
-		return err
+// Size returns the length of the file
+func (r *FileReader) Size() int64 {
+	return r.size
+}
+
+// ReadAt implements io.ReaderAt
+func (r *FileReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	n := min(int64(len(p)), r.size-off)
+	if err := r.c.readRange(r.ctx, r.chunks, off, n, sliceWriter(p[:n])); err != nil {
+		return 0, err
+	}
+	if n < int64(len(p)) {
+		return int(n), io.EOF
 	}
+	return int(n), nil
+}
+
+// sliceWriter lets chunks be downloaded straight into a byte slice
+type sliceWriter []byte
 
+func (w sliceWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(w)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(w[off:], p), nil
 }
 
-func (c *Client) Delete(filename string) (bool, error) {
-	conn, err := net.Dial("tcp", c.mainAddress)
-	if err != nil {
-		return false, err
+// readRange copies length bytes of a file starting at offset to dst, at
+// positions counted from offset
+func (c *Client) readRange(ctx context.Context, chunks []protocol.Chunkinfo, offset int64, length int64, dst io.WriterAt) error {
+	var start int64 // Of the chunk within the file
+	for _, chunk := range chunks {
+		end := start + chunk.Size
+		from, to := max(offset, start), min(offset+length, end)
+		if from < to {
+			writer := io.NewOffsetWriter(dst, from-offset)
+			if err := c.downloadChunk(ctx, chunk, from-start, to-from, writer); err != nil {
+				return err
+			}
+		}
+		start = end
 	}
-	defer conn.Close()
-	encoder := json.NewEncoder(conn)
-	decoder := json.NewDecoder(conn)
+	return nil
+}
 
-	req := protocol.Delete_Request{
-		Filename: filename,
+// downloadChunk tries each replica of the chunk until one succeeds.
+// A failed attempt's data is overwritten by the next one, as writer
+// starts at the range's position every time.
+func (c *Client) downloadChunk(ctx context.Context, chunk protocol.Chunkinfo, offset int64, length int64, writer *io.OffsetWriter) error {
+	if chunk.Coded() {
+		return c.downloadShards(ctx, chunk, offset, length, writer)
 	}
-	payload, err := json.Marshal(req)
+	payload, err := json.Marshal(protocol.Download_Request{Filename: chunk.ID, Offset: offset, Length: length})
 	if err != nil {
-		return false, err
+		return err
 	}
-	err = encoder.Encode(protocol.Message{
-		Type:    protocol.DeleteReqC,
-		Payload: payload,
+	// Reading is harmless to repeat, so once every replica failed they are
+	// all tried again
+	return c.retry(ctx, idempotent, func() error {
+		err := fmt.Errorf("chunk %s has no replicas", chunk.ID)
+		for _, addr := range chunk.Locations {
+			if _, err = writer.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			err = c.downloadFrom(ctx, addr, payload, chunk.Size, length, writer)
+			if err == nil || ctx.Err() != nil {
+				return err
+			}
+			fmt.Println("Download of chunk", chunk.ID, "from", addr, "failed:", err)
+		}
+		return fmt.Errorf("all replicas of chunk %s failed, last error: %w", chunk.ID, err)
 	})
+}
+
+// downloadShards reads a range of an erasure-coded chunk from the data
+// shards it covers. If any of them fails, other shards are read until there
+// are enough to reconstruct it.
+func (c *Client) downloadShards(ctx context.Context, chunk protocol.Chunkinfo, offset int64, length int64, writer *io.OffsetWriter) error {
+	code, err := erasure.New(chunk.DataShards, len(chunk.Shards)-chunk.DataShards)
 	if err != nil {
-		return false, err
+		return err
 	}
+	size := chunk.Shards[0].Size
+	first, last := int(offset/size), int((offset+length-1)/size)
+	return c.retry(ctx, idempotent, func() error {
+		shards := make([][]byte, len(chunk.Shards))
+		found := 0
+		var err error
+		for i := first; i <= last; i++ {
+			if shards[i], err = c.fetchShard(ctx, chunk.Shards[i]); err == nil {
+				found++
+			} else if ctx.Err() != nil {
+				return err
+			}
+		}
 
-	// Receive response
-	var msg protocol.Message
-	err = decoder.Decode(&msg)
+		// Any DataShards shards make up for the ones that failed
+		if found < last-first+1 {
+			for i := range chunk.Shards {
+				if found >= chunk.DataShards {
+					break
+				}
+				if i >= first && i <= last {
+					continue
+				}
+				if shards[i], err = c.fetchShard(ctx, chunk.Shards[i]); err == nil {
+					found++
+				} else if ctx.Err() != nil {
+					return err
+				}
+			}
+			if found < chunk.DataShards {
+				return fmt.Errorf("read %d shards of chunk %s, %d are needed, last error: %w", found, chunk.ID, chunk.DataShards, err)
+			}
+			fmt.Println("Reconstructing chunk", chunk.ID, "from", found, "shards")
+			if err := code.Reconstruct(shards); err != nil {
+				return err
+			}
+		}
+
+		// Cut the range out of the data shards it covers
+		data := bytes.Join(shards[first:last+1], nil)
+		start := offset - int64(first)*size
+		if _, err := writer.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err = writer.Write(data[start : start+length])
+		return err
+	})
+}
+
+// fetchShard reads a whole shard from the first of its locations that succeeds
+func (c *Client) fetchShard(ctx context.Context, shard protocol.Chunkinfo) ([]byte, error) {
+	payload, err := json.Marshal(protocol.Download_Request{Filename: shard.ID})
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	if msg.Type != protocol.DeleteAckM {
-		return false, fmt.Errorf("DeleteAckM expected")
+	err = fmt.Errorf("shard %s has no location", shard.ID)
+	for _, addr := range shard.Locations {
+		var buf bytes.Buffer
+		if err = c.downloadFrom(ctx, addr, payload, shard.Size, shard.Size, &buf); err == nil {
+			return buf.Bytes(), nil
+		}
+		fmt.Println("Download of shard", shard.ID, "from", addr, "failed:", err)
 	}
-	var resp protocol.Delete_Response
-	err = json.Unmarshal(msg.Payload, &resp)
+	return nil, err
+}
+
+// downloadFrom fetches a range of a chunk from one replica
+func (c *Client) downloadFrom(ctx context.Context, addr string, payload json.RawMessage, size int64, length int64, writer io.Writer) error {
+	stream, err := c.openChunk(ctx, addr, payload, size, length)
 	if err != nil {
-		return false, err
+		return err
 	}
-	return resp.Success, nil
+	defer stream.Close()
+	_, err = io.Copy(writer, stream)
+	return err
+}
+
+// chunkStream is a range of a chunk as it arrives from a replica
+type chunkStream struct {
+	conn      net.Conn
+	data      io.Reader
+	remaining int64
+	hash      hash.Hash // Only set if the range is the whole chunk
+	checksum  string
 }
 
-func (c *Client) Lookup() (map[string]protocol.Fileinfo, error) {
-	conn, err := net.Dial("tcp", c.mainAddress)
+// openChunk requests a range of a chunk from one replica, checking the
+// chunk has the expected size. If the range is all of it, reading the
+// stream to its end also checks the checksum the node recorded for it.
+func (c *Client) openChunk(ctx context.Context, addr string, payload json.RawMessage, size int64, length int64) (*chunkStream, error) {
+	// Connect to storage server
+	storageConn, err := c.dial(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
-	encoder := json.NewEncoder(conn)
-	decoder := json.NewDecoder(conn)
-	err = encoder.Encode(protocol.Message{
-		Type: protocol.LookupReq,
+	stream, err := requestChunk(storageConn, payload, size, length)
+	if err != nil {
+		storageConn.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// requestChunk asks for a range of a chunk over storageConn and reads the ack
+func requestChunk(storageConn net.Conn, payload json.RawMessage, size int64, length int64) (*chunkStream, error) {
+	// Send download request
+	encoder := json.NewEncoder(storageConn)
+	decoder := json.NewDecoder(storageConn)
+	err := encoder.Encode(protocol.Message{
+		Type:    protocol.DownloadReq,
+		Payload: payload,
 	})
 	if err != nil {
 		return nil, err
@@ -257,13 +697,178 @@ func (c *Client) Lookup() (map[string]protocol.Fileinfo, error) {
 	if err != nil {
 		return nil, err
 	}
-	if msg.Type != protocol.LookupResp {
-		return nil, fmt.Errorf("LookupResp expected")
+	if err := msg.Err(); err != nil {
+		return nil, err
+	}
+	if msg.Type != protocol.DownloadAck {
+		return nil, fmt.Errorf("DownloadAck expected")
 	}
-	var resp protocol.Lookup_Response
-	err = json.Unmarshal(msg.Payload, &resp)
-	if err != nil {
+	var ack protocol.Download_Ack
+	if err := json.Unmarshal(msg.Payload, &ack); err != nil {
+		return nil, err
+	}
+	if ack.Size != size {
+		return nil, fmt.Errorf("replica has %d bytes, expected %d", ack.Size, size)
+	}
+	if ack.Length != length {
+		return nil, fmt.Errorf("replica sends %d bytes, expected %d", ack.Length, length)
+	}
+
+	// File data starts in whatever the decoder read past the ack,
+	// after the newline the encoder terminates every message with
+	data := io.MultiReader(decoder.Buffered(), storageConn)
+	var newline [1]byte
+	if _, err := io.ReadFull(data, newline[:]); err != nil {
 		return nil, err
 	}
-	return resp.Files, nil
+
+	stream := &chunkStream{
+		conn:      storageConn,
+		data:      io.LimitReader(data, length),
+		remaining: length,
+	}
+	if length == size && ack.Checksum != "" {
+		stream.hash = sha256.New()
+		stream.checksum = ack.Checksum
+	}
+	return stream, nil
+}
+
+func (s *chunkStream) Read(p []byte) (int, error) {
+	n, err := s.data.Read(p)
+	s.remaining -= int64(n)
+	if s.hash != nil {
+		s.hash.Write(p[:n])
+	}
+	if err == io.EOF && s.remaining > 0 {
+		return n, fmt.Errorf("received %d bytes too few", s.remaining)
+	}
+	if err == io.EOF && s.hash != nil {
+		if checksum := hex.EncodeToString(s.hash.Sum(nil)); checksum != s.checksum {
+			return n, fmt.Errorf("checksum mismatch, expected %s, received %s", s.checksum, checksum)
+		}
+	}
+	return n, err
+}
+
+func (s *chunkStream) Close() error {
+	return s.conn.Close()
+}
+
+func (c *Client) Delete(ctx context.Context, filename string) (bool, error) {
+	var resp protocol.Delete_Response
+	err := c.call(ctx, protocol.DeleteReqC, protocol.Delete_Request{Filename: filename}, protocol.DeleteAckM, &resp)
+	return resp.Success, err
+}
+
+// Lookup lists every file along with the liveness of every storage server
+func (c *Client) Lookup(ctx context.Context) (protocol.Lookup_Response, error) {
+	var resp protocol.Lookup_Response
+	err := c.call(ctx, protocol.LookupReq, nil, protocol.LookupResp, &resp)
+	return resp, err
+}
+
+// Decommission moves every chunk off a storage server and removes it from
+// the cluster. It returns once the drain is done, however long that takes.
+func (c *Client) Decommission(ctx context.Context, addr string) (protocol.Decommission_Response, error) {
+	var resp protocol.Decommission_Response
+	err := c.call(ctx, protocol.DecommissionReq, protocol.Decommission_Request{Addr: addr}, protocol.DecommissionResp, &resp)
+	return resp, err
+}
+
+// Balance plans moves that bring every storage server within threshold of
+// the mean utilization and starts them, or only plans them with dryRun. The
+// moves go on after it returns.
+func (c *Client) Balance(ctx context.Context, threshold float64, dryRun bool) (protocol.Balance_Response, error) {
+	var resp protocol.Balance_Response
+	req := protocol.Balance_Request{Threshold: threshold, DryRun: dryRun}
+	err := c.call(ctx, protocol.BalanceReq, req, protocol.BalanceResp, &resp)
+	return resp, err
+}
+
+// StopBalance stops the balance in progress after its current move
+func (c *Client) StopBalance(ctx context.Context) (protocol.Balance_Response, error) {
+	var resp protocol.Balance_Response
+	err := c.call(ctx, protocol.BalanceReq, protocol.Balance_Request{Stop: true}, protocol.BalanceResp, &resp)
+	return resp, err
+}
+
+// Mkdir creates a directory, and with parents any missing parent directories
+func (c *Client) Mkdir(ctx context.Context, path string, parents bool) (protocol.Dir_Response, error) {
+	var resp protocol.Dir_Response
+	err := c.call(ctx, protocol.MkdirReq, protocol.Mkdir_Request{Path: path, Parents: parents}, protocol.MkdirResp, &resp)
+	return resp, err
+}
+
+// Rmdir removes a directory, and with recursive every file and directory in it
+func (c *Client) Rmdir(ctx context.Context, path string, recursive bool) (protocol.Dir_Response, error) {
+	var resp protocol.Dir_Response
+	err := c.call(ctx, protocol.RmdirReq, protocol.Rmdir_Request{Path: path, Recursive: recursive}, protocol.RmdirResp, &resp)
+	return resp, err
+}
+
+// List returns the entries of a directory, and with recursive of its whole subtree
+func (c *Client) List(ctx context.Context, path string, recursive bool) (protocol.List_Response, error) {
+	var resp protocol.List_Response
+	err := c.call(ctx, protocol.ListReq, protocol.List_Request{Path: path, Recursive: recursive}, protocol.ListResp, &resp)
+	return resp, err
+}
+
+// Rename moves a file or directory to destination without moving any data
+func (c *Client) Rename(ctx context.Context, source string, destination string, overwrite bool) (protocol.Rename_Response, error) {
+	var resp protocol.Rename_Response
+	req := protocol.Rename_Request{Source: source, Destination: destination, Overwrite: overwrite}
+	err := c.call(ctx, protocol.RenameReq, req, protocol.RenameResp, &resp)
+	return resp, err
+}
+
+// readOnly are the requests that change nothing on the main server, so
+// sending one twice is harmless
+var readOnly = map[protocol.MessageType]bool{
+	protocol.DownloadReq: true,
+	protocol.LookupReq:   true,
+	protocol.ListReq:     true,
+}
+
+// call sends a single request to the main server and decodes its reply of
+// respType into resp. An Error reply is returned as a *protocol.Error_Response.
+func (c *Client) call(ctx context.Context, reqType protocol.MessageType, req any, respType protocol.MessageType, resp any) error {
+	policy := unsent
+	if readOnly[reqType] {
+		policy = idempotent
+	}
+	return c.retry(ctx, policy, func() error {
+		return c.callOnce(ctx, reqType, req, respType, resp)
+	})
+}
+
+// slowReplies are the requests the main server only answers once it is done
+// with the storage servers, after the drain of a decommission or once the
+// chunks of every deleted or replaced file are deleted, however long that takes
+var slowReplies = map[protocol.MessageType]bool{
+	protocol.DecommissionReq: true,
+	protocol.DeleteReqC:      true,
+	protocol.RmdirReq:        true,
+	protocol.RenameReq:       true,
+}
+
+func (c *Client) callOnce(ctx context.Context, reqType protocol.MessageType, req any, respType protocol.MessageType, resp any) error {
+	if c.config.ReadTimeout > 0 && !slowReplies[reqType] {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, c.config.ReadTimeout, errNoReply)
+		defer cancel()
+	}
+	err := c.main.Call(ctx, reqType, req, respType, resp)
+	if err != nil && ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return err
+}
+
+var errNoReply = errors.New("main server did not reply in time")
+
+// Close closes the connection to the main server, failing the calls still
+// waiting on it
+func (c *Client) Close() error {
+	return c.pool.Close()
 }
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"DistributedFileSystem/protocol"
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ctxConn is a connection that belongs to a single transfer
+type ctxConn struct {
+	net.Conn
+	ctx  context.Context
+	stop func() bool
+
+	// Longest a single read or write may block, 0 waits forever
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+// dial opens a connection of its own to addr, for a transfer of raw data
+// made under ctx, giving up after the client's dial timeout. Once ctx is
+// cancelled or its deadline passes the connection is closed, failing
+// whatever is in progress on it with the context's error.
+func (c *Client) dial(ctx context.Context, addr string) (*ctxConn, error) {
+	dialer := net.Dialer{Timeout: c.config.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", protocol.ErrNotSent, err)
+	}
+	return &ctxConn{
+		Conn:         conn,
+		ctx:          ctx,
+		stop:         context.AfterFunc(ctx, func() { conn.Close() }),
+		readTimeout:  c.config.ReadTimeout,
+		writeTimeout: c.config.WriteTimeout,
+	}, nil
+}
+
+func (c *ctxConn) Read(p []byte) (int, error) {
+	if c.readTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	n, err := c.Conn.Read(p)
+	if err != nil && c.ctx.Err() != nil {
+		err = c.ctx.Err()
+	}
+	return n, err
+}
+
+func (c *ctxConn) Write(p []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	n, err := c.Conn.Write(p)
+	if err != nil && c.ctx.Err() != nil {
+		err = c.ctx.Err()
+	}
+	return n, err
+}
+
+func (c *ctxConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"DistributedFileSystem/protocol"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+Retries
+A call that fails is only attempted again if doing so cannot change the
+outcome of the first attempt. Requests that only read, such as lookups and
+downloads, are retried after any failure of the connection. Requests that
+change something, such as uploads and deletes, are only retried when the
+connection could not be established, since once a request is sent the
+server may have acted on it even if its reply never arrived. A reply from
+the server is final either way, except that no leader could be found among
+replicating main servers, which did nothing.
+*/
+
+// idempotent allows retrying after any failure but a server's reply
+func idempotent(err error) bool {
+	var resp *protocol.Error_Response
+	return !errors.As(err, &resp) || resp.Code == protocol.ErrNotLeader
+}
+
+// unsent allows retrying only if the request never reached a server that acted on it
+func unsent(err error) bool {
+	return errors.Is(err, protocol.ErrNotSent) || protocol.CodeOf(err) == protocol.ErrNotLeader
+}
+
+// resumable allows retrying a chunk upload after any failure of the
+// connection, and while the node still holds the session of the failed one
+func resumable(err error) bool {
+	return idempotent(err) || protocol.CodeOf(err) == protocol.ErrInternal || protocol.CodeOf(err) == protocol.ErrExists
+}
+
+// retry runs op until it succeeds, fails in a way policy does not allow
+// retrying, ctx is done, or the client's attempts run out. It returns the
+// last error.
+func (c *Client) retry(ctx context.Context, policy func(error) bool, op func() error) error {
+	backoff := c.config.Backoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || ctx.Err() != nil || attempt >= c.config.Attempts || !policy(err) {
+			return err
+		}
+		fmt.Println("Attempt", attempt, "failed, retrying in", backoff, ":", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
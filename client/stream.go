@@ -0,0 +1,253 @@
+package client
+
+import (
+	"DistributedFileSystem/protocol"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+/*
+Streaming
+Create and Open let programs write and read remote files as streams, so data
+can be passed straight through from or to a network connection without a
+local copy. A FileWriter buffers one chunk at a time in memory and sends each
+to its replicas once it is full, allocating the chunks as it goes since the
+size of the file is not known in advance. A File reads the chunks in order
+over one connection each, and reconnects at the new offset after a seek.
+*/
+
+// FileWriter uploads a file as it is written. It holds up to one chunk, as
+// large as the main server's chunk size, in memory. The file only appears
+// once Close succeeds, and if a write or Close fails the upload is aborted.
+// It is not safe for concurrent use.
+type FileWriter struct {
+	c         *Client
+	ctx       context.Context
+	lease     string
+	chunkSize int64
+	buf       []byte
+	hash      hash.Hash
+	chunks    int
+	err       error // Set once the upload failed
+	closed    bool
+}
+
+// Create starts a streamed upload of remote. Every call the FileWriter makes
+// is made under ctx.
+func (c *Client) Create(ctx context.Context, remote string) (*FileWriter, error) {
+	var resp protocol.Upload_Response
+	req := protocol.Upload_Request{Filename: remote, Stream: true}
+	if err := c.call(ctx, protocol.UploadReq, req, protocol.UploadResp, &resp); err != nil {
+		return nil, err
+	}
+	if resp.ChunkSize <= 0 {
+		return nil, fmt.Errorf("main server did not open a streamed upload")
+	}
+	return &FileWriter{
+		c:         c,
+		ctx:       ctx,
+		lease:     resp.Lease,
+		chunkSize: resp.ChunkSize,
+		hash:      sha256.New(),
+	}, nil
+}
+
+func (w *FileWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := min(int(w.chunkSize)-len(w.buf), len(p))
+		w.buf = append(w.buf, p[:n]...)
+		w.hash.Write(p[:n])
+		written += n
+		p = p[n:]
+		if int64(len(w.buf)) == w.chunkSize {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close sends whatever is buffered and commits the file
+func (w *FileWriter) Close() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	if w.err != nil {
+		return w.err
+	}
+
+	// An empty file still has its one empty chunk
+	if len(w.buf) > 0 || w.chunks == 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	if err := w.c.commit(w.ctx, w.lease, hex.EncodeToString(w.hash.Sum(nil))); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
+
+// flush allocates a chunk for the buffered data and sends it to every replica
+func (w *FileWriter) flush() error {
+	var resp protocol.Allocate_Response
+	req := protocol.Allocate_Request{Lease: w.lease, Size: int64(len(w.buf))}
+	err := w.c.call(w.ctx, protocol.AllocateReq, req, protocol.AllocateResp, &resp)
+	if err == nil {
+		err = w.sendChunk(resp.Chunk)
+	}
+	if err != nil {
+		w.err = err
+		// Abort now rather than leaving the lease to expire
+		w.c.abort(context.WithoutCancel(w.ctx), w.lease)
+		return err
+	}
+	w.buf = w.buf[:0]
+	w.chunks++
+	return nil
+}
+
+func (w *FileWriter) sendChunk(chunk protocol.Chunkinfo) error {
+	sum := sha256.Sum256(w.buf)
+	payload, err := w.c.chunkRequest(w.lease, chunk, hex.EncodeToString(sum[:]))
+	if err != nil {
+		return err
+	}
+	for _, addr := range chunk.Locations {
+		section := io.NewSectionReader(bytes.NewReader(w.buf), 0, chunk.Size)
+		if err := w.c.uploadReplica(w.ctx, addr, payload, section); err != nil {
+			return fmt.Errorf("upload of chunk %s to %s failed: %w", chunk.ID, addr, err)
+		}
+	}
+	return nil
+}
+
+// File reads a remote file as a stream. Besides Read, Seek and Close it
+// offers the ReadAt and Size of its FileReader. It is not safe for
+// concurrent use, apart from ReadAt.
+type File struct {
+	*FileReader
+	offset int64
+	stream *chunkStream // Of the chunk offset is in, nil until the next read
+	closed bool
+}
+
+// Open looks up filename for reading as a stream. Like OpenReaderAt it
+// reads the file as it was when opened, and every read is made under ctx.
+func (c *Client) Open(ctx context.Context, filename string) (*File, error) {
+	reader, err := c.OpenReaderAt(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	return &File{FileReader: reader}, nil
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	for {
+		if f.offset >= f.size {
+			return 0, io.EOF
+		}
+		if f.stream == nil {
+			if err := f.open(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := f.stream.Read(p)
+		f.offset += int64(n)
+		if err != nil {
+			f.stream.Close()
+			f.stream = nil
+		}
+		if err == io.EOF {
+			// On to the next chunk
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// open starts streaming from offset to the end of its chunk, trying each
+// replica until one answers
+func (f *File) open() error {
+	var start int64 // Of the chunk within the file
+	for _, chunk := range f.chunks {
+		if f.offset >= start+chunk.Size {
+			start += chunk.Size
+			continue
+		}
+		length := start + chunk.Size - f.offset
+		payload, err := json.Marshal(protocol.Download_Request{Filename: chunk.ID, Offset: f.offset - start, Length: length})
+		if err != nil {
+			return err
+		}
+		return f.c.retry(f.ctx, idempotent, func() error {
+			err := fmt.Errorf("chunk %s has no replicas", chunk.ID)
+			for _, addr := range chunk.Locations {
+				f.stream, err = f.c.openChunk(f.ctx, addr, payload, chunk.Size, length)
+				if err == nil || f.ctx.Err() != nil {
+					return err
+				}
+				fmt.Println("Download of chunk", chunk.ID, "from", addr, "failed:", err)
+			}
+			return fmt.Errorf("all replicas of chunk %s failed, last error: %w", chunk.ID, err)
+		})
+	}
+	return io.EOF
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != f.offset && f.stream != nil {
+		f.stream.Close()
+		f.stream = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *File) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	if f.stream != nil {
+		f.stream.Close()
+		f.stream = nil
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package erasure
+
+import (
+	"fmt"
+)
+
+/*
+Reed-Solomon Erasure Coding
+Data is cut into Data shards of equal length, and Parity more shards are
+computed from them. Any Data of the Data+Parity shards are enough to get all
+of them back, so the shards survive the loss of any Parity of them.
+Arithmetic is over GF(2^8), every byte position of the shards is coded on
+its own. The encoding matrix is a Vandermonde matrix turned systematic, so
+the first Data shards are the data itself.
+*/
+
+type Code struct {
+	data   int
+	parity int
+	matrix [][]byte // (data+parity) x data, its top data rows are the identity
+}
+
+// MaxShards is how many shards a stripe can have in all
+const MaxShards = 256
+
+// New creates a code with the given numbers of data and parity shards
+func New(data int, parity int) (*Code, error) {
+	if data < 1 || parity < 1 {
+		return nil, fmt.Errorf("need at least one data and one parity shard, got %d+%d", data, parity)
+	}
+	if data+parity > MaxShards {
+		return nil, fmt.Errorf("at most %d shards in all, got %d+%d", MaxShards, data, parity)
+	}
+
+	// Any data rows of a Vandermonde matrix are invertible, and stay so
+	// once it is multiplied by the inverse of its top
+	vandermonde := make([][]byte, data+parity)
+	for r := range vandermonde {
+		vandermonde[r] = make([]byte, data)
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := invert(vandermonde[:data])
+	if err != nil {
+		return nil, err
+	}
+	return &Code{data: data, parity: parity, matrix: multiply(vandermonde, top)}, nil
+}
+
+// DataShards returns the number of data shards
+func (c *Code) DataShards() int {
+	return c.data
+}
+
+// ParityShards returns the number of parity shards
+func (c *Code) ParityShards() int {
+	return c.parity
+}
+
+// ShardSize returns the length of every shard of size bytes of data
+func ShardSize(size int64, data int) int64 {
+	return (size + int64(data) - 1) / int64(data)
+}
+
+// Split cuts data into data shards, padding the last with zeros, followed
+// by empty parity shards for Encode to fill
+func (c *Code) Split(data []byte) [][]byte {
+	size := ShardSize(int64(len(data)), c.data)
+	shards := make([][]byte, c.data+c.parity)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < c.data {
+			copy(shards[i], data[min(int64(i)*size, int64(len(data))):])
+		}
+	}
+	return shards
+}
+
+// Encode computes the parity shards from the data shards. Every shard
+// must be allocated and of the same length.
+func (c *Code) Encode(shards [][]byte) error {
+	if err := c.check(shards, false); err != nil {
+		return err
+	}
+	for i := c.data; i < c.data+c.parity; i++ {
+		combine(shards[i], c.matrix[i], shards[:c.data])
+	}
+	return nil
+}
+
+// Reconstruct fills in the missing shards, which are nil, from the others.
+// At least DataShards of them must be present.
+func (c *Code) Reconstruct(shards [][]byte) error {
+	if err := c.check(shards, true); err != nil {
+		return err
+	}
+
+	// Solve for the data from the first data shards present
+	var rows [][]byte
+	var present [][]byte
+	size := 0
+	for i, shard := range shards {
+		if shard != nil && len(rows) < c.data {
+			rows = append(rows, c.matrix[i])
+			present = append(present, shard)
+			size = len(shard)
+		}
+	}
+	if len(rows) < c.data {
+		return fmt.Errorf("%d shards present, at least %d needed", len(rows), c.data)
+	}
+	decode, err := invert(rows)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < c.data; i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			combine(shards[i], decode[i], present)
+		}
+	}
+
+	// Then recompute the missing parity from the data
+	for i := c.data; i < c.data+c.parity; i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			combine(shards[i], c.matrix[i], shards[:c.data])
+		}
+	}
+	return nil
+}
+
+// check makes sure there is one shard per row, all of the same length, and
+// unless missing is allowed none of them nil
+func (c *Code) check(shards [][]byte, missing bool) error {
+	if len(shards) != c.data+c.parity {
+		return fmt.Errorf("%d shards given, the code has %d", len(shards), c.data+c.parity)
+	}
+	size := -1
+	for i, shard := range shards {
+		if shard == nil {
+			if !missing {
+				return fmt.Errorf("shard %d is missing", i)
+			}
+			continue
+		}
+		if size >= 0 && len(shard) != size {
+			return fmt.Errorf("shard %d has %d bytes, expected %d", i, len(shard), size)
+		}
+		size = len(shard)
+	}
+	return nil
+}
+
+// combine sets dst to the sum of the shards weighted by coefficients
+func combine(dst []byte, coefficients []byte, shards [][]byte) {
+	clear(dst)
+	for j, shard := range shards {
+		coefficient := coefficients[j]
+		if coefficient == 0 {
+			continue
+		}
+		row := mulTable[coefficient]
+		for k, b := range shard {
+			dst[k] ^= row[b]
+		}
+	}
+}
+
+/*
+GF(2^8) Arithmetic
+Addition is XOR. Multiplication uses logarithms to the generator 2 modulo
+the polynomial x^8 + x^4 + x^3 + x^2 + 1.
+*/
+
+var (
+	expTable [510]byte // Doubled so exp[log a + log b] needs no modulo
+	logTable [256]byte
+	mulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := range 256 {
+		for b := range 256 {
+			mulTable[a][b] = gfMul(byte(a), byte(b))
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+func gfInv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	result := byte(1)
+	for range n {
+		result = gfMul(result, a)
+	}
+	return result
+}
+
+// multiply returns a x b
+func multiply(a, b [][]byte) [][]byte {
+	product := make([][]byte, len(a))
+	for r := range a {
+		product[r] = make([]byte, len(b[0]))
+		for c := range product[r] {
+			var sum byte
+			for k := range b {
+				sum ^= gfMul(a[r][k], b[k][c])
+			}
+			product[r][c] = sum
+		}
+	}
+	return product
+}
+
+// invert returns the inverse of a square matrix by Gauss-Jordan elimination
+func invert(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	work := make([][]byte, n)
+	for r := range work {
+		work[r] = make([]byte, 2*n)
+		copy(work[r], matrix[r])
+		work[r][n+r] = 1
+	}
+	for col := range n {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, fmt.Errorf("matrix is singular")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		scale := gfInv(work[col][col])
+		for c := range work[col] {
+			work[col][c] = gfMul(work[col][c], scale)
+		}
+		for r := range n {
+			if r == col || work[r][col] == 0 {
+				continue
+			}
+			factor := work[r][col]
+			for c := range work[r] {
+				work[r][c] ^= gfMul(factor, work[col][c])
+			}
+		}
+	}
+	inverse := make([][]byte, n)
+	for r := range inverse {
+		inverse[r] = work[r][n:]
+	}
+	return inverse, nil
+}
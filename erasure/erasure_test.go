@@ -0,0 +1,81 @@
+package erasure
+
+import (
+	"bytes"
+	"math/bits"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		data   int
+		parity int
+		size   int
+	}{
+		{data: 1, parity: 1, size: 100},
+		{data: 2, parity: 1, size: 0},
+		{data: 2, parity: 2, size: 1},
+		{data: 3, parity: 2, size: 1000},
+		{data: 4, parity: 2, size: 4096},
+		{data: 6, parity: 3, size: 1001},
+		{data: 10, parity: 4, size: 12345},
+	}
+	for _, test := range tests {
+		code, err := New(test.data, test.parity)
+		if err != nil {
+			t.Fatalf("New(%d, %d): %v", test.data, test.parity, err)
+		}
+		data := make([]byte, test.size)
+		for i := range data {
+			data[i] = byte(rand.UintN(256))
+		}
+		encoded := code.Split(data)
+		if err := code.Encode(encoded); err != nil {
+			t.Fatalf("%d+%d: Encode: %v", test.data, test.parity, err)
+		}
+		if joined := bytes.Join(encoded[:test.data], nil); !bytes.Equal(joined[:test.size], data) {
+			t.Fatalf("%d+%d: data shards do not hold the data", test.data, test.parity)
+		}
+
+		// Every subset of at most parity shards, as a bit mask of the dropped ones
+		total := test.data + test.parity
+		for dropped := uint(0); dropped < 1<<total; dropped++ {
+			if bits.OnesCount(dropped) > test.parity {
+				continue
+			}
+			shards := make([][]byte, total)
+			for i := range shards {
+				if dropped&(1<<i) == 0 {
+					shards[i] = slices.Clone(encoded[i])
+				}
+			}
+			if err := code.Reconstruct(shards); err != nil {
+				t.Fatalf("%d+%d without shards %b: Reconstruct: %v", test.data, test.parity, dropped, err)
+			}
+			for i := range shards {
+				if !bytes.Equal(shards[i], encoded[i]) {
+					t.Fatalf("%d+%d without shards %b: shard %d differs", test.data, test.parity, dropped, i)
+				}
+			}
+		}
+
+		// One more lost is too many
+		shards := slices.Clone(encoded)
+		for i := range test.parity + 1 {
+			shards[i] = nil
+		}
+		if err := code.Reconstruct(shards); err == nil {
+			t.Fatalf("%d+%d: Reconstruct without %d shards succeeded", test.data, test.parity, test.parity+1)
+		}
+	}
+}
+
+func TestNewLimits(t *testing.T) {
+	for _, scheme := range [][2]int{{0, 1}, {1, 0}, {200, 57}} {
+		if _, err := New(scheme[0], scheme[1]); err == nil {
+			t.Errorf("New(%d, %d) succeeded", scheme[0], scheme[1])
+		}
+	}
+}
@@ -3,11 +3,17 @@ package main
 import (
 	"DistributedFileSystem/client"
 	"DistributedFileSystem/mainserver"
+	"DistributedFileSystem/protocol"
 	"DistributedFileSystem/storageserver"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -15,26 +21,79 @@ func main() {
 
 	// Shared Args
 	listenaddr := flag.String("listen_addr", "", "Address to listen on")
+	heartbeat := flag.Duration("heartbeat_interval", 3*time.Second, "How often storage servers heartbeat to the main server")
 
 	// Main Server Args
-	storageaddrs := flag.String("storage_addrs", "", "Storage addresses, comma separated") //localhost:8081,localhost:8082 ...
+	storageaddrs := flag.String("storage_addrs", "", "Storage addresses, comma separated")               //localhost:8081,localhost:8082 ...
+	metadir := flag.String("meta_dir", "", "Directory to persist metadata in, empty keeps it in memory") // ./MainMeta ...
+	replication := flag.Int("replication", 1, "Number of storage servers every chunk is placed on")
+	chunksize := flag.Int64("chunk_size", 64<<20, "Size in bytes files are split into")
+	leasetimeout := flag.Duration("lease_timeout", 5*time.Minute, "How long an upload may stall before it is aborted")
+	nodetimeout := flag.Duration("node_timeout", 10*time.Second, "How long a storage server may take to answer a delete")
+	repairconcurrency := flag.Int("repair_concurrency", 4, "Number of chunks of dead storage servers copied elsewhere at once")
+	repairrate := flag.Int64("repair_rate", 50<<20, "Maximum bytes per second sent by all re-replication together, 0 is unlimited")
+	placement := flag.String("placement", "most-free", "How storage servers are picked for new chunks: most-free, round-robin, weighted-random, power-of-two, least-loaded or consistent-hash")
+	peers := flag.String("peers", "", "Every main server replicating the metadata, this one's -listen_addr among them, comma separated") //localhost:8080,localhost:8090 ...
 
 	// Storage Server Args
 	storagedir := flag.String("storage_dir", "", "Directory to store file") // ./StorageNode1 ...
 	availablemem := flag.Int64("available_mem", -1, "Available memory")
+	scrubinterval := flag.Duration("scrub_interval", 24*time.Hour, "How often every stored file is checked against its checksum, 0 disables")
+	scrubrate := flag.Int64("scrub_rate", 10<<20, "Maximum bytes per second read by the scrubber")
+	sessiontimeout := flag.Duration("session_timeout", time.Hour, "How long the partial data of an interrupted upload is kept for it to resume, 0 keeps it until restart")
+	deregister := flag.Bool("deregister_on_exit", false, "Drain every file to other nodes before exiting on interrupt")
+
+	// Client and Storage Server Args
+	mainaddr := flag.String("main_addr", "", "Main server address, or every replicating main server's, comma separated")
 
 	// Client Args
-	mainaddr := flag.String("main_addr", "", "Main server address")
-	command := flag.String("cmd", "", "Command to execute: upload, download, delete, lookup")
-	filename := flag.String("filename", "", "Filename to upload/download/delete")
+	command := flag.String("cmd", "", "Command to execute: upload, download, delete, lookup, decommission, balance, mkdir, rmdir, ls, rename")
+	filename := flag.String("filename", "", "Local file to upload, or remote file to download/delete")
+	remote := flag.String("remote", "", "Remote name to upload as, defaults to the base name of -filename")
+	resume := flag.Bool("resume", false, "Continue an interrupted upload of -filename instead of starting over")
+	erasurescheme := flag.String("erasure", "", "Store the upload erasure-coded as data+parity shards, like 6+3, instead of replicated")
 	output := flag.String("output", "", "Output filename for download")
+	offset := flag.Int64("offset", 0, "Byte of the file to start downloading at")
+	length := flag.Int64("length", 0, "Number of bytes to download, 0 downloads to the end of the file")
+	node := flag.String("node", "", "Storage server address to decommission")
+	threshold := flag.Float64("threshold", 0.1, "How far from the mean utilization balance leaves every storage server, a fraction of its capacity")
+	dryrun := flag.Bool("dry_run", false, "Only print the moves balance would make")
+	stopbalance := flag.Bool("stop", false, "Stop the balance in progress")
+	dirpath := flag.String("path", "", "Directory for mkdir/rmdir/ls, ls defaults to the root, or file or directory to rename")
+	dest := flag.String("dest", "", "New path for rename")
+	overwrite := flag.Bool("overwrite", false, "Replace an existing destination with rename")
+	parents := flag.Bool("parents", false, "Create missing parent directories with mkdir")
+	recursive := flag.Bool("recursive", false, "Remove or list the whole subtree with rmdir/ls")
+	dialtimeout := flag.Duration("dial_timeout", 5*time.Second, "How long connecting to a server may take, 0 waits forever")
+	readtimeout := flag.Duration("read_timeout", 30*time.Second, "How long a server may stay silent during a call, 0 waits forever")
+	writetimeout := flag.Duration("write_timeout", 30*time.Second, "How long sending to a server may stall during a call, 0 waits forever")
+	attempts := flag.Int("attempts", 4, "Times a failed call is attempted in all, calls that change something only if the server could not be reached")
+	backoff := flag.Duration("retry_backoff", time.Second, "Wait before the first retry of a call, doubled for every further one")
 
 	flag.Parse()
 
 	switch *role {
 	case "main":
-		storageList := strings.Split(*storageaddrs, ",")
-		server, err := mainserver.NewMainServer(*listenaddr, storageList)
+		policy, err := mainserver.NewPlacement(*placement)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		server, err := mainserver.NewMainServer(mainserver.Config{
+			Addr:         *listenaddr,
+			StorageAddrs: splitByComma(*storageaddrs),
+			MetaDir:      *metadir,
+			Peers:        splitByComma(*peers),
+			Replication:  *replication,
+			ChunkSize:    *chunksize,
+			Placement:    policy,
+
+			HeartbeatInterval: *heartbeat,
+			LeaseTimeout:      *leasetimeout,
+			NodeTimeout:       *nodetimeout,
+			RepairConcurrency: *repairconcurrency,
+			RepairRate:        *repairrate,
+		})
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -51,26 +110,79 @@ func main() {
 			os.Exit(1)
 		}
 
-		server, err := storageserver.NewStorageServer(*listenaddr, *storagedir, *availablemem)
+		server, err := storageserver.NewStorageServer(storageserver.Config{
+			Addr:      *listenaddr,
+			Dir:       *storagedir,
+			Mem:       *availablemem,
+			MainAddrs: splitByComma(*mainaddr),
+
+			HeartbeatInterval: *heartbeat,
+			ScrubInterval:     *scrubinterval,
+			ScrubRate:         *scrubrate,
+			SessionTimeout:    *sessiontimeout,
+		})
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
 
+		if *deregister {
+			if *mainaddr == "" {
+				fmt.Println("Main address is required to deregister")
+				os.Exit(1)
+			}
+			go func() {
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+				<-signals
+				fmt.Println("Deregistering, draining files to other nodes")
+				resp, err := server.Deregister()
+				if err != nil {
+					fmt.Println("Deregistration Failed", err)
+					os.Exit(1)
+				}
+				fmt.Println("Deregistered, moved", resp.Moved, "chunks")
+				os.Exit(0)
+			}()
+		}
+
 		fmt.Println("Storage server listening on", *listenaddr)
 		server.Start()
 
 	case "client":
-		client := client.NewClient(*mainaddr)
+		client := client.NewClient(client.Config{
+			MainAddrs: splitByComma(*mainaddr),
+
+			DialTimeout:  *dialtimeout,
+			ReadTimeout:  *readtimeout,
+			WriteTimeout: *writetimeout,
+			Attempts:     *attempts,
+			Backoff:      *backoff,
+		})
+
+		// An interrupt cancels the command, an interrupted upload can be resumed
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
 		switch *command {
 		case "upload":
 			if *filename == "" {
 				fmt.Println("Filename is required")
 				os.Exit(1)
 			}
-			err := client.Upload(*filename)
+			var err error
+			switch {
+			case *resume:
+				err = client.Resume(ctx, *filename)
+			case *erasurescheme != "":
+				var scheme protocol.Erasure
+				if scheme, err = protocol.ParseErasure(*erasurescheme); err == nil {
+					err = client.UploadErasure(ctx, *filename, *remote, scheme)
+				}
+			default:
+				err = client.Upload(ctx, *filename, *remote)
+			}
 			if err != nil {
-				fmt.Println(err)
+				printError(err)
 				os.Exit(1)
 			}
 			fmt.Println("Upload successful")
@@ -79,8 +191,8 @@ func main() {
 				fmt.Println("Filename and Output is required")
 				os.Exit(1)
 			}
-			if err := client.Download(*filename, *output); err != nil {
-				fmt.Println(err)
+			if err := client.DownloadRange(ctx, *filename, *output, *offset, *length); err != nil {
+				printError(err)
 				os.Exit(1)
 			}
 			fmt.Println("Download successful")
@@ -89,21 +201,130 @@ func main() {
 				fmt.Println("Filename is required")
 				os.Exit(1)
 			}
-			success, err := client.Delete(*filename)
-			if err != nil || !success {
+			success, err := client.Delete(ctx, *filename)
+			if err != nil {
+				printError(err)
+				os.Exit(1)
+			}
+			if !success {
 				fmt.Println("Deletion Failed")
 				os.Exit(1)
 			}
 			fmt.Println("Deletion successful")
 		case "lookup":
-			files, err := client.Lookup()
+			resp, err := client.Lookup(ctx)
+			if err != nil {
+				printError(err)
+				os.Exit(1)
+			}
+			if resp.Leader != "" {
+				fmt.Println("Leader:", resp.Leader, "Term:", resp.Term)
+			}
+			for addr, node := range resp.Nodes {
+				fmt.Println("Storage:", addr, "Status:", node.Status, "Available:", node.Availmem, "Reported:", node.Reported, "Capacity:", node.Capacity,
+					"Reserved:", node.Reserved, "Files:", node.FileCount, "Load:", node.Load, "Draining:", node.Draining, "Last Heartbeat:", node.LastHeartbeat.Format(time.RFC3339))
+			}
+			for _, file := range resp.Files {
+				fmt.Println("Filename:", file.Filename, "Size:", file.Size, "SHA-256:", file.Checksum, "Chunks:", len(file.Chunks), "Corrupt:", file.Corrupt)
+				for i, chunk := range file.Chunks {
+					if chunk.Coded() {
+						fmt.Println("  Chunk", i, chunk.ID, "Size:", chunk.Size, "Erasure:", protocol.Erasure{Data: chunk.DataShards, Parity: len(chunk.Shards) - chunk.DataShards})
+						for j, shard := range chunk.Shards {
+							fmt.Println("    Shard", j, shard.ID, "Size:", shard.Size, "Locations:", describeLocations(shard.Locations, resp.Nodes))
+						}
+						continue
+					}
+					fmt.Println("  Chunk", i, chunk.ID, "Size:", chunk.Size, "Locations:", describeLocations(chunk.Locations, resp.Nodes))
+				}
+			}
+		case "decommission":
+			if *node == "" {
+				fmt.Println("Node is required")
+				os.Exit(1)
+			}
+			resp, err := client.Decommission(ctx, *node)
+			if err != nil {
+				printError(err)
+				os.Exit(1)
+			}
+			fmt.Println("Decommission successful, moved", resp.Moved, "chunks")
+		case "balance":
+			if *stopbalance {
+				resp, err := client.StopBalance(ctx)
+				if err != nil {
+					printError(err)
+					os.Exit(1)
+				}
+				fmt.Println("Balance stopped, moved", resp.Moved, "chunks")
+				break
+			}
+			resp, err := client.Balance(ctx, *threshold, *dryrun)
+			if err != nil {
+				printError(err)
+				os.Exit(1)
+			}
+			fmt.Printf("Mean utilization: %.1f%%\n", resp.Mean*100)
+			for addr, utilization := range resp.Utilization {
+				fmt.Printf("Storage: %s Utilization: %.1f%%\n", addr, utilization*100)
+			}
+			for _, move := range resp.Moves {
+				fmt.Println("Move chunk", move.Chunk, "Size:", move.Size, "from", move.From, "to", move.To)
+			}
+			switch {
+			case len(resp.Moves) == 0:
+				fmt.Println("Every storage server is within", *threshold, "of the mean")
+			case *dryrun:
+				fmt.Println("Dry run,", len(resp.Moves), "moves planned")
+			default:
+				fmt.Println("Balance started,", len(resp.Moves), "moves planned")
+			}
+		case "mkdir", "rmdir":
+			if *dirpath == "" {
+				fmt.Println("Path is required")
+				os.Exit(1)
+			}
+			var resp protocol.Dir_Response
+			var err error
+			if *command == "mkdir" {
+				resp, err = client.Mkdir(ctx, *dirpath, *parents)
+			} else {
+				resp, err = client.Rmdir(ctx, *dirpath, *recursive)
+			}
 			if err != nil {
-				fmt.Println(err)
+				printError(err)
 				os.Exit(1)
 			}
-			for _, file := range files {
-				fmt.Println("Filename:", file.Filename, "Size:", file.Size)
+			if resp.Message != "" {
+				fmt.Println(resp.Message)
+			}
+			fmt.Println(*command, "successful")
+		case "ls":
+			resp, err := client.List(ctx, *dirpath, *recursive)
+			if err != nil {
+				printError(err)
+				os.Exit(1)
 			}
+			for _, entry := range resp.Entries {
+				if entry.IsDir {
+					fmt.Println("dir ", entry.Path+"/")
+				} else {
+					fmt.Println("file", entry.Path, entry.Size)
+				}
+			}
+		case "rename":
+			if *dirpath == "" || *dest == "" {
+				fmt.Println("Path and Dest is required")
+				os.Exit(1)
+			}
+			resp, err := client.Rename(ctx, *dirpath, *dest, *overwrite)
+			if err != nil {
+				printError(err)
+				os.Exit(1)
+			}
+			if resp.Message != "" {
+				fmt.Println(resp.Message)
+			}
+			fmt.Println("Rename successful")
 		default:
 			fmt.Println("Invalid command")
 			os.Exit(1)
@@ -115,9 +336,28 @@ func main() {
 	}
 }
 
+// describeLocations lists addresses along with the status of each
+func describeLocations(addrs []string, nodes map[string]protocol.Nodeinfo) string {
+	locations := make([]string, len(addrs))
+	for i, addr := range addrs {
+		locations[i] = addr + "(" + string(nodes[addr].Status) + ")"
+	}
+	return strings.Join(locations, ",")
+}
+
 func splitByComma(input string) []string {
 	if input == "" {
 		return nil
 	}
 	return strings.Split(input, ",")
 }
+
+// printError prints err, prefixed by its code if a server sent one
+func printError(err error) {
+	var resp *protocol.Error_Response
+	if errors.As(err, &resp) {
+		fmt.Println(string(resp.Code)+":", err)
+		return
+	}
+	fmt.Println(err)
+}
@@ -0,0 +1,279 @@
+package mainserver
+
+import (
+	"DistributedFileSystem/protocol"
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+Balancing
+New chunks go where the placement policy puts them, but nothing moves
+chunks already stored, so a node added to a full cluster stays nearly empty.
+A balance compares every live node's utilization, the used fraction of its
+capacity, with the mean of the whole cluster, and plans moves of chunk
+replicas and shards from nodes above it to nodes below it until every node is
+within the threshold of the mean, or nothing more can move. The moves then
+run one at a time in the background. A moved chunk is copied, recorded at its
+new location, and only deleted from the old one after balanceGrace, so
+downloads that looked it up before keep reading. Balances live in memory
+only and end with a change of leader.
+*/
+
+// balanceGrace is how long the old copy of a moved chunk is kept
+const balanceGrace = time.Minute
+
+type Balancer struct {
+	lock    sync.Mutex
+	run     *balanceRun      // Nil unless a balance is in progress
+	leaving map[string]int64 // Bytes of moved chunks each node still has to delete
+}
+
+type balanceRun struct {
+	cancel context.CancelFunc
+	moved  int
+}
+
+// A chunk replica or shard as seen while planning
+type placement struct {
+	block protocol.Chunkinfo
+	chunk string // ID of the chunk it is a replica or shard of
+}
+
+func NewBalancer() *Balancer {
+	return &Balancer{leaving: make(map[string]int64)}
+}
+
+// Balance plans a balance and starts it unless request.DryRun, or stops the
+// one in progress with request.Stop
+func (ms *MainServer) Balance(request protocol.Balance_Request) (protocol.Balance_Response, error) {
+	ms.balancer.lock.Lock()
+	defer ms.balancer.lock.Unlock()
+	run := ms.balancer.run
+
+	if request.Stop {
+		if run == nil {
+			return protocol.Balance_Response{Success: true}, nil
+		}
+		run.cancel()
+		ms.balancer.run = nil
+		fmt.Println("Balance stopped after", run.moved, "moves")
+		return protocol.Balance_Response{Success: true, Moved: run.moved}, nil
+	}
+
+	if request.Threshold <= 0 || request.Threshold >= 1 {
+		return protocol.Balance_Response{}, protocol.Errorf(protocol.ErrInvalid, "threshold must be between 0 and 1, got %v", request.Threshold)
+	}
+	if run != nil && !request.DryRun {
+		return protocol.Balance_Response{}, protocol.Errorf(protocol.ErrExists, "a balance is already in progress")
+	}
+	mean, utilization, moves := ms.planBalance(request.Threshold)
+	resp := protocol.Balance_Response{
+		Success:     true,
+		Mean:        mean,
+		Utilization: utilization,
+		Moves:       moves,
+		Running:     run != nil,
+	}
+	if request.DryRun || len(moves) == 0 {
+		return resp, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	run = &balanceRun{cancel: cancel}
+	ms.balancer.run = run
+	go ms.runBalance(ctx, run, moves)
+	resp.Running = true
+	return resp, nil
+}
+
+// planBalance returns the mean utilization of the live nodes, the
+// utilization of each, and the moves that bring them within threshold of
+// the mean. Each move goes from the fullest node that has a chunk to give to
+// the emptiest node that can take it, and is the largest chunk that does not
+// leave the target fuller than the source.
+func (ms *MainServer) planBalance(threshold float64) (float64, map[string]float64, []protocol.Move) {
+	used := make(map[string]int64)
+	free := make(map[string]int64)
+	capacity := make(map[string]int64)
+	var totalUsed, totalCapacity int64
+	for addr, node := range ms.Storage.ListNodes() {
+		if node.Status != protocol.NodeAlive || node.Draining || node.Capacity <= 0 {
+			continue
+		}
+		// Chunks that already moved away are as good as gone
+		used[addr] = node.Capacity - node.Availmem - ms.balancer.leaving[addr]
+		free[addr] = node.Availmem - node.Reserved
+		capacity[addr] = node.Capacity
+		totalUsed += used[addr]
+		totalCapacity += node.Capacity
+	}
+	if totalCapacity == 0 {
+		return 0, nil, nil
+	}
+	mean := float64(totalUsed) / float64(totalCapacity)
+	fraction := func(addr string, delta int64) float64 {
+		return float64(used[addr]+delta) / float64(capacity[addr])
+	}
+	utilization := make(map[string]float64, len(used))
+	for addr := range used {
+		utilization[addr] = fraction(addr, 0)
+	}
+
+	// What each node holds, and who holds each chunk
+	held := make(map[string][]placement)
+	holders := make(map[string][]string)
+	for _, file := range ms.FileTable.ListFiles() {
+		for i, chunk := range file.Chunks {
+			holders[chunk.ID] = chunk.Holders()
+			for _, block := range protocol.Blocks(file.Chunks[i : i+1]) {
+				for _, addr := range block.Locations {
+					if _, participates := used[addr]; participates {
+						held[addr] = append(held[addr], placement{block: *block, chunk: chunk.ID})
+					}
+				}
+			}
+		}
+	}
+	for addr := range held {
+		slices.SortFunc(held[addr], func(a, b placement) int {
+			return cmp.Compare(b.block.Size, a.block.Size)
+		})
+	}
+
+	// A moved chunk is not moved again, so this ends
+	var moves []protocol.Move
+	for {
+		addrs := make([]string, 0, len(used))
+		for addr := range used {
+			addrs = append(addrs, addr)
+		}
+		slices.SortFunc(addrs, func(a, b string) int {
+			return cmp.Or(cmp.Compare(fraction(b, 0), fraction(a, 0)), cmp.Compare(a, b))
+		})
+		if len(addrs) < 2 || fraction(addrs[0], 0)-mean <= threshold && mean-fraction(addrs[len(addrs)-1], 0) <= threshold {
+			break
+		}
+
+		move, found := protocol.Move{}, false
+		for _, source := range addrs {
+			if found || fraction(source, 0) <= mean {
+				break
+			}
+			for _, target := range slices.Backward(addrs) {
+				if fraction(target, 0) >= mean {
+					break
+				}
+				i := slices.IndexFunc(held[source], func(p placement) bool {
+					size := p.block.Size
+					return size <= free[target] && !slices.Contains(holders[p.chunk], target) &&
+						fraction(target, size) <= fraction(source, -size)
+				})
+				if i < 0 {
+					continue
+				}
+				p := held[source][i]
+				held[source] = slices.Delete(held[source], i, i+1)
+				holders[p.chunk] = append(holders[p.chunk], target)
+				used[source] -= p.block.Size
+				used[target] += p.block.Size
+				free[target] -= p.block.Size
+				move, found = protocol.Move{Chunk: p.block.ID, Size: p.block.Size, From: source, To: target}, true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+		moves = append(moves, move)
+	}
+	return mean, utilization, moves
+}
+
+// runBalance carries out the moves one after the other, until they are done
+// or the balance is stopped
+func (ms *MainServer) runBalance(ctx context.Context, run *balanceRun, moves []protocol.Move) {
+	fmt.Println("Balancing, moving", len(moves), "chunks")
+	failed := 0
+	for _, move := range moves {
+		if ctx.Err() != nil || !ms.leading() {
+			break
+		}
+		if err := ms.moveChunk(move); err != nil {
+			fmt.Println("Move of chunk", move.Chunk, "from", move.From, "to", move.To, "Failed:", err)
+			failed++
+			continue
+		}
+		ms.balancer.lock.Lock()
+		run.moved++
+		ms.balancer.lock.Unlock()
+	}
+
+	ms.balancer.lock.Lock()
+	defer ms.balancer.lock.Unlock()
+	if ms.balancer.run == run {
+		ms.balancer.run = nil
+		fmt.Println("Balance done, moved", run.moved, "chunks,", failed, "failed")
+	}
+	run.cancel()
+}
+
+// moveChunk copies a chunk replica or shard to the move's target, records it
+// there instead of on the source and deletes the source's copy after
+// balanceGrace. A chunk that was deleted, or moved off the source, since the
+// move was planned is left alone.
+func (ms *MainServer) moveChunk(move protocol.Move) error {
+	block, holders, exists := ms.findBlock(move.Chunk)
+	if !exists || !slices.Contains(block.Locations, move.From) {
+		return nil
+	}
+	if slices.Contains(holders, move.To) {
+		return protocol.Errorf(protocol.ErrExists, "%s already holds a copy of the chunk", move.To)
+	}
+	if !ms.reserveOn(move.To, block.Size) {
+		return protocol.Errorf(protocol.ErrNoSpace, "no room on %s", move.To)
+	}
+	if err := ms.copyChunk(block, []string{move.From}, move.To, ms.repairRate); err != nil {
+		return err
+	}
+	if !ms.moveReplica(block, move.From, move.To) {
+		return nil
+	}
+
+	ms.balancer.lock.Lock()
+	ms.balancer.leaving[move.From] += block.Size
+	ms.balancer.lock.Unlock()
+	time.AfterFunc(balanceGrace, func() {
+		defer func() {
+			ms.balancer.lock.Lock()
+			defer ms.balancer.lock.Unlock()
+			if ms.balancer.leaving[move.From] -= block.Size; ms.balancer.leaving[move.From] == 0 {
+				delete(ms.balancer.leaving, move.From)
+			}
+		}()
+		// Moved back in the meantime
+		if current, _, exists := ms.findBlock(block.ID); exists && slices.Contains(current.Locations, move.From) {
+			return
+		}
+		if ms.leading() && ms.DeleteRequest(move.From, block.ID) {
+			ms.Storage.ChangeMem(move.From, +block.Size)
+		}
+	})
+	return nil
+}
+
+// findBlock returns a replicated chunk or a shard by ID, along with every
+// storage server holding a replica or shard of its chunk
+func (ms *MainServer) findBlock(id string) (protocol.Chunkinfo, []string, bool) {
+	if file, i, exists := ms.FileTable.FindChunk(id); exists {
+		return file.Chunks[i], file.Chunks[i].Holders(), true
+	}
+	if chunk, i, exists := ms.FileTable.FindShard(id); exists {
+		return chunk.Shards[i], chunk.Holders(), true
+	}
+	return protocol.Chunkinfo{}, nil, false
+}
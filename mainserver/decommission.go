@@ -0,0 +1,123 @@
+package mainserver
+
+import (
+	"DistributedFileSystem/protocol"
+	"fmt"
+	"slices"
+)
+
+// Decommission drains every chunk replica and shard off a storage server
+// onto other servers and then removes it from the storage list. Uploads in
+// progress with chunks on it are aborted, or drained once committed. If any
+// chunk cannot be moved the node stays in the list, and it returns how many
+// were moved.
+func (ms *MainServer) Decommission(addr string) (int, error) {
+	if !ms.Storage.SetDraining(addr, true) {
+		return 0, protocol.Errorf(protocol.ErrNotFound, "unknown storage server %s", addr)
+	}
+	ms.abortLeasesOn(addr)
+
+	moved, failed := 0, 0
+	for _, file := range ms.FileTable.ListFiles() {
+		for i, chunk := range file.Chunks {
+			for _, block := range protocol.Blocks(file.Chunks[i : i+1]) {
+				if !slices.Contains(block.Locations, addr) {
+					continue
+				}
+				err := ms.evacuate(*block, chunk.Holders(), addr)
+				if err != nil && chunk.Coded() {
+					// A shard that cannot be copied is rebuilt from the others
+					fmt.Println("Could not copy shard", block.ID, "off", addr, err, ", rebuilding it")
+					if err = ms.rebuildShard(block.ID, addr, 0); err == nil && ms.DeleteRequest(addr, block.ID) {
+						ms.Storage.ChangeMem(addr, +block.Size)
+					}
+				}
+				if err != nil {
+					fmt.Println("Could not move chunk", block.ID, "of", file.Filename, "off", addr, err)
+					failed++
+					continue
+				}
+				moved++
+			}
+		}
+	}
+
+	if failed > 0 {
+		ms.Storage.SetDraining(addr, false)
+		return moved, protocol.Errorf(protocol.ErrNoSpace, "%d chunk replicas could not be moved off %s, %d were", failed, addr, moved)
+	}
+	if err := ms.Storage.Retire(addr); err != nil {
+		ms.Storage.SetDraining(addr, false)
+		return moved, err
+	}
+	fmt.Println("Decommissioned", addr, ", moved", moved, "chunk replicas")
+	return moved, nil
+}
+
+// evacuate copies a chunk or shard from addr to a new storage server outside
+// avoid and then drops addr's replica
+func (ms *MainServer) evacuate(chunk protocol.Chunkinfo, avoid []string, addr string) error {
+	targets := ms.reserveStorage(chunk.ID, chunk.Size, 1, avoid)
+	if targets == nil {
+		return protocol.Errorf(protocol.ErrNoSpace, "no storage available")
+	}
+	target := targets[0]
+
+	// Prefer copying from the draining node, fall back to the other replicas
+	var sources []string
+	if node, _ := ms.Storage.GetNode(addr); node.Status == protocol.NodeAlive {
+		sources = append(sources, addr)
+	}
+	for _, location := range chunk.Locations {
+		if location != addr {
+			sources = append(sources, location)
+		}
+	}
+
+	if err := ms.copyChunk(chunk, sources, target, 0); err != nil {
+		return err
+	}
+	ms.moveReplica(chunk, addr, target)
+
+	if ms.DeleteRequest(addr, chunk.ID) {
+		ms.Storage.ChangeMem(addr, +chunk.Size)
+	}
+	return nil
+}
+
+// copyChunk puts a new replica of the chunk on target from the first source
+// that succeeds, sent at no more than rate bytes per second unless it is 0.
+// The chunk's size must already be reserved on target, and is given back if
+// no source succeeds.
+func (ms *MainServer) copyChunk(chunk protocol.Chunkinfo, sources []string, target string, rate int64) error {
+	err := fmt.Errorf("no replica to copy from")
+	for _, source := range sources {
+		if err = ms.replicateChunk(source, target, chunk, rate); err == nil {
+			fmt.Println("Copied chunk", chunk.ID, "from", source, "to", target)
+			return nil
+		}
+		fmt.Println("Copy of chunk", chunk.ID, "from", source, "Failed:", err)
+	}
+	ms.Storage.Reserve(target, -chunk.Size)
+	return err
+}
+
+// moveReplica records that a chunk's replica on from now lives on to, or
+// that to holds a new replica if from is empty. If the chunk was deleted in
+// the meantime, the new copy is deleted too and it returns false.
+func (ms *MainServer) moveReplica(chunk protocol.Chunkinfo, from string, to string) bool {
+	_, exists := ms.FileTable.UpdateChunk(chunk.ID, func(_ *protocol.Fileinfo, current *protocol.Chunkinfo) bool {
+		current.Locations = slices.DeleteFunc(current.Locations, func(location string) bool {
+			return location == from || location == to
+		})
+		current.Locations = append(current.Locations, to)
+		return true
+	})
+	if !exists {
+		ms.Storage.Reserve(to, -chunk.Size)
+		ms.DeleteRequest(to, chunk.ID)
+		return false
+	}
+	ms.settleReplica(to, chunk.Size)
+	return true
+}
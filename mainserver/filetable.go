@@ -2,35 +2,150 @@ package mainserver
 
 import (
 	"DistributedFileSystem/protocol"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
 	"sync"
 )
 
+/*
+File Table
+Files and directories form a tree rooted at "/". Every name is a cleaned
+absolute path, so "a/b", "/a/./b" and "/a/b/" all refer to "/a/b".
+How a file is named here has no bearing on how its chunks are named on
+storage servers.
+*/
+
 type FileTable struct {
-	lock  sync.RWMutex
-	files map[string]protocol.Fileinfo
+	lock     sync.RWMutex // Held to read the table and to apply a change
+	write    sync.Mutex   // Held by a mutation from its checks until it is recorded
+	files    map[string]protocol.Fileinfo
+	dirs     map[string]bool
+	children map[string]map[string]bool // Directory -> Names of its entries
+	chunks   map[string]string          // Chunk or shard ID -> Filename
+	recorder Recorder                   // Nil keeps changes in memory only
 }
 
 func NewFileTable() *FileTable {
 	return &FileTable{
-		files: make(map[string]protocol.Fileinfo),
+		files:    make(map[string]protocol.Fileinfo),
+		dirs:     map[string]bool{"/": true},
+		children: map[string]map[string]bool{"/": {}},
+		chunks:   make(map[string]string),
 	}
 }
 
-func (ft *FileTable) AddFile(filename string, file protocol.Fileinfo) {
-	ft.lock.Lock()
-	ft.files[filename] = file
-	ft.lock.Unlock()
+// NormalizePath turns a client supplied name into the absolute path it refers to
+func NormalizePath(name string) string {
+	return path.Clean("/" + name)
 }
 
-func (ft *FileTable) RemoveFile(filename string) bool {
-	ft.lock.Lock()
-	defer ft.lock.Unlock()
-	_, exists := ft.files[filename]
-	if exists {
-		delete(ft.files, filename)
-		return true
+// CheckCreate returns an error if no file can be created at filename,
+// because it already exists, is a directory or one of its parents is a file
+func (ft *FileTable) CheckCreate(filename string) error {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
+	return ft.checkCreate(filename)
+}
+
+// Callers hold ft.lock.
+func (ft *FileTable) checkCreate(filename string) error {
+	if _, exists := ft.files[filename]; exists {
+		return protocol.Errorf(protocol.ErrExists, "%s already exists", filename)
+	}
+	if ft.dirs[filename] {
+		return protocol.Errorf(protocol.ErrInvalid, "%s is a directory", filename)
+	}
+	for dir := path.Dir(filename); dir != "/"; dir = path.Dir(dir) {
+		if _, exists := ft.files[dir]; exists {
+			return protocol.Errorf(protocol.ErrInvalid, "%s is a file", dir)
+		}
 	}
-	return false
+	return nil
+}
+
+// AddFile records a new file in an existing directory. Uploads create the
+// directory when they start, so one removed or renamed before the upload is
+// committed fails it rather than coming back. The check and the insert are
+// one step, so of two concurrent uploads of the same name exactly one succeeds.
+func (ft *FileTable) AddFile(filename string, file protocol.Fileinfo) error {
+	_, err := ft.mutate(func() ([]LogEntry, error) {
+		if err := ft.checkCreate(filename); err != nil {
+			return nil, err
+		}
+		if !ft.dirs[path.Dir(filename)] {
+			return nil, protocol.Errorf(protocol.ErrNotFound, "%s does not exist", path.Dir(filename))
+		}
+		return []LogEntry{{Op: OpAddFile, Filename: filename, File: file}}, nil
+	})
+	return err
+}
+
+// RemoveFile removes a file and returns it, so that only one of several
+// concurrent callers gets to clean up its chunks
+func (ft *FileTable) RemoveFile(filename string) (protocol.Fileinfo, error) {
+	var file protocol.Fileinfo
+	_, err := ft.mutate(func() ([]LogEntry, error) {
+		var exists bool
+		if file, exists = ft.files[filename]; !exists {
+			return nil, protocol.Errorf(protocol.ErrNotFound, "%s does not exist", filename)
+		}
+		return []LogEntry{{Op: OpRemoveFile, Filename: filename}}, nil
+	})
+	return file, err
+}
+
+// UpdateFile applies update to a copy of a file and records the result if
+// update returns true, as one mutation so no concurrent change is lost.
+// It returns the file as it is afterwards, unchanged if recording failed.
+func (ft *FileTable) UpdateFile(filename string, update func(file *protocol.Fileinfo) bool) (protocol.Fileinfo, bool) {
+	return ft.update(func() string { return filename }, update)
+}
+
+// UpdateChunk is UpdateFile for the file holding a chunk, or a shard of
+// one, update gets that chunk or shard too
+func (ft *FileTable) UpdateChunk(id string, update func(file *protocol.Fileinfo, chunk *protocol.Chunkinfo) bool) (protocol.Fileinfo, bool) {
+	return ft.update(func() string { return ft.chunks[id] }, func(file *protocol.Fileinfo) bool {
+		for _, block := range protocol.Blocks(file.Chunks) {
+			if block.ID == id {
+				return update(file, block)
+			}
+		}
+		return false
+	})
+}
+
+// update changes the file named by filename, which is looked up as part of
+// the mutation
+func (ft *FileTable) update(filename func() string, update func(file *protocol.Fileinfo) bool) (protocol.Fileinfo, bool) {
+	var current, changed protocol.Fileinfo
+	exists := false
+	recorded, _ := ft.mutate(func() ([]LogEntry, error) {
+		name := filename()
+		if current, exists = ft.files[name]; !exists {
+			return nil, nil
+		}
+
+		// The stored chunk list is shared with earlier readers, so change a copy
+		changed = current
+		changed.Chunks = slices.Clone(current.Chunks)
+		for i := range changed.Chunks {
+			changed.Chunks[i].Locations = slices.Clone(changed.Chunks[i].Locations)
+			changed.Chunks[i].Shards = slices.Clone(changed.Chunks[i].Shards)
+			for j := range changed.Chunks[i].Shards {
+				changed.Chunks[i].Shards[j].Locations = slices.Clone(changed.Chunks[i].Shards[j].Locations)
+			}
+		}
+		if !update(&changed) {
+			return nil, nil
+		}
+		return []LogEntry{{Op: OpAddFile, Filename: name, File: changed}}, nil
+	})
+	if recorded > 0 {
+		return changed, true
+	}
+	return current, exists
 }
 
 func (ft *FileTable) GetFile(filename string) (protocol.Fileinfo, bool) {
@@ -40,6 +155,42 @@ func (ft *FileTable) GetFile(filename string) (protocol.Fileinfo, bool) {
 	return file, exists
 }
 
+// FindChunk returns the file a chunk belongs to and the chunk's index in it
+func (ft *FileTable) FindChunk(id string) (protocol.Fileinfo, int, bool) {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
+	filename, exists := ft.chunks[id]
+	if !exists {
+		return protocol.Fileinfo{}, -1, false
+	}
+	file := ft.files[filename]
+	for i, chunk := range file.Chunks {
+		if chunk.ID == id {
+			return file, i, true
+		}
+	}
+	return protocol.Fileinfo{}, -1, false
+}
+
+// FindShard returns the erasure-coded chunk a shard belongs to and the
+// shard's index in it
+func (ft *FileTable) FindShard(id string) (protocol.Chunkinfo, int, bool) {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
+	filename, exists := ft.chunks[id]
+	if !exists {
+		return protocol.Chunkinfo{}, -1, false
+	}
+	for _, chunk := range ft.files[filename].Chunks {
+		for i, shard := range chunk.Shards {
+			if shard.ID == id {
+				return chunk, i, true
+			}
+		}
+	}
+	return protocol.Chunkinfo{}, -1, false
+}
+
 func (ft *FileTable) ListFiles() []protocol.Fileinfo {
 	ft.lock.RLock()
 	defer ft.lock.RUnlock()
@@ -49,3 +200,333 @@ func (ft *FileTable) ListFiles() []protocol.Fileinfo {
 	}
 	return files
 }
+
+// Mkdir creates a directory. With parents, missing parents are created
+// and an existing directory is not an error, like mkdir -p.
+func (ft *FileTable) Mkdir(dir string, parents bool) error {
+	_, err := ft.mutate(func() ([]LogEntry, error) {
+		if ft.dirs[dir] {
+			if parents {
+				return nil, nil
+			}
+			return nil, protocol.Errorf(protocol.ErrExists, "%s already exists", dir)
+		}
+		if _, exists := ft.files[dir]; exists {
+			return nil, protocol.Errorf(protocol.ErrInvalid, "%s is a file", dir)
+		}
+		for parent := path.Dir(dir); parent != "/"; parent = path.Dir(parent) {
+			if _, exists := ft.files[parent]; exists {
+				return nil, protocol.Errorf(protocol.ErrInvalid, "%s is a file", parent)
+			}
+		}
+		if !parents && !ft.dirs[path.Dir(dir)] {
+			return nil, protocol.Errorf(protocol.ErrNotFound, "%s does not exist", path.Dir(dir))
+		}
+
+		// Create the missing parents first
+		var entries []LogEntry
+		for ; !ft.dirs[dir]; dir = path.Dir(dir) {
+			entries = append(entries, LogEntry{Op: OpMkdir, Filename: dir})
+		}
+		slices.Reverse(entries)
+		return entries, nil
+	})
+	return err
+}
+
+// Rmdir removes a directory. Unless recursive it must be empty. It returns
+// every file that was removed along with it, whose chunks are now garbage,
+// even if it fails part way.
+func (ft *FileTable) Rmdir(dir string, recursive bool) ([]protocol.Fileinfo, error) {
+	var entries []LogEntry
+	var files []protocol.Fileinfo // Removed by each entry, if it removes a file
+	recorded, err := ft.mutate(func() ([]LogEntry, error) {
+		if dir == "/" {
+			return nil, protocol.Errorf(protocol.ErrPermissionDenied, "cannot remove the root directory")
+		}
+		if _, isFile := ft.files[dir]; isFile {
+			return nil, protocol.Errorf(protocol.ErrInvalid, "%s is not a directory", dir)
+		}
+		if !ft.dirs[dir] {
+			return nil, protocol.Errorf(protocol.ErrNotFound, "%s does not exist", dir)
+		}
+		if !recursive && len(ft.children[dir]) > 0 {
+			return nil, protocol.Errorf(protocol.ErrInvalid, "%s is not empty", dir)
+		}
+
+		// Remove the deepest entries first so every directory is empty when removed
+		for _, entry := range slices.Backward(ft.walk(dir)) {
+			if entry.IsDir {
+				entries = append(entries, LogEntry{Op: OpRmdir, Filename: entry.Path})
+				files = append(files, protocol.Fileinfo{})
+			} else {
+				entries = append(entries, LogEntry{Op: OpRemoveFile, Filename: entry.Path})
+				files = append(files, ft.files[entry.Path])
+			}
+		}
+		entries = append(entries, LogEntry{Op: OpRmdir, Filename: dir})
+		return entries, nil
+	})
+
+	var removed []protocol.Fileinfo
+	for i, entry := range entries[:recorded] {
+		if entry.Op == OpRemoveFile {
+			removed = append(removed, files[i])
+		}
+	}
+	return removed, err
+}
+
+// Rename moves a file or directory to target as a single journaled step, so
+// it either happens completely or not at all. An existing target is only
+// replaced with overwrite, and only by the same kind of entry; a directory
+// has to be empty to be replaced. It returns every file that was replaced,
+// whose chunks the caller must delete.
+func (ft *FileTable) Rename(source string, target string, overwrite bool) ([]protocol.Fileinfo, error) {
+	var replaced []protocol.Fileinfo
+	_, err := ft.mutate(func() ([]LogEntry, error) {
+		var err error
+		replaced, err = ft.checkRename(source, target, overwrite)
+		if err != nil || source == target {
+			return nil, err
+		}
+		return []LogEntry{{Op: OpRename, Filename: source, Target: target}}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return replaced, nil
+}
+
+// checkRename returns an error if source cannot be renamed to target, and
+// otherwise the files the rename replaces. Callers hold ft.lock.
+func (ft *FileTable) checkRename(source string, target string, overwrite bool) ([]protocol.Fileinfo, error) {
+	_, isFile := ft.files[source]
+	if !isFile && !ft.dirs[source] {
+		return nil, protocol.Errorf(protocol.ErrNotFound, "%s does not exist", source)
+	}
+	if source == "/" || target == "/" {
+		return nil, protocol.Errorf(protocol.ErrPermissionDenied, "cannot rename the root directory")
+	}
+	if source == target {
+		return nil, nil
+	}
+	if strings.HasPrefix(target, source+"/") {
+		return nil, protocol.Errorf(protocol.ErrInvalid, "cannot move %s into itself", source)
+	}
+	if !ft.dirs[path.Dir(target)] {
+		return nil, protocol.Errorf(protocol.ErrInvalid, "%s is not a directory", path.Dir(target))
+	}
+
+	var replaced []protocol.Fileinfo
+	if file, exists := ft.files[target]; exists {
+		if !overwrite {
+			return nil, protocol.Errorf(protocol.ErrExists, "%s already exists", target)
+		}
+		if !isFile {
+			return nil, protocol.Errorf(protocol.ErrInvalid, "cannot replace file %s with a directory", target)
+		}
+		replaced = append(replaced, file)
+	} else if ft.dirs[target] {
+		if !overwrite {
+			return nil, protocol.Errorf(protocol.ErrExists, "%s already exists", target)
+		}
+		if isFile {
+			return nil, protocol.Errorf(protocol.ErrInvalid, "cannot replace directory %s with a file", target)
+		}
+		if len(ft.children[target]) > 0 {
+			return nil, protocol.Errorf(protocol.ErrInvalid, "%s is not empty", target)
+		}
+	}
+
+	return replaced, nil
+}
+
+// List returns the entries of a directory, or of the whole subtree if
+// recursive, sorted by path. Listing a file returns just that file.
+func (ft *FileTable) List(name string, recursive bool) ([]protocol.DirEntry, error) {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
+	if file, exists := ft.files[name]; exists {
+		return []protocol.DirEntry{{Path: name, Size: file.Size}}, nil
+	}
+	if !ft.dirs[name] {
+		return nil, protocol.Errorf(protocol.ErrNotFound, "%s does not exist", name)
+	}
+	if recursive {
+		return ft.walk(name), nil
+	}
+
+	entries := make([]protocol.DirEntry, 0, len(ft.children[name]))
+	for child := range ft.children[name] {
+		entries = append(entries, ft.entry(path.Join(name, child)))
+	}
+	slices.SortFunc(entries, func(a, b protocol.DirEntry) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return entries, nil
+}
+
+// walk returns every entry below dir, each directory before its contents.
+// Callers hold ft.lock.
+func (ft *FileTable) walk(dir string) []protocol.DirEntry {
+	names := make([]string, 0, len(ft.children[dir]))
+	for child := range ft.children[dir] {
+		names = append(names, child)
+	}
+	slices.Sort(names)
+
+	var entries []protocol.DirEntry
+	for _, name := range names {
+		entry := ft.entry(path.Join(dir, name))
+		entries = append(entries, entry)
+		if entry.IsDir {
+			entries = append(entries, ft.walk(entry.Path)...)
+		}
+	}
+	return entries
+}
+
+// Callers hold ft.lock.
+func (ft *FileTable) entry(name string) protocol.DirEntry {
+	if ft.dirs[name] {
+		return protocol.DirEntry{Path: name, IsDir: true}
+	}
+	return protocol.DirEntry{Path: name, Size: ft.files[name].Size}
+}
+
+// mutate makes a change to the table. Under the read lock, plan checks the
+// change can be made and returns the entries making it, which are then
+// recorded in order up to the first that fails. Mutations run one at a
+// time, so what plan saw still holds when they are recorded, but the table
+// lock is only held while an entry is applied: readers do not wait for the
+// change to be made durable or replicated. It returns how many entries were
+// recorded.
+func (ft *FileTable) mutate(plan func() ([]LogEntry, error)) (int, error) {
+	ft.write.Lock()
+	defer ft.write.Unlock()
+	ft.lock.RLock()
+	entries, err := plan()
+	ft.lock.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	for i, entry := range entries {
+		if err := ft.record(entry); err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
+
+// record makes a mutation durable and applies it. The mutation is not
+// applied if it returns an error. Callers hold ft.write, not ft.lock.
+func (ft *FileTable) record(entry LogEntry) error {
+	if ft.recorder == nil {
+		ft.applyLocked(entry, func() {})
+		return nil
+	}
+	err := ft.recorder.Record(entry, ft.applyLocked)
+	if err != nil {
+		fmt.Println("Metadata Record Error:", err)
+	}
+	return err
+}
+
+// applyLocked applies an entry under the table lock, and calls applied
+// before releasing it
+func (ft *FileTable) applyLocked(entry LogEntry, applied func()) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	ft.apply(entry)
+	applied()
+}
+
+// apply performs a journaled mutation. Callers hold ft.lock.
+func (ft *FileTable) apply(entry LogEntry) {
+	parent, name := path.Split(entry.Filename)
+	parent = path.Clean(parent)
+	switch entry.Op {
+	case OpAddFile:
+		ft.unindex(entry.Filename)
+		ft.files[entry.Filename] = entry.File
+		for _, block := range protocol.Blocks(entry.File.Chunks) {
+			ft.chunks[block.ID] = entry.Filename
+		}
+		ft.link(parent, name)
+	case OpRemoveFile:
+		ft.unindex(entry.Filename)
+		delete(ft.files, entry.Filename)
+		delete(ft.children[parent], name)
+	case OpMkdir:
+		ft.dirs[entry.Filename] = true
+		if ft.children[entry.Filename] == nil {
+			ft.children[entry.Filename] = make(map[string]bool)
+		}
+		ft.link(parent, name)
+	case OpRmdir:
+		delete(ft.dirs, entry.Filename)
+		delete(ft.children, entry.Filename)
+		delete(ft.children[parent], name)
+	case OpRename:
+		// Drop whatever is being replaced, then move the entry and everything below it
+		targetParent, targetName := path.Split(entry.Target)
+		ft.unindex(entry.Target)
+		delete(ft.files, entry.Target)
+		delete(ft.dirs, entry.Target)
+		delete(ft.children, entry.Target)
+
+		dirs := make(map[string]map[string]bool)
+		for dir := range ft.dirs {
+			if moved, ok := rebase(dir, entry.Filename, entry.Target); ok {
+				dirs[moved] = ft.children[dir]
+				delete(ft.dirs, dir)
+				delete(ft.children, dir)
+			}
+		}
+		for dir, children := range dirs {
+			ft.dirs[dir] = true
+			ft.children[dir] = children
+		}
+		files := make(map[string]protocol.Fileinfo)
+		for filename, file := range ft.files {
+			if moved, ok := rebase(filename, entry.Filename, entry.Target); ok {
+				file.Filename = moved
+				files[moved] = file
+				delete(ft.files, filename)
+			}
+		}
+		for filename, file := range files {
+			ft.files[filename] = file
+			for _, block := range protocol.Blocks(file.Chunks) {
+				ft.chunks[block.ID] = filename
+			}
+		}
+		delete(ft.children[parent], name)
+		ft.link(path.Clean(targetParent), targetName)
+	}
+}
+
+// rebase returns name with its prefix dir replaced by target, if name is dir or lies below it
+func rebase(name string, dir string, target string) (string, bool) {
+	if name == dir {
+		return target, true
+	}
+	if rest, ok := strings.CutPrefix(name, dir+"/"); ok {
+		return target + "/" + rest, true
+	}
+	return "", false
+}
+
+func (ft *FileTable) link(parent string, name string) {
+	if ft.children[parent] == nil {
+		ft.children[parent] = make(map[string]bool)
+	}
+	ft.children[parent][name] = true
+}
+
+func (ft *FileTable) unindex(filename string) {
+	for _, block := range protocol.Blocks(ft.files[filename].Chunks) {
+		delete(ft.chunks, block.ID)
+	}
+}
@@ -0,0 +1,185 @@
+package mainserver
+
+import (
+	"DistributedFileSystem/protocol"
+	"slices"
+	"testing"
+)
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"//", "/"},
+		{"a", "/a"},
+		{"a/b/", "/a/b"},
+		{"//a//b", "/a/b"},
+		{"/a/./b", "/a/b"},
+		{"/a/../b", "/b"},
+		{"..", "/"},
+		{"../../etc", "/etc"},
+	}
+	for _, test := range tests {
+		if got := NormalizePath(test.name); got != test.want {
+			t.Errorf("NormalizePath(%q) = %q, expected %q", test.name, got, test.want)
+		}
+	}
+}
+
+// newTestTable returns a file table holding dirs and a file of one chunk at
+// each of files
+func newTestTable(t *testing.T, dirs []string, files ...string) *FileTable {
+	t.Helper()
+	ft := NewFileTable()
+	for _, dir := range dirs {
+		if err := ft.Mkdir(dir, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, filename := range files {
+		file := protocol.Fileinfo{
+			Filename: filename,
+			Size:     1,
+			Chunks:   []protocol.Chunkinfo{{ID: "chunk " + filename, Size: 1}},
+		}
+		if err := ft.AddFile(filename, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ft
+}
+
+func TestRmdir(t *testing.T) {
+	tests := []struct {
+		name      string
+		dir       string
+		recursive bool
+		code      protocol.ErrorCode // Empty if it succeeds
+		removed   int                // Files removed along with it
+	}{
+		{name: "empty", dir: "/empty"},
+		{name: "not empty", dir: "/a", code: protocol.ErrInvalid},
+		{name: "recursive", dir: "/a", recursive: true, removed: 3},
+		{name: "missing", dir: "/missing", code: protocol.ErrNotFound},
+		{name: "file", dir: "/a/f", code: protocol.ErrInvalid},
+		{name: "root", dir: "/", recursive: true, code: protocol.ErrPermissionDenied},
+	}
+	for _, test := range tests {
+		ft := newTestTable(t, []string{"/a/b/c", "/empty"}, "/a/f", "/a/b/g", "/a/b/c/h", "/top")
+		removed, err := ft.Rmdir(test.dir, test.recursive)
+		if test.code != "" {
+			if protocol.CodeOf(err) != test.code {
+				t.Errorf("%s: got %v, expected %s", test.name, err, test.code)
+			}
+			if _, err := ft.List(test.dir, false); test.code != protocol.ErrNotFound && err != nil {
+				t.Errorf("%s: %s is gone after a failed rmdir", test.name, test.dir)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(removed) != test.removed {
+			t.Errorf("%s: removed %d files, expected %d", test.name, len(removed), test.removed)
+		}
+		if _, err := ft.List(test.dir, false); protocol.CodeOf(err) != protocol.ErrNotFound {
+			t.Errorf("%s: %s still listed", test.name, test.dir)
+		}
+		for _, file := range removed {
+			if _, exists := ft.GetFile(file.Filename); exists {
+				t.Errorf("%s: %s still exists", test.name, file.Filename)
+			}
+			if _, _, exists := ft.FindChunk(file.Chunks[0].ID); exists {
+				t.Errorf("%s: chunk of %s still indexed", test.name, file.Filename)
+			}
+		}
+		if _, exists := ft.GetFile("/top"); !exists {
+			t.Errorf("%s: /top removed too", test.name)
+		}
+	}
+}
+
+func TestRenameDirectory(t *testing.T) {
+	ft := newTestTable(t, []string{"/a/b/c", "/d"}, "/a/f", "/a/b/g", "/a/b/c/h")
+	if replaced, err := ft.Rename("/a", "/d/x", false); err != nil || len(replaced) != 0 {
+		t.Fatalf("got %v, %v", replaced, err)
+	}
+
+	entries, err := ft.List("/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, entry := range entries {
+		paths = append(paths, entry.Path)
+	}
+	expected := []string{"/d", "/d/x", "/d/x/b", "/d/x/b/c", "/d/x/b/c/h", "/d/x/b/g", "/d/x/f"}
+	if !slices.Equal(paths, expected) {
+		t.Fatalf("listed %v, expected %v", paths, expected)
+	}
+
+	// Files moved along keep their chunks, found under their new names
+	file, _, exists := ft.FindChunk("chunk /a/b/c/h")
+	if !exists || file.Filename != "/d/x/b/c/h" {
+		t.Fatalf("chunk of h found in %q", file.Filename)
+	}
+}
+
+func TestRenameOverwrite(t *testing.T) {
+	tests := []struct {
+		name      string
+		source    string
+		target    string
+		overwrite bool
+		code      protocol.ErrorCode // Empty if it succeeds
+		replaced  []string
+	}{
+		{name: "onto a file", source: "/a/f", target: "/g", overwrite: true, replaced: []string{"/g"}},
+		{name: "onto a file without overwrite", source: "/a/f", target: "/g", code: protocol.ErrExists},
+		{name: "onto an empty directory", source: "/a/b", target: "/empty", overwrite: true},
+		{name: "onto a directory that is not empty", source: "/a/b", target: "/a", overwrite: true, code: protocol.ErrInvalid},
+		{name: "file onto a directory", source: "/g", target: "/empty", overwrite: true, code: protocol.ErrInvalid},
+		{name: "directory onto a file", source: "/empty", target: "/g", overwrite: true, code: protocol.ErrInvalid},
+		{name: "into its own subtree", source: "/a", target: "/a/b/a", code: protocol.ErrInvalid},
+		{name: "into a missing directory", source: "/g", target: "/missing/g", code: protocol.ErrInvalid},
+		{name: "missing source", source: "/missing", target: "/h", code: protocol.ErrNotFound},
+		{name: "root", source: "/", target: "/h", code: protocol.ErrPermissionDenied},
+	}
+	for _, test := range tests {
+		ft := newTestTable(t, []string{"/a/b", "/empty"}, "/a/f", "/g")
+		before, _ := ft.List("/", true)
+		replaced, err := ft.Rename(test.source, test.target, test.overwrite)
+		if test.code != "" {
+			if protocol.CodeOf(err) != test.code {
+				t.Errorf("%s: got %v, expected %s", test.name, err, test.code)
+			}
+			if after, _ := ft.List("/", true); !slices.Equal(after, before) {
+				t.Errorf("%s: the table changed from %v to %v", test.name, before, after)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		var names []string
+		for _, file := range replaced {
+			names = append(names, file.Filename)
+		}
+		if !slices.Equal(names, test.replaced) {
+			t.Errorf("%s: replaced %v, expected %v", test.name, names, test.replaced)
+		}
+		if _, err := ft.List(test.source, false); protocol.CodeOf(err) != protocol.ErrNotFound {
+			t.Errorf("%s: %s still listed", test.name, test.source)
+		}
+		for _, file := range replaced {
+			if _, _, exists := ft.FindChunk(file.Chunks[0].ID); exists {
+				t.Errorf("%s: chunk of replaced %s still indexed", test.name, file.Filename)
+			}
+		}
+	}
+}
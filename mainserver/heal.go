@@ -0,0 +1,181 @@
+package mainserver
+
+import (
+	"DistributedFileSystem/protocol"
+	"cmp"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+Re-replication
+Once a storage server is declared dead, or turns out to have lost chunks,
+the main server looks for chunks with fewer live replicas than the
+replication factor, and for erasure-coded chunks with shards on no live
+node. Each gets new copies from its surviving ones, replacing those on dead
+nodes, most endangered first: the chunks that survive the fewest further
+losses. At most repairConcurrency chunks are restored at once, each copy
+sent at its share of repairRate. Chunks that could not be restored are
+tried again on the next pass.
+*/
+
+// healInterval is how often a pass runs without being asked for
+const healInterval = time.Minute
+
+// repair is a chunk that lacks redundancy
+type repair struct {
+	chunk  protocol.Chunkinfo
+	margin int // How many more copies or shards it can lose and still be read
+}
+
+// healLoop restores redundancy whenever asked to, and periodically to retry what failed
+func (ms *MainServer) healLoop() {
+	ticker := time.NewTicker(healInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ms.healing:
+		}
+		if ms.leading() {
+			ms.heal()
+		}
+	}
+}
+
+// triggerHeal asks for a pass without waiting for it. Requests made during
+// a pass are served by a single further one.
+func (ms *MainServer) triggerHeal() {
+	select {
+	case ms.healing <- struct{}{}:
+	default:
+	}
+}
+
+// heal restores every chunk that lacks redundancy and returns once all
+// of them were attempted
+func (ms *MainServer) heal() {
+	live := ms.liveNodes()
+	repairs := ms.underReplicated(live)
+	if len(repairs) == 0 {
+		return
+	}
+	fmt.Println("Restoring redundancy of", len(repairs), "chunks")
+
+	rate := ms.repairRate / int64(ms.repairConcurrency)
+	slots := make(chan struct{}, ms.repairConcurrency)
+	var wg sync.WaitGroup
+	for _, r := range repairs {
+		if r.margin < 0 {
+			fmt.Println("Chunk", r.chunk.ID, "has too few live copies left to restore it from")
+			continue
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := ms.rereplicate(r.chunk, live, rate); err != nil {
+				fmt.Println("Re-replication of chunk", r.chunk.ID, "Failed:", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// liveNodes returns a check for whether a storage server is in the list and
+// not declared dead
+func (ms *MainServer) liveNodes() func(addr string) bool {
+	nodes := ms.Storage.ListNodes()
+	return func(addr string) bool {
+		node, exists := nodes[addr]
+		return exists && node.Status != protocol.NodeDead
+	}
+}
+
+// underReplicated returns every chunk with a copy or shard missing from the
+// live nodes, the ones with the smallest margin first
+func (ms *MainServer) underReplicated(live func(addr string) bool) []repair {
+	var repairs []repair
+	for _, file := range ms.FileTable.ListFiles() {
+		for _, chunk := range file.Chunks {
+			if chunk.Coded() {
+				stored := 0
+				for _, shard := range chunk.Shards {
+					if slices.ContainsFunc(shard.Locations, live) {
+						stored++
+					}
+				}
+				if stored < len(chunk.Shards) {
+					repairs = append(repairs, repair{chunk: chunk, margin: stored - chunk.DataShards})
+				}
+				continue
+			}
+			copies := 0
+			for _, addr := range chunk.Locations {
+				if live(addr) {
+					copies++
+				}
+			}
+			if copies < ms.replication {
+				repairs = append(repairs, repair{chunk: chunk, margin: copies - 1})
+			}
+		}
+	}
+	slices.SortStableFunc(repairs, func(a, b repair) int {
+		return cmp.Compare(a.margin, b.margin)
+	})
+	return repairs
+}
+
+// rereplicate brings a chunk back to full redundancy from its live copies,
+// each new copy taking the place of one on a dead node
+func (ms *MainServer) rereplicate(chunk protocol.Chunkinfo, live func(addr string) bool, rate int64) error {
+	if chunk.Coded() {
+		for _, shard := range chunk.Shards {
+			if slices.ContainsFunc(shard.Locations, live) {
+				continue
+			}
+			from := ""
+			if len(shard.Locations) > 0 {
+				from = shard.Locations[0]
+			}
+			if err := ms.rebuildShard(shard.ID, from, rate); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var sources, dead []string
+	chunk.Locations = slices.Clone(chunk.Locations)
+	for _, addr := range chunk.Locations {
+		if live(addr) {
+			sources = append(sources, addr)
+		} else {
+			dead = append(dead, addr)
+		}
+	}
+	for copies := len(sources); copies < ms.replication; copies++ {
+		targets := ms.reserveStorage(chunk.ID, chunk.Size, 1, chunk.Locations)
+		if targets == nil {
+			return protocol.Errorf(protocol.ErrNoSpace, "no storage available for copy %d of %d", copies+1, ms.replication)
+		}
+		if err := ms.copyChunk(chunk, sources, targets[0], rate); err != nil {
+			return err
+		}
+		from := ""
+		if len(dead) > 0 {
+			from, dead = dead[0], dead[1:]
+		}
+		if !ms.moveReplica(chunk, from, targets[0]) {
+			return nil
+		}
+		chunk.Locations = append(slices.DeleteFunc(chunk.Locations, func(location string) bool {
+			return location == from
+		}), targets[0])
+	}
+	return nil
+}
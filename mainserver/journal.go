@@ -0,0 +1,414 @@
+package mainserver
+
+import (
+	"DistributedFileSystem/protocol"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+Metadata Journal
+Every mutation of the FileTable and StorageList is appended to an fsync'd
+write-ahead log before it is applied in memory. The log is periodically
+compacted into a snapshot so replay on startup stays short.
+
+Layout inside the metadata directory:
+snapshot.json - full copy of the tables as of LastSeq
+journal.log   - one JSON LogEntry per line, applied on top of the snapshot
+*/
+
+type Op string
+
+const (
+	OpAddFile    Op = "ADD_FILE"
+	OpRemoveFile Op = "REMOVE_FILE"
+	OpMkdir      Op = "MKDIR"
+	OpRmdir      Op = "RMDIR"
+	OpRename     Op = "RENAME"
+	OpAddNode    Op = "ADD_NODE"
+	OpRemoveNode Op = "REMOVE_NODE"
+	OpChangeMem  Op = "CHANGE_MEM"
+	OpNoop       Op = "NOOP" // Changes nothing, a new Raft leader's first entry
+)
+
+const (
+	journalFile  = "journal.log"
+	snapshotFile = "snapshot.json"
+
+	// Compact once this many entries have accumulated since the last snapshot
+	snapshotThreshold = 1000
+	// Compact at least this often while there are new entries
+	snapshotInterval = time.Minute
+)
+
+type LogEntry struct {
+	Seq      uint64            `json:"seq"`
+	Term     uint64            `json:"term,omitempty"` // Raft term the entry was proposed in
+	Op       Op                `json:"op"`
+	Filename string            `json:"filename,omitempty"`
+	File     protocol.Fileinfo `json:"file,omitzero"`
+	Target   string            `json:"target,omitempty"` // New name of a renamed file or directory
+	Address  string            `json:"address,omitempty"`
+	Amount   int64             `json:"amount,omitempty"`
+}
+
+type Snapshot struct {
+	LastSeq  uint64                        `json:"last_seq"`
+	LastTerm uint64                        `json:"last_term,omitempty"`
+	Files    map[string]protocol.Fileinfo  `json:"files"`
+	Dirs     []string                      `json:"dirs"`
+	Nodes    map[string]*protocol.Nodeinfo `json:"nodes"`
+}
+
+// Recorder makes a mutation durable and applies it with apply, which takes
+// the table lock and calls applied before releasing it. A Journal writes it
+// to local disk, Raft replicates it to a majority of main servers. Callers
+// do not hold the table lock while it waits.
+type Recorder interface {
+	Record(entry LogEntry, apply func(entry LogEntry, applied func())) error
+}
+
+type Journal struct {
+	lock    sync.Mutex
+	dir     string
+	file    *os.File
+	seq     uint64     // Sequence number of the last appended entry
+	applied uint64     // Sequence number of the last entry in the tables
+	record  sync.Mutex // Held by Record from appending an entry until it is applied
+	pending int        // Entries appended since the last snapshot
+	compact chan struct{}
+}
+
+func OpenJournal(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Journal{
+		dir:     dir,
+		compact: make(chan struct{}, 1),
+	}, nil
+}
+
+// Replay loads the snapshot and every journal entry written after it,
+// then opens the journal for appending. Must be called once before Append.
+func (j *Journal) Replay(restore func(Snapshot), apply func(LogEntry)) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	// Load Snapshot
+	data, err := os.ReadFile(filepath.Join(j.dir, snapshotFile))
+	if err == nil {
+		var snap Snapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return fmt.Errorf("corrupt snapshot: %v", err)
+		}
+		j.seq = snap.LastSeq
+		restore(snap)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// Replay Journal
+	path := filepath.Join(j.dir, journalFile)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	var valid int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial last line is a write torn by a crash
+			break
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+		// A complete line that does not parse is damage, not a torn write,
+		// and the entries after it were committed
+		var entry LogEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			file.Close()
+			return fmt.Errorf("corrupt journal entry at byte %d: %v", valid, err)
+		}
+		valid += int64(len(line))
+		if entry.Seq <= j.seq {
+			// Already covered by the snapshot
+			continue
+		}
+		j.seq = entry.Seq
+		j.pending++
+		apply(entry)
+	}
+
+	// Drop the torn line, if any
+	if err := file.Truncate(valid); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(valid, 0); err != nil {
+		file.Close()
+		return err
+	}
+	j.file = file
+	j.applied = j.seq
+	fmt.Println("Replayed metadata journal up to entry", j.seq)
+	return nil
+}
+
+// Record appends the entry and applies it. A change that could not be
+// written is not applied, and the error is returned for the caller to fail
+// its request, so nothing a client was told succeeded is lost on restart.
+// Entries are applied in the order they were appended.
+func (j *Journal) Record(entry LogEntry, apply func(entry LogEntry, applied func())) error {
+	j.record.Lock()
+	defer j.record.Unlock()
+	if err := j.Append(entry); err != nil {
+		fmt.Println("Journal Append Error:", err)
+		return err
+	}
+	entry.Seq = j.LastSeq()
+	apply(entry, func() {
+		j.lock.Lock()
+		j.applied = entry.Seq
+		j.lock.Unlock()
+	})
+	return nil
+}
+
+// Append durably writes the entries to the log in a single sync. Entries
+// are numbered on from the last one, or must already carry the next number.
+func (j *Journal) Append(entries ...LogEntry) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	var data []byte
+	seq := j.seq
+	for _, entry := range entries {
+		seq++
+		if entry.Seq != 0 && entry.Seq != seq {
+			return fmt.Errorf("journal entry %d does not follow %d", entry.Seq, seq-1)
+		}
+		entry.Seq = seq
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	// A failed write must not leave a partial line for later entries to follow
+	info, err := j.file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(data); err != nil {
+		j.file.Truncate(info.Size())
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		j.file.Truncate(info.Size())
+		return err
+	}
+	j.pending += int(seq - j.seq)
+	j.seq = seq
+
+	// Ask for compaction without blocking the writer
+	if j.pending >= snapshotThreshold {
+		select {
+		case j.compact <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// LastSeq returns the sequence number of the last appended entry
+func (j *Journal) LastSeq() uint64 {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.seq
+}
+
+// Applied returns the sequence number of the last entry Record applied, or
+// Replay if none was recorded since
+func (j *Journal) Applied() uint64 {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.applied
+}
+
+// Truncate drops every entry after last, which Raft does to entries a new
+// leader never got
+func (j *Journal) Truncate(last uint64) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if last >= j.seq {
+		return nil
+	}
+	if err := j.rewrite(func(entry LogEntry) bool { return entry.Seq <= last }); err != nil {
+		return err
+	}
+	j.pending = max(0, j.pending-int(j.seq-last))
+	j.seq = last
+	return nil
+}
+
+// Compact writes snap, which must cover every entry up to its LastSeq, and
+// drops those entries from the log. Later entries are kept. Callers must
+// hold the table locks so the tables match snap.
+func (j *Journal) Compact(snap Snapshot) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.pending == 0 || snap.LastSeq > j.seq {
+		return nil
+	}
+	if err := j.writeSnapshot(snap); err != nil {
+		return err
+	}
+
+	// The snapshot now covers these entries, so the log can drop them.
+	// Entries that survive a crash here are skipped on replay by Seq.
+	if snap.LastSeq < j.seq {
+		if err := j.rewrite(func(entry LogEntry) bool { return entry.Seq > snap.LastSeq }); err != nil {
+			return err
+		}
+	} else if err := j.reset(); err != nil {
+		return err
+	}
+	j.pending = int(j.seq - snap.LastSeq)
+	fmt.Println("Compacted metadata journal at entry", snap.LastSeq)
+	return nil
+}
+
+// Install replaces the snapshot and the whole log with snap, which Raft does
+// when a follower is too far behind for the entries it misses
+func (j *Journal) Install(snap Snapshot) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err := j.writeSnapshot(snap); err != nil {
+		return err
+	}
+	if err := j.reset(); err != nil {
+		return err
+	}
+	j.seq = snap.LastSeq
+	j.pending = 0
+	return nil
+}
+
+// ReadSnapshot returns the last written snapshot as it is on disk, or nil
+// if there is none
+func (j *Journal) ReadSnapshot() ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(j.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (j *Journal) writeSnapshot(snap Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(filepath.Join(j.dir, snapshotFile), data)
+}
+
+// reset empties the log. Callers hold j.lock.
+func (j *Journal) reset() error {
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := j.file.Seek(0, 0); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// rewrite replaces the log with the entries keep accepts. Callers hold j.lock.
+func (j *Journal) rewrite(keep func(LogEntry) bool) error {
+	if _, err := j.file.Seek(0, 0); err != nil {
+		return err
+	}
+	var data []byte
+	reader := bufio.NewReader(j.file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var entry LogEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("corrupt journal entry: %v", err)
+		}
+		if keep(entry) {
+			data = append(data, line...)
+		}
+	}
+
+	path := filepath.Join(j.dir, journalFile)
+	if err := writeFileSync(path, data); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.file.Close()
+	j.file = file
+	return nil
+}
+
+// writeFileSync writes data to a temporary file, then atomically swaps it in
+func writeFileSync(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func (j *Journal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,191 @@
+package mainserver
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// replayJournal opens the journal in dir and returns it along with the
+// snapshot it restored, if any, and the entries it replayed
+func replayJournal(t *testing.T, dir string) (*Journal, *Snapshot, []LogEntry, error) {
+	t.Helper()
+	journal, err := OpenJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored *Snapshot
+	var entries []LogEntry
+	err = journal.Replay(func(snap Snapshot) {
+		restored = &snap
+	}, func(entry LogEntry) {
+		entries = append(entries, entry)
+	})
+	if err == nil {
+		t.Cleanup(func() { journal.Close() })
+	}
+	return journal, restored, entries, err
+}
+
+func recordMkdirs(t *testing.T, journal *Journal, dirs ...string) {
+	t.Helper()
+	for _, dir := range dirs {
+		if err := journal.Record(LogEntry{Op: OpMkdir, Filename: dir}, func(_ LogEntry, applied func()) { applied() }); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func replayedDirs(entries []LogEntry) []string {
+	var dirs []string
+	for _, entry := range entries {
+		dirs = append(dirs, entry.Filename)
+	}
+	return dirs
+}
+
+func TestJournalReplayAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	journal, _, _, err := replayJournal(t, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordMkdirs(t, journal, "/a", "/b", "/c")
+	journal.Close()
+
+	journal, restored, entries, err := replayJournal(t, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != nil {
+		t.Fatalf("restored a snapshot that was never written: %+v", restored)
+	}
+	if dirs := replayedDirs(entries); !slices.Equal(dirs, []string{"/a", "/b", "/c"}) {
+		t.Fatalf("replayed %v", dirs)
+	}
+	for i, entry := range entries {
+		if entry.Seq != uint64(i+1) {
+			t.Fatalf("entry %d has sequence number %d", i, entry.Seq)
+		}
+	}
+
+	// Numbering carries on after a restart
+	recordMkdirs(t, journal, "/d")
+	if seq := journal.LastSeq(); seq != 4 {
+		t.Fatalf("last entry %d, expected 4", seq)
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	tests := []struct {
+		name     string
+		recorded []string
+		covered  uint64   // LastSeq of the snapshot
+		after    []string // Recorded once compacted
+		replayed []string
+	}{
+		{name: "everything covered", recorded: []string{"/a", "/b", "/c"}, covered: 3, after: []string{"/d"}, replayed: []string{"/d"}},
+		{name: "later entries kept", recorded: []string{"/a", "/b", "/c", "/d", "/e"}, covered: 3, replayed: []string{"/d", "/e"}},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		journal, _, _, err := replayJournal(t, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recordMkdirs(t, journal, test.recorded...)
+		if err := journal.Compact(Snapshot{LastSeq: test.covered, Dirs: test.recorded[:test.covered]}); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		recordMkdirs(t, journal, test.after...)
+		journal.Close()
+
+		_, restored, entries, err := replayJournal(t, dir)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if restored == nil || restored.LastSeq != test.covered || !slices.Equal(restored.Dirs, test.recorded[:test.covered]) {
+			t.Fatalf("%s: restored %+v", test.name, restored)
+		}
+		if dirs := replayedDirs(entries); !slices.Equal(dirs, test.replayed) {
+			t.Fatalf("%s: replayed %v, expected %v", test.name, dirs, test.replayed)
+		}
+	}
+}
+
+func TestJournalTornTail(t *testing.T) {
+	dir := t.TempDir()
+	journal, _, _, err := replayJournal(t, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordMkdirs(t, journal, "/a", "/b")
+	journal.Close()
+	path := filepath.Join(dir, journalFile)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash in the middle of writing the third entry
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"seq":3,"op":"MK`)
+	file.Close()
+
+	journal, _, entries, err := replayJournal(t, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirs := replayedDirs(entries); !slices.Equal(dirs, []string{"/a", "/b"}) {
+		t.Fatalf("replayed %v", dirs)
+	}
+	if truncated, err := os.Stat(path); err != nil || truncated.Size() != info.Size() {
+		t.Fatalf("torn line not dropped: %v", err)
+	}
+
+	// The entry written in its place replays
+	recordMkdirs(t, journal, "/c")
+	journal.Close()
+	_, _, entries, err = replayJournal(t, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirs := replayedDirs(entries); !slices.Equal(dirs, []string{"/a", "/b", "/c"}) {
+		t.Fatalf("replayed %v", dirs)
+	}
+}
+
+func TestJournalCorruptEntry(t *testing.T) {
+	dir := t.TempDir()
+	journal, _, _, err := replayJournal(t, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordMkdirs(t, journal, "/a", "/b", "/c")
+	journal.Close()
+
+	// Damage the middle entry, the ones around it stay intact
+	path := filepath.Join(dir, journalFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	lines[1] = []byte("garbage\n")
+	corrupt := slices.Concat(lines...)
+	if err := os.WriteFile(path, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := replayJournal(t, dir); err == nil {
+		t.Fatal("replay of a corrupt journal succeeded")
+	}
+	if after, err := os.ReadFile(path); err != nil || !bytes.Equal(after, corrupt) {
+		t.Fatalf("corrupt journal was changed: %v", err)
+	}
+}
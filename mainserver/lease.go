@@ -0,0 +1,331 @@
+package mainserver
+
+import (
+	"DistributedFileSystem/protocol"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+Upload Leases
+An upload is two-phase. The main server allocates chunks under a lease and
+reserves space for them, but does not list the file yet. Every storage server
+confirms each chunk replica it stored, and once all of them are confirmed the
+file is added to the file table. A lease that is not completed and committed
+by the client in time expires, its reservation is returned and any chunks
+already stored are deleted. A streamed upload's lease starts empty and stays
+open while the client allocates chunks, and is only committed once the client
+closes it. Leases live in memory only; after a restart or a change of leader
+the chunks of an unfinished upload are orphans and are collected as such.
+*/
+
+type lease struct {
+	id        string
+	file      protocol.Fileinfo
+	confirmed map[replica]bool
+	expires   time.Time     // Pushed back by every confirmation
+	committed bool          // The file is in the file table
+	open      bool          // Streamed, the client may still allocate chunks
+	err       error         // Why the file could not be committed
+	finishing chan struct{} // Closed once committing the file ended, nil before it started
+}
+
+type replica struct {
+	chunk string
+	addr  string
+}
+
+type Leases struct {
+	lock   sync.Mutex
+	leases map[string]*lease
+}
+
+func NewLeases() *Leases {
+	return &Leases{leases: make(map[string]*lease)}
+}
+
+// openLease starts the upload of a file whose chunks were allocated and
+// reserved, or with stream the upload of a file whose chunks are allocated
+// later. A storage server that started draining since the chunks were placed
+// fails it, and the chunks are cancelled.
+func (ms *MainServer) openLease(file protocol.Fileinfo, stream bool) (string, error) {
+	ms.leases.lock.Lock()
+	defer ms.leases.lock.Unlock()
+	if err := ms.checkDraining(file.Chunks); err != nil {
+		ms.cancelChunks(file.Chunks)
+		return "", err
+	}
+	l := &lease{
+		id:        newChunkID(),
+		file:      file,
+		confirmed: make(map[replica]bool),
+		expires:   time.Now().Add(ms.leaseTimeout),
+		open:      stream,
+	}
+	ms.leases.leases[l.id] = l
+	return l.id, nil
+}
+
+// uploading reports whether an unfinished upload of filename holds a lease
+func (ms *MainServer) uploading(filename string) bool {
+	ms.leases.lock.Lock()
+	defer ms.leases.lock.Unlock()
+	for _, l := range ms.leases.leases {
+		if l.file.Filename == filename && !l.committed && l.err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// leased reports whether a chunk belongs to an upload in progress
+func (ms *MainServer) leased(id string) bool {
+	ms.leases.lock.Lock()
+	defer ms.leases.lock.Unlock()
+	for _, l := range ms.leases.leases {
+		if !l.committed && slices.ContainsFunc(protocol.Blocks(l.file.Chunks), func(block *protocol.Chunkinfo) bool {
+			return block.ID == id
+		}) {
+			return true
+		}
+	}
+	return false
+}
+
+// confirmReplica records that a storage server stored a chunk or shard of a
+// leased upload, and commits the file once every replica of every chunk is stored
+func (ms *MainServer) confirmReplica(confirm protocol.Upload_Confirm) error {
+	l, err := ms.markConfirmed(confirm)
+	if l == nil {
+		return err
+	}
+	return ms.finishLease(l)
+}
+
+// markConfirmed records a confirmed replica, and returns the lease if it is
+// now up to the caller to commit
+func (ms *MainServer) markConfirmed(confirm protocol.Upload_Confirm) (*lease, error) {
+	ms.leases.lock.Lock()
+	defer ms.leases.lock.Unlock()
+	l, exists := ms.leases.leases[confirm.Lease]
+	if !exists || l.err != nil {
+		return nil, protocol.Errorf(protocol.ErrNotFound, "unknown or expired lease %s", confirm.Lease)
+	}
+	blocks := protocol.Blocks(l.file.Chunks)
+	index := slices.IndexFunc(blocks, func(block *protocol.Chunkinfo) bool {
+		return block.ID == confirm.Filename
+	})
+	if index < 0 || !slices.Contains(blocks[index].Locations, confirm.Addr) {
+		return nil, protocol.Errorf(protocol.ErrInvalid, "chunk %s on %s is not part of lease %s", confirm.Filename, confirm.Addr, confirm.Lease)
+	}
+	if blocks[index].Size != confirm.Size {
+		return nil, protocol.Errorf(protocol.ErrInvalid, "chunk %s has size %d, expected %d", confirm.Filename, confirm.Size, blocks[index].Size)
+	}
+	l.confirmed[replica{confirm.Filename, confirm.Addr}] = true
+	l.expires = time.Now().Add(ms.leaseTimeout)
+
+	if l.committed || l.open || l.finishing != nil || ms.missing(l) > 0 {
+		return nil, nil
+	}
+	l.finishing = make(chan struct{})
+	return l, nil
+}
+
+// allocateChunk reserves space for the next chunk of a streamed upload
+func (ms *MainServer) allocateChunk(id string, size int64) (protocol.Chunkinfo, error) {
+	if size < 0 || size > ms.chunkSize {
+		return protocol.Chunkinfo{}, protocol.Errorf(protocol.ErrInvalid, "chunks are at most %d bytes, not %d", ms.chunkSize, size)
+	}
+	chunk := protocol.Chunkinfo{ID: newChunkID(), Size: size}
+	chunk.Locations = ms.reserveStorage(chunk.ID, size, ms.replication, nil)
+	if chunk.Locations == nil {
+		return chunk, protocol.Errorf(protocol.ErrNoSpace, "no storage available for %d bytes", size)
+	}
+
+	ms.leases.lock.Lock()
+	defer ms.leases.lock.Unlock()
+	l, exists := ms.leases.leases[id]
+	if exists && l.err != nil {
+		ms.cancelChunks([]protocol.Chunkinfo{chunk})
+		return chunk, l.err
+	}
+	if !exists || !l.open {
+		ms.cancelChunks([]protocol.Chunkinfo{chunk})
+		return chunk, protocol.Errorf(protocol.ErrNotFound, "unknown, expired or closed streamed upload lease %s", id)
+	}
+	if err := ms.checkDraining([]protocol.Chunkinfo{chunk}); err != nil {
+		ms.cancelChunks([]protocol.Chunkinfo{chunk})
+		return chunk, err
+	}
+	l.file.Chunks = append(l.file.Chunks, chunk)
+	l.file.Size += size
+	l.expires = time.Now().Add(ms.leaseTimeout)
+	return chunk, nil
+}
+
+// checkDraining returns an error if a chunk was placed on a storage server
+// that is being decommissioned. Callers hold ms.leases.lock, so a chunk is
+// either refused here or seen by abortLeasesOn.
+func (ms *MainServer) checkDraining(chunks []protocol.Chunkinfo) error {
+	for _, block := range protocol.Blocks(chunks) {
+		for _, addr := range block.Locations {
+			if node, _ := ms.Storage.GetNode(addr); node.Draining {
+				return protocol.Errorf(protocol.ErrNodeUnavailable, "%s is being decommissioned", addr)
+			}
+		}
+	}
+	return nil
+}
+
+// abortLeasesOn aborts every upload in progress with a chunk on addr. It
+// returns when the uploads that were already being committed are done, so
+// their files can be drained with the others.
+func (ms *MainServer) abortLeasesOn(addr string) {
+	ms.leases.lock.Lock()
+	var committing []chan struct{}
+	for _, l := range ms.leases.leases {
+		if l.committed || l.err != nil || !slices.ContainsFunc(protocol.Blocks(l.file.Chunks), func(block *protocol.Chunkinfo) bool {
+			return slices.Contains(block.Locations, addr)
+		}) {
+			continue
+		}
+		if l.finishing != nil {
+			committing = append(committing, l.finishing)
+			continue
+		}
+		fmt.Println("Aborting upload of", l.file.Filename, "under lease", l.id, "as", addr, "is being decommissioned")
+		l.err = protocol.Errorf(protocol.ErrNodeUnavailable, "%s is being decommissioned, upload aborted", addr)
+		go ms.abortLease(l)
+	}
+	ms.leases.lock.Unlock()
+
+	for _, finishing := range committing {
+		<-finishing
+	}
+}
+
+// finishLease adds the file of a lease whose every replica is confirmed to
+// the file table. Callers set l.finishing under ms.leases.lock and call it
+// without the lock, as the change waits to be recorded.
+func (ms *MainServer) finishLease(l *lease) error {
+	// Every replica landed, make the file visible
+	err := ms.FileTable.AddFile(l.file.Filename, l.file)
+	if err == nil {
+		for _, block := range protocol.Blocks(l.file.Chunks) {
+			for _, addr := range block.Locations {
+				ms.settleReplica(addr, block.Size)
+			}
+		}
+	}
+
+	ms.leases.lock.Lock()
+	defer ms.leases.lock.Unlock()
+	defer close(l.finishing)
+	if err != nil {
+		fmt.Println("Commit of", l.file.Filename, "Failed:", err)
+		l.err = err
+		go ms.abortLease(l)
+		return err
+	}
+	l.committed = true
+	fmt.Println("Committed upload of", l.file.Filename, "under lease", l.id)
+	return nil
+}
+
+// commitLease ends a lease on the client's request. It succeeds if the file
+// was committed, and aborts the upload otherwise. A streamed upload is
+// committed now, with the checksum the client computed.
+func (ms *MainServer) commitLease(commit protocol.Upload_Commit) error {
+	ms.leases.lock.Lock()
+	l, exists := ms.leases.leases[commit.Lease]
+	if !exists {
+		ms.leases.lock.Unlock()
+		return protocol.Errorf(protocol.ErrNotFound, "unknown or expired lease %s", commit.Lease)
+	}
+	delete(ms.leases.leases, commit.Lease)
+	if commit.Abort {
+		// Too late once the file is being committed
+		if !l.committed && l.err == nil && l.finishing == nil {
+			go ms.abortLease(l)
+		}
+		ms.leases.lock.Unlock()
+		return nil
+	}
+	if l.open && l.err == nil && ms.missing(l) == 0 {
+		l.open = false
+		l.file.Checksum = commit.Checksum
+		l.finishing = make(chan struct{})
+		ms.leases.lock.Unlock()
+		return ms.finishLease(l)
+	}
+	finishing := l.finishing
+	ms.leases.lock.Unlock()
+
+	// The last confirmation is committing the file, wait for it
+	if finishing != nil {
+		<-finishing
+	}
+	ms.leases.lock.Lock()
+	defer ms.leases.lock.Unlock()
+	if l.committed {
+		return nil
+	}
+	if l.err != nil {
+		return l.err
+	}
+	missing := ms.missing(l)
+	go ms.abortLease(l)
+	return protocol.Errorf(protocol.ErrNodeUnavailable, "%d chunk replicas were not stored, upload aborted", missing)
+}
+
+// missing counts the replicas and shards of a lease that are not confirmed
+// yet. Callers hold ms.leases.lock.
+func (ms *MainServer) missing(l *lease) int {
+	missing := 0
+	for _, block := range protocol.Blocks(l.file.Chunks) {
+		for _, addr := range block.Locations {
+			if !l.confirmed[replica{block.ID, addr}] {
+				missing++
+			}
+		}
+	}
+	return missing
+}
+
+// abortLease returns the space reserved for an upload that will never be
+// committed and deletes whatever chunks of it were already stored
+func (ms *MainServer) abortLease(l *lease) {
+	ms.cancelChunks(l.file.Chunks)
+	for _, block := range protocol.Blocks(l.file.Chunks) {
+		for _, addr := range block.Locations {
+			ms.DeleteRequest(addr, block.ID)
+		}
+	}
+	fmt.Println("Aborted upload of", l.file.Filename, "under lease", l.id)
+}
+
+// leaseLoop expires leases whose uploads stalled
+func (ms *MainServer) leaseLoop() {
+	ticker := time.NewTicker(ms.leaseTimeout / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !ms.leading() {
+			continue
+		}
+		ms.leases.lock.Lock()
+		for id, l := range ms.leases.leases {
+			// A lease being committed ends with the commit
+			if time.Now().Before(l.expires) || l.finishing != nil && !l.committed && l.err == nil {
+				continue
+			}
+			delete(ms.leases.leases, id)
+			if !l.committed && l.err == nil {
+				fmt.Println("Lease", id, "of", l.file.Filename, "expired")
+				go ms.abortLease(l)
+			}
+		}
+		ms.leases.lock.Unlock()
+	}
+}
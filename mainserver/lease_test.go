@@ -0,0 +1,192 @@
+package mainserver
+
+import (
+	"DistributedFileSystem/protocol"
+	"encoding/json"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNode is a storage server that only answers deletes, and remembers
+// which chunks it was asked to delete
+type fakeNode struct {
+	addr    string
+	lock    sync.Mutex
+	deleted []string
+}
+
+func newFakeNode(t *testing.T) *fakeNode {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	node := &fakeNode{addr: listener.Addr().String()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go protocol.Serve(conn, func(msg protocol.Message, encoder protocol.Encoder, _ net.Conn) {
+				var req protocol.Delete_Request
+				if msg.Type != protocol.DeleteReqM || json.Unmarshal(msg.Payload, &req) != nil {
+					return
+				}
+				node.lock.Lock()
+				node.deleted = append(node.deleted, req.Filename)
+				node.lock.Unlock()
+				payload, _ := json.Marshal(protocol.Delete_Response{Success: true})
+				encoder.Encode(protocol.Message{Type: protocol.DeleteAckN, Payload: payload})
+			})
+		}
+	}()
+	return node
+}
+
+func (node *fakeNode) wasDeleted(id string) bool {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	return slices.Contains(node.deleted, id)
+}
+
+// newLeaseServer starts a main server placing every chunk on both of two
+// fake storage servers
+func newLeaseServer(t *testing.T, leaseTimeout time.Duration) (*MainServer, []*fakeNode) {
+	t.Helper()
+	ms, err := NewMainServer(Config{
+		Addr:              "127.0.0.1:0",
+		Replication:       2,
+		ChunkSize:         100,
+		HeartbeatInterval: time.Second,
+		LeaseTimeout:      leaseTimeout,
+		NodeTimeout:       time.Second,
+		RepairConcurrency: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ms.listener.Close() })
+	nodes := []*fakeNode{newFakeNode(t), newFakeNode(t)}
+	for _, node := range nodes {
+		if err := ms.Storage.Add(node.addr, 10000); err != nil {
+			t.Fatal(err)
+		}
+		ms.Storage.Touch(node.addr)
+	}
+	return ms, nodes
+}
+
+// startUpload allocates a file of size bytes under a new lease
+func startUpload(t *testing.T, ms *MainServer, filename string, size int64) (string, protocol.Fileinfo) {
+	t.Helper()
+	file := protocol.Fileinfo{Filename: filename, Size: size, Chunks: ms.allocateChunks(size, nil)}
+	if file.Chunks == nil {
+		t.Fatal("no storage for the upload")
+	}
+	id, err := ms.openLease(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, file
+}
+
+// waitAborted waits until every replica of the file's chunks was deleted
+// and its reservations given back
+func waitAborted(t *testing.T, ms *MainServer, nodes []*fakeNode, file protocol.Fileinfo) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		deleted := true
+		for _, chunk := range file.Chunks {
+			for _, node := range nodes {
+				deleted = deleted && node.wasDeleted(chunk.ID)
+			}
+		}
+		if deleted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("chunks of the aborted upload were not deleted")
+		}
+	}
+	for _, node := range nodes {
+		if info, _ := ms.Storage.GetNode(node.addr); info.Reserved != 0 || info.Availmem != 10000 {
+			t.Fatalf("%s has %d bytes reserved and %d available after the abort", node.addr, info.Reserved, info.Availmem)
+		}
+	}
+	if _, exists := ms.FileTable.GetFile(file.Filename); exists {
+		t.Fatalf("%s was added by an aborted upload", file.Filename)
+	}
+}
+
+func TestLeaseExpires(t *testing.T) {
+	ms, nodes := newLeaseServer(t, 200*time.Millisecond)
+	id, file := startUpload(t, ms, "/f", 250)
+
+	// One replica lands, the rest never do
+	confirm := protocol.Upload_Confirm{Lease: id, Addr: nodes[0].addr, Filename: file.Chunks[0].ID, Size: file.Chunks[0].Size}
+	if err := ms.confirmReplica(confirm); err != nil {
+		t.Fatal(err)
+	}
+	waitAborted(t, ms, nodes, file)
+
+	if err := ms.commitLease(protocol.Upload_Commit{Lease: id}); protocol.CodeOf(err) != protocol.ErrNotFound {
+		t.Fatalf("commit of an expired lease got %v, expected %s", err, protocol.ErrNotFound)
+	}
+}
+
+func TestLeaseCommitRefusedWhileUnconfirmed(t *testing.T) {
+	ms, nodes := newLeaseServer(t, time.Minute)
+	id, file := startUpload(t, ms, "/f", 150)
+
+	// Every replica but the last one is confirmed
+	blocks := protocol.Blocks(file.Chunks)
+	for i, block := range blocks {
+		for j, addr := range block.Locations {
+			if i == len(blocks)-1 && j == len(block.Locations)-1 {
+				break
+			}
+			confirm := protocol.Upload_Confirm{Lease: id, Addr: addr, Filename: block.ID, Size: block.Size}
+			if err := ms.confirmReplica(confirm); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, exists := ms.FileTable.GetFile("/f"); exists {
+		t.Fatal("file listed before every replica was confirmed")
+	}
+
+	err := ms.commitLease(protocol.Upload_Commit{Lease: id})
+	if protocol.CodeOf(err) != protocol.ErrNodeUnavailable {
+		t.Fatalf("commit got %v, expected %s", err, protocol.ErrNodeUnavailable)
+	}
+	waitAborted(t, ms, nodes, file)
+}
+
+func TestLeaseCommitted(t *testing.T) {
+	ms, nodes := newLeaseServer(t, time.Minute)
+	id, file := startUpload(t, ms, "/f", 150)
+	for _, block := range protocol.Blocks(file.Chunks) {
+		for _, addr := range block.Locations {
+			confirm := protocol.Upload_Confirm{Lease: id, Addr: addr, Filename: block.ID, Size: block.Size}
+			if err := ms.confirmReplica(confirm); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := ms.commitLease(protocol.Upload_Commit{Lease: id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := ms.FileTable.GetFile("/f"); !exists {
+		t.Fatal("committed file not listed")
+	}
+	for _, node := range nodes {
+		if info, _ := ms.Storage.GetNode(node.addr); info.Reserved != 0 || info.Availmem != 10000-150 {
+			t.Fatalf("%s has %d bytes reserved and %d available after the commit", node.addr, info.Reserved, info.Availmem)
+		}
+	}
+}
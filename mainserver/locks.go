@@ -0,0 +1,87 @@
+package mainserver
+
+import (
+	"maps"
+	"path"
+	"slices"
+	"sync"
+)
+
+/*
+Path Locks
+Client requests are served concurrently. Every FileTable and StorageList
+method is atomic on its own, but an upload or delete takes several steps,
+so operations on the same name additionally hold that name's lock from
+start to finish. They also hold the lock of every directory above the name
+in shared mode, so removing or renaming a directory waits for the operations
+underneath it, while those operations do not wait for each other. Operations
+on different names do not wait for each other.
+*/
+
+type PathLocks struct {
+	lock  sync.Mutex
+	paths map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.RWMutex
+	refs int // Holders and waiters, the entry is dropped at zero
+}
+
+func NewPathLocks() *PathLocks {
+	return &PathLocks{paths: make(map[string]*pathLock)}
+}
+
+// Lock locks every given path, and every directory above them in shared
+// mode, and returns a function that unlocks them. Paths are locked in sorted
+// order, parents before their children, so two callers can never deadlock.
+func (pl *PathLocks) Lock(paths ...string) (unlock func()) {
+	exclusive := make(map[string]bool)
+	for _, name := range paths {
+		exclusive[name] = true
+	}
+	for _, name := range paths {
+		// Up to the root, whose parent is itself
+		for parent := path.Dir(name); parent != name; name, parent = parent, path.Dir(parent) {
+			if _, named := exclusive[parent]; !named {
+				exclusive[parent] = false
+			}
+		}
+	}
+	names := slices.Sorted(maps.Keys(exclusive))
+
+	held := make([]*pathLock, len(names))
+	for i, name := range names {
+		pl.lock.Lock()
+		entry, exists := pl.paths[name]
+		if !exists {
+			entry = &pathLock{}
+			pl.paths[name] = entry
+		}
+		entry.refs++
+		pl.lock.Unlock()
+
+		if exclusive[name] {
+			entry.Lock()
+		} else {
+			entry.RLock()
+		}
+		held[i] = entry
+	}
+
+	return func() {
+		for i, name := range names {
+			if exclusive[name] {
+				held[i].Unlock()
+			} else {
+				held[i].RUnlock()
+			}
+			pl.lock.Lock()
+			held[i].refs--
+			if held[i].refs == 0 {
+				delete(pl.paths, name)
+			}
+			pl.lock.Unlock()
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package mainserver
+
+import (
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestPathLocksRenames runs renames in both directions alongside mkdirs under
+// the directory being renamed, each holding its path locks as the request
+// handlers do, and checks they all finish and leave the tree whole
+func TestPathLocksRenames(t *testing.T) {
+	for round := 0; round < 50; round++ {
+		pl := NewPathLocks()
+		ft := newTestTable(t, []string{"/a"})
+
+		var wg sync.WaitGroup
+		rename := func(source, target string) {
+			defer wg.Done()
+			unlock := pl.Lock(source, target)
+			defer unlock()
+			ft.Rename(source, target, false)
+		}
+		mkdir := func(dir string) {
+			defer wg.Done()
+			unlock := pl.Lock(dir)
+			defer unlock()
+			ft.Mkdir(dir, false)
+		}
+		wg.Add(4)
+		go rename("/a", "/b")
+		go rename("/b", "/a")
+		go mkdir("/a/x")
+		go mkdir("/b/y")
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("round %d: operations deadlocked", round)
+		}
+
+		entries, err := ft.List("/", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed := map[string]bool{"/": true}
+		for _, entry := range entries {
+			if !listed[path.Dir(entry.Path)] {
+				t.Fatalf("round %d: %s listed without its parent in %v", round, entry.Path, entries)
+			}
+			listed[entry.Path] = true
+		}
+		if listed["/a"] == listed["/b"] {
+			t.Fatalf("round %d: expected exactly one of /a and /b in %v", round, entries)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package mainserver
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+/*
+Placement
+FindStorage narrows the storage servers down to the candidates for a chunk,
+those alive, not draining, not excluded and with room for it, and a
+placement policy picks among them. Policies only choose, so any of them keeps
+every copy and shard of a chunk on distinct servers and never overfills one.
+*/
+
+// A storage server that can take a chunk
+type Candidate struct {
+	Addr     string
+	Free     int64 // Available memory not reserved by transfers in progress
+	Capacity int64
+	Load     int64 // Transfers in progress at its last heartbeat
+	Reserved int64 // Bytes of transfers in progress the main server allocated
+}
+
+// Placement picks count distinct servers from the candidates, of which there
+// are at least count, for the chunk or shard with ID key. The candidates are
+// sorted by address. Place may be called concurrently.
+type Placement interface {
+	Place(key string, candidates []Candidate, count int) []string
+}
+
+// placements are the built-in policies by name
+var placements = map[string]func() Placement{
+	"most-free":       func() Placement { return mostFree{} },
+	"round-robin":     func() Placement { return &roundRobin{} },
+	"weighted-random": func() Placement { return weightedRandom{} },
+	"power-of-two":    func() Placement { return powerOfTwo{} },
+	"least-loaded":    func() Placement { return leastLoaded{} },
+	"consistent-hash": func() Placement { return consistentHash{} },
+}
+
+// NewPlacement returns the built-in policy with the given name
+func NewPlacement(name string) (Placement, error) {
+	policy, exists := placements[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown placement policy %q, expected one of %v", name, slices.Sorted(maps.Keys(placements)))
+	}
+	return policy(), nil
+}
+
+func candidateAddrs(candidates []Candidate) []string {
+	picked := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		picked[i] = candidate.Addr
+	}
+	return picked
+}
+
+// mostFree picks the servers with the most free space. Concurrent uploads
+// all go to the same servers until their reservations tip the balance.
+type mostFree struct{}
+
+func (mostFree) Place(_ string, candidates []Candidate, count int) []string {
+	slices.SortStableFunc(candidates, func(a, b Candidate) int {
+		return cmp.Compare(b.Free, a.Free)
+	})
+	return candidateAddrs(candidates[:count])
+}
+
+// roundRobin takes turns, every placement starting one server further along
+type roundRobin struct {
+	next atomic.Uint64
+}
+
+func (r *roundRobin) Place(_ string, candidates []Candidate, count int) []string {
+	start := int(r.next.Add(1) % uint64(len(candidates)))
+	return candidateAddrs(slices.Concat(candidates[start:], candidates[:start])[:count])
+}
+
+// weightedRandom picks servers at random, each with a chance proportional to
+// its free space
+type weightedRandom struct{}
+
+func (weightedRandom) Place(_ string, candidates []Candidate, count int) []string {
+	var picked []string
+	for range count {
+		var total int64
+		for _, candidate := range candidates {
+			total += candidate.Free + 1 // An empty chunk fits on a full server too
+		}
+		n := rand.Int64N(total)
+		i := 0
+		for ; n >= candidates[i].Free+1; i++ {
+			n -= candidates[i].Free + 1
+		}
+		picked = append(picked, candidates[i].Addr)
+		candidates = slices.Delete(candidates, i, i+1)
+	}
+	return picked
+}
+
+// powerOfTwo picks two servers at random for every copy and takes the one
+// with more free space, which spreads load nearly as evenly as mostFree
+// without sending every concurrent upload to the same server
+type powerOfTwo struct{}
+
+func (powerOfTwo) Place(_ string, candidates []Candidate, count int) []string {
+	var picked []string
+	for range count {
+		i := rand.IntN(len(candidates))
+		if len(candidates) > 1 {
+			j := rand.IntN(len(candidates) - 1)
+			if j >= i {
+				j++
+			}
+			if candidates[j].Free > candidates[i].Free {
+				i = j
+			}
+		}
+		picked = append(picked, candidates[i].Addr)
+		candidates = slices.Delete(candidates, i, i+1)
+	}
+	return picked
+}
+
+// leastLoaded picks the servers with the fewest transfers in progress, then
+// the fewest bytes allocated to them since, then the most free space
+type leastLoaded struct{}
+
+func (leastLoaded) Place(_ string, candidates []Candidate, count int) []string {
+	slices.SortStableFunc(candidates, func(a, b Candidate) int {
+		return cmp.Or(cmp.Compare(a.Load, b.Load), cmp.Compare(a.Reserved, b.Reserved), cmp.Compare(b.Free, a.Free))
+	})
+	return candidateAddrs(candidates[:count])
+}
+
+// consistentHash places every server at virtualNodes points on a ring and a
+// chunk on the servers that follow its ID around the ring. A chunk keeps its
+// servers as others join or leave, and re-replication, which excludes the
+// servers that already hold it, picks the next ones along.
+type consistentHash struct{}
+
+// virtualNodes is how many points each server has on the ring, which evens
+// out how much of the ring it owns
+const virtualNodes = 64
+
+type ringPoint struct {
+	hash uint64
+	addr string
+}
+
+func (consistentHash) Place(key string, candidates []Candidate, count int) []string {
+	ring := make([]ringPoint, 0, len(candidates)*virtualNodes)
+	for _, candidate := range candidates {
+		for i := range virtualNodes {
+			ring = append(ring, ringPoint{hash: ringHash(candidate.Addr + "#" + strconv.Itoa(i)), addr: candidate.Addr})
+		}
+	}
+	slices.SortFunc(ring, func(a, b ringPoint) int {
+		return cmp.Or(cmp.Compare(a.hash, b.hash), cmp.Compare(a.addr, b.addr))
+	})
+
+	start := ringHash(key)
+	at := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= start })
+	var picked []string
+	for i := 0; len(picked) < count; i++ {
+		point := ring[(at+i)%len(ring)]
+		if !slices.Contains(picked, point.addr) {
+			picked = append(picked, point.addr)
+		}
+	}
+	return picked
+}
+
+// ringHash spreads even similar strings evenly around the ring
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
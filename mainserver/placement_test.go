@@ -0,0 +1,50 @@
+package mainserver
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestPlacementPicksDistinctCandidates(t *testing.T) {
+	var candidates []Candidate
+	for i := range 7 {
+		candidates = append(candidates, Candidate{
+			Addr:     fmt.Sprintf("localhost:%d", 9101+i),
+			Free:     int64(i%3) * 1000,
+			Capacity: 10000,
+			Load:     int64(i % 2),
+			Reserved: int64(i) * 10,
+		})
+	}
+	for name := range placements {
+		policy, err := NewPlacement(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for count := 1; count <= len(candidates); count++ {
+			// Random policies get a few tries
+			for try := range 20 {
+				key := fmt.Sprintf("chunk-%d-%d", count, try)
+				picked := policy.Place(key, slices.Clone(candidates), count)
+				if len(picked) != count {
+					t.Fatalf("%s picked %d of %d servers: %v", name, len(picked), count, picked)
+				}
+				for i, addr := range picked {
+					if !slices.ContainsFunc(candidates, func(c Candidate) bool { return c.Addr == addr }) {
+						t.Fatalf("%s picked %s, which is not a candidate", name, addr)
+					}
+					if slices.Contains(picked[:i], addr) {
+						t.Fatalf("%s picked %s twice: %v", name, addr, picked)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestNewPlacementUnknown(t *testing.T) {
+	if _, err := NewPlacement("fastest"); err == nil {
+		t.Fatal("NewPlacement of an unknown policy succeeded")
+	}
+}
@@ -0,0 +1,677 @@
+package mainserver
+
+import (
+	"DistributedFileSystem/protocol"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+Replicated Metadata
+Main servers started with peers keep their tables consistent through Raft.
+One of them is elected leader and answers every request, the others refuse
+with NOT_LEADER and the leader's address. The journal doubles as the Raft
+log: a mutation is appended to the leader's journal, sent to the followers,
+and applied to the tables once a majority has it on disk. Followers apply
+the same entries in the same order, so any of them can take over with the
+same tables. A follower too far behind is sent the leader's snapshot.
+
+Only the tables are replicated. Node liveness, reservations and upload
+leases live in the leader's memory, so a new leader starts with every node
+suspect and no uploads in progress.
+
+Layout added to the metadata directory:
+raft.json - the current term and who this server voted for in it
+*/
+
+type raftState int
+
+const (
+	follower raftState = iota
+	candidate
+	leader
+)
+
+const (
+	raftFile = "raft.json"
+
+	// How often the leader sends entries, or heartbeats when there are none
+	raftHeartbeat = 50 * time.Millisecond
+	// A follower that hears nothing from a leader for a random time between
+	// this and twice this starts an election
+	electionTimeout = 300 * time.Millisecond
+	// Entries sent to a follower in a single request
+	maxBatch = 256
+)
+
+// RaftConfig describes a main server's place in a replicated group
+type RaftConfig struct {
+	ID      string   // Address of this main server, as the others know it
+	Peers   []string // Addresses of the other main servers
+	Dir     string   // Metadata directory, raft.json is kept next to the journal
+	Journal *Journal // Replayed journal, it becomes the log
+
+	// Snapshot the journal was replayed from, and the entries after it
+	LastIndex uint64
+	LastTerm  uint64
+	Entries   []LogEntry
+
+	// Apply applies a committed entry nobody waits on and calls applied
+	// before the change is visible. Install replaces the tables with a
+	// snapshot the same way. OnLeader runs once a new leader is ready.
+	Apply    func(entry LogEntry, applied func())
+	Install  func(snap Snapshot, applied func())
+	OnLeader func()
+}
+
+type raftPersist struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for,omitempty"`
+}
+
+// proposal is an entry a local caller waits on. Its apply takes the table
+// lock itself, as Apply does.
+type proposal struct {
+	term  uint64
+	apply func(entry LogEntry, applied func())
+	done  chan error
+}
+
+type Raft struct {
+	config RaftConfig
+	pool   *protocol.Pool
+
+	lock     sync.Mutex
+	applying *sync.Cond // Signalled when there is something to apply
+	state    raftState
+	term     uint64
+	votedFor string
+	leader   string    // Address of the leader of the current term, if known
+	heard    time.Time // Last contact with a leader, or vote granted
+	ready    bool      // Leading, and every earlier term's entry is applied
+
+	log       []LogEntry // Entries after the snapshot
+	lastIndex uint64     // Index of the snapshot
+	lastTerm  uint64     // Term of the snapshot
+	commit    uint64     // Highest index stored by a majority
+	applied   uint64     // Highest index applied to the tables
+	snapshot  *Snapshot  // Received from the leader, not yet installed
+
+	next    map[string]uint64        // Peer -> Next index to send it
+	match   map[string]uint64        // Peer -> Highest index known stored on it
+	acked   map[string]time.Time     // Peer -> Last answer to the leader
+	wake    map[string]chan struct{} // Peer -> Send entries now
+	waiting map[uint64]*proposal     // Index -> Local caller waiting on it
+}
+
+func NewRaft(config RaftConfig) (*Raft, error) {
+	r := &Raft{
+		config:    config,
+		pool:      &protocol.Pool{DialTimeout: electionTimeout, WriteTimeout: electionTimeout},
+		heard:     time.Now(),
+		log:       config.Entries,
+		lastIndex: config.LastIndex,
+		lastTerm:  config.LastTerm,
+		commit:    config.LastIndex,
+		applied:   config.LastIndex,
+		next:      make(map[string]uint64),
+		match:     make(map[string]uint64),
+		acked:     make(map[string]time.Time),
+		wake:      make(map[string]chan struct{}),
+		waiting:   make(map[uint64]*proposal),
+	}
+	r.applying = sync.NewCond(&r.lock)
+
+	data, err := os.ReadFile(filepath.Join(config.Dir, raftFile))
+	if err == nil {
+		var persisted raftPersist
+		if err := json.Unmarshal(data, &persisted); err != nil {
+			return nil, fmt.Errorf("corrupt %s: %v", raftFile, err)
+		}
+		r.term = persisted.Term
+		r.votedFor = persisted.VotedFor
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, peer := range config.Peers {
+		r.wake[peer] = make(chan struct{}, 1)
+	}
+	fmt.Println("Raft member", config.ID, "in term", r.term, "with peers", config.Peers)
+	return r, nil
+}
+
+// Start runs elections, replication and the applier in the background
+func (r *Raft) Start() {
+	go r.tickLoop()
+	go r.applyLoop()
+	for _, peer := range r.config.Peers {
+		go r.replicateLoop(peer)
+	}
+}
+
+// Leader returns the address requests should go to and whether that is this
+// server, ready to take them. The address is empty while none is known.
+func (r *Raft) Leader() (string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.state == leader && !r.ready {
+		return "", false
+	}
+	return r.leader, r.state == leader
+}
+
+func (r *Raft) Term() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.term
+}
+
+// Record appends the entry to the log, waits until a majority stored it, and
+// applies it with apply in log order
+func (r *Raft) Record(entry LogEntry, apply func(entry LogEntry, applied func())) error {
+	r.lock.Lock()
+	if r.state != leader || !r.ready {
+		defer r.lock.Unlock()
+		if r.state == leader {
+			return protocol.NotLeader("")
+		}
+		return protocol.NotLeader(r.leader)
+	}
+	entry.Term = r.term
+	entry.Seq = r.last() + 1
+	if err := r.config.Journal.Append(entry); err != nil {
+		r.lock.Unlock()
+		return err
+	}
+	r.log = append(r.log, entry)
+	p := &proposal{term: r.term, apply: apply, done: make(chan error, 1)}
+	r.waiting[entry.Seq] = p
+	r.advance()
+	r.lock.Unlock()
+
+	r.wakeAll()
+	return <-p.done
+}
+
+// Compact writes a snapshot of the tables as of the last applied entry and
+// drops the entries it covers. Callers hold both table locks, and make snap
+// of the tables.
+func (r *Raft) Compact(snap func(index, term uint64) Snapshot) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.applied <= r.lastIndex {
+		return nil
+	}
+	term := r.termAt(r.applied)
+	if err := r.config.Journal.Compact(snap(r.applied, term)); err != nil {
+		return err
+	}
+	r.log = slices.Clone(r.log[r.applied-r.lastIndex:])
+	r.lastIndex, r.lastTerm = r.applied, term
+	return nil
+}
+
+/* Log, callers hold r.lock */
+
+// last returns the index of the last entry
+func (r *Raft) last() uint64 {
+	return r.lastIndex + uint64(len(r.log))
+}
+
+// termAt returns the term of the entry at index, 0 if it was compacted away
+func (r *Raft) termAt(index uint64) uint64 {
+	switch {
+	case index == r.lastIndex:
+		return r.lastTerm
+	case index < r.lastIndex || index > r.last():
+		return 0
+	}
+	return r.log[index-r.lastIndex-1].Term
+}
+
+func (r *Raft) entry(index uint64) LogEntry {
+	return r.log[index-r.lastIndex-1]
+}
+
+func (r *Raft) quorum() int {
+	return (len(r.config.Peers)+1)/2 + 1
+}
+
+func (r *Raft) persist() {
+	data, err := json.Marshal(raftPersist{Term: r.term, VotedFor: r.votedFor})
+	if err == nil {
+		err = writeFileSync(filepath.Join(r.config.Dir, raftFile), data)
+	}
+	if err != nil {
+		fmt.Println("Raft Persist Error:", err)
+	}
+}
+
+// follow makes this server a follower in term, which may be the current one
+func (r *Raft) follow(term uint64, leaderAddr string) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+		r.persist()
+	}
+	if r.state == leader {
+		fmt.Println("Stepping down as leader in term", r.term)
+		// Whether those entries commit is now up to the next leader
+		for index, p := range r.waiting {
+			p.done <- protocol.Errorf(protocol.ErrInternal, "leadership lost, the change may or may not take effect")
+			delete(r.waiting, index)
+		}
+	}
+	r.state = follower
+	r.ready = false
+	r.leader = leaderAddr
+}
+
+// advance moves the commit index to the highest entry of the current term
+// stored by a majority
+func (r *Raft) advance() {
+	matches := []uint64{r.last()}
+	for _, peer := range r.config.Peers {
+		matches = append(matches, r.match[peer])
+	}
+	slices.Sort(matches)
+	slices.Reverse(matches)
+	index := matches[r.quorum()-1]
+	if index > r.commit && r.termAt(index) == r.term {
+		r.commit = index
+		r.applying.Broadcast()
+	}
+}
+
+/* Elections */
+
+// tickLoop starts an election when the leader goes quiet, and makes a
+// leader that lost touch with a majority step down
+func (r *Raft) tickLoop() {
+	ticker := time.NewTicker(raftHeartbeat)
+	defer ticker.Stop()
+	timeout := electionTimeout + rand.N(electionTimeout)
+	for range ticker.C {
+		r.lock.Lock()
+		switch {
+		case r.state == leader:
+			reached := 1
+			for _, peer := range r.config.Peers {
+				if time.Since(r.acked[peer]) < 2*electionTimeout {
+					reached++
+				}
+			}
+			if reached < r.quorum() {
+				fmt.Println("Lost contact with a majority of main servers")
+				r.follow(r.term, "")
+			}
+		case time.Since(r.heard) >= timeout:
+			r.campaign()
+			timeout = electionTimeout + rand.N(electionTimeout)
+		}
+		r.lock.Unlock()
+	}
+}
+
+// campaign starts an election in the next term. Callers hold r.lock.
+func (r *Raft) campaign() {
+	r.follow(r.term+1, "")
+	r.state = candidate
+	r.votedFor = r.config.ID
+	r.persist()
+	r.heard = time.Now()
+	fmt.Println("Starting election for term", r.term)
+
+	term := r.term
+	votes := 1
+	if votes >= r.quorum() {
+		r.lead()
+		return
+	}
+	req := protocol.Vote_Request{Term: term, Candidate: r.config.ID, LastIndex: r.last(), LastTerm: r.termAt(r.last())}
+	for _, peer := range r.config.Peers {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), electionTimeout)
+			defer cancel()
+			var resp protocol.Vote_Response
+			if err := r.pool.Call(ctx, peer, protocol.VoteReq, req, protocol.VoteResp, &resp); err != nil {
+				return
+			}
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if resp.Term > r.term {
+				r.follow(resp.Term, "")
+				return
+			}
+			if !resp.Granted || r.state != candidate || r.term != term {
+				return
+			}
+			votes++
+			if votes >= r.quorum() {
+				r.lead()
+			}
+		}()
+	}
+}
+
+// lead makes this candidate the leader. It is ready once the entry it
+// appends in its own term is applied, and with it every earlier one.
+// Callers hold r.lock.
+func (r *Raft) lead() {
+	fmt.Println("Elected leader for term", r.term)
+	r.state = leader
+	r.leader = r.config.ID
+	for _, peer := range r.config.Peers {
+		r.next[peer] = r.last() + 1
+		r.match[peer] = 0
+		r.acked[peer] = time.Now()
+	}
+	noop := LogEntry{Seq: r.last() + 1, Term: r.term, Op: OpNoop}
+	if err := r.config.Journal.Append(noop); err != nil {
+		fmt.Println("Journal Append Error:", err)
+		r.follow(r.term, "")
+		return
+	}
+	r.log = append(r.log, noop)
+	r.advance()
+	r.wakeAll()
+}
+
+// HandleVote answers a candidate
+func (r *Raft) HandleVote(req protocol.Vote_Request) protocol.Vote_Response {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if req.Term > r.term {
+		r.follow(req.Term, "")
+	}
+	if req.Term < r.term {
+		return protocol.Vote_Response{Term: r.term}
+	}
+
+	// Only vote for a log holding at least everything this one does
+	last, lastTerm := r.last(), r.termAt(r.last())
+	upToDate := req.LastTerm > lastTerm || (req.LastTerm == lastTerm && req.LastIndex >= last)
+	if (r.votedFor != "" && r.votedFor != req.Candidate) || !upToDate {
+		return protocol.Vote_Response{Term: r.term}
+	}
+	r.votedFor = req.Candidate
+	r.persist()
+	r.heard = time.Now()
+	return protocol.Vote_Response{Term: r.term, Granted: true}
+}
+
+/* Replication */
+
+func (r *Raft) wakeAll() {
+	for _, wake := range r.wake {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicateLoop keeps a peer's log up to date while leading
+func (r *Raft) replicateLoop(peer string) {
+	ticker := time.NewTicker(raftHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.wake[peer]:
+		}
+		// Keep sending while the peer is behind
+		for r.replicate(peer) {
+		}
+	}
+}
+
+// replicate sends a peer the entries it lacks, or the snapshot if they were
+// compacted away. It returns true if there is more to send right away.
+func (r *Raft) replicate(peer string) bool {
+	r.lock.Lock()
+	if r.state != leader {
+		r.lock.Unlock()
+		return false
+	}
+	term := r.term
+	next := r.next[peer]
+	if next <= r.lastIndex {
+		r.lock.Unlock()
+		return r.sendSnapshot(peer, term)
+	}
+
+	req := protocol.AppendEntries_Request{
+		Term:      term,
+		Leader:    r.config.ID,
+		PrevIndex: next - 1,
+		PrevTerm:  r.termAt(next - 1),
+		Commit:    r.commit,
+	}
+	for index := next; index <= r.last() && len(req.Entries) < maxBatch; index++ {
+		data, err := json.Marshal(r.entry(index))
+		if err != nil {
+			r.lock.Unlock()
+			fmt.Println("Raft Marshal Error:", err)
+			return false
+		}
+		req.Entries = append(req.Entries, data)
+	}
+	r.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), electionTimeout)
+	defer cancel()
+	var resp protocol.AppendEntries_Response
+	if err := r.pool.Call(ctx, peer, protocol.AppendEntriesReq, req, protocol.AppendEntriesResp, &resp); err != nil {
+		return false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if resp.Term > r.term {
+		r.follow(resp.Term, "")
+		return false
+	}
+	if r.state != leader || r.term != term {
+		return false
+	}
+	r.acked[peer] = time.Now()
+	if !resp.Success {
+		// Back up to where the logs may agree
+		r.next[peer] = max(min(resp.Match+1, next-1), 1)
+		return true
+	}
+	r.match[peer] = max(r.match[peer], resp.Match)
+	r.next[peer] = r.match[peer] + 1
+	r.advance()
+	return r.next[peer] <= r.last()
+}
+
+func (r *Raft) sendSnapshot(peer string, term uint64) bool {
+	data, err := r.config.Journal.ReadSnapshot()
+	if err != nil || data == nil {
+		fmt.Println("Raft Snapshot Read Error:", err)
+		return false
+	}
+	var snap struct {
+		LastSeq uint64 `json:"last_seq"`
+	}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		fmt.Println("Raft Snapshot Read Error:", err)
+		return false
+	}
+
+	fmt.Println("Sending snapshot at entry", snap.LastSeq, "to", peer)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*electionTimeout)
+	defer cancel()
+	req := protocol.InstallSnapshot_Request{Term: term, Leader: r.config.ID, Snapshot: data}
+	var resp protocol.InstallSnapshot_Response
+	if err := r.pool.Call(ctx, peer, protocol.InstallSnapshotReq, req, protocol.InstallSnapshotAck, &resp); err != nil {
+		fmt.Println("Raft Snapshot Send Error to", peer, err)
+		return false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if resp.Term > r.term {
+		r.follow(resp.Term, "")
+		return false
+	}
+	if r.state != leader || r.term != term {
+		return false
+	}
+	r.acked[peer] = time.Now()
+	r.match[peer] = max(r.match[peer], snap.LastSeq)
+	r.next[peer] = r.match[peer] + 1
+	r.advance()
+	return r.next[peer] <= r.last()
+}
+
+// HandleAppendEntries stores the leader's entries after the ones both logs agree on
+func (r *Raft) HandleAppendEntries(req protocol.AppendEntries_Request) protocol.AppendEntries_Response {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if req.Term < r.term {
+		return protocol.AppendEntries_Response{Term: r.term}
+	}
+	r.follow(req.Term, req.Leader)
+	r.heard = time.Now()
+
+	// The entry before the new ones has to match, else find where the logs diverge
+	if req.PrevIndex > r.last() {
+		return protocol.AppendEntries_Response{Term: r.term, Match: r.last()}
+	}
+	if req.PrevIndex > r.lastIndex && r.termAt(req.PrevIndex) != req.PrevTerm {
+		conflict := r.termAt(req.PrevIndex)
+		index := req.PrevIndex
+		for index > r.lastIndex+1 && r.termAt(index-1) == conflict {
+			index--
+		}
+		return protocol.AppendEntries_Response{Term: r.term, Match: index - 1}
+	}
+
+	var entries []LogEntry
+	for _, data := range req.Entries {
+		var entry LogEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			fmt.Println("Raft Decode Error:", err)
+			return protocol.AppendEntries_Response{Term: r.term, Match: r.commit}
+		}
+		// Skip what is already compacted, or already here in the same term
+		if entry.Seq <= r.lastIndex || (entry.Seq <= r.last() && r.termAt(entry.Seq) == entry.Term) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) > 0 {
+		// Anything from the first differing entry on came from a deposed leader
+		if first := entries[0].Seq; first <= r.last() {
+			if err := r.config.Journal.Truncate(first - 1); err != nil {
+				fmt.Println("Journal Truncate Error:", err)
+				return protocol.AppendEntries_Response{Term: r.term, Match: r.commit}
+			}
+			r.log = r.log[:first-1-r.lastIndex]
+		}
+		if err := r.config.Journal.Append(entries...); err != nil {
+			fmt.Println("Journal Append Error:", err)
+			return protocol.AppendEntries_Response{Term: r.term, Match: r.commit}
+		}
+		r.log = append(r.log, entries...)
+	}
+
+	match := req.PrevIndex + uint64(len(req.Entries))
+	if commit := min(req.Commit, match); commit > r.commit {
+		r.commit = commit
+		r.applying.Broadcast()
+	}
+	return protocol.AppendEntries_Response{Term: r.term, Success: true, Match: match}
+}
+
+// HandleInstallSnapshot replaces the log and the tables with the leader's snapshot
+func (r *Raft) HandleInstallSnapshot(req protocol.InstallSnapshot_Request) protocol.InstallSnapshot_Response {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if req.Term < r.term {
+		return protocol.InstallSnapshot_Response{Term: r.term}
+	}
+	r.follow(req.Term, req.Leader)
+	r.heard = time.Now()
+
+	var snap Snapshot
+	if err := json.Unmarshal(req.Snapshot, &snap); err != nil {
+		fmt.Println("Raft Decode Error:", err)
+		return protocol.InstallSnapshot_Response{Term: r.term}
+	}
+	if snap.LastSeq <= r.applied {
+		return protocol.InstallSnapshot_Response{Term: r.term}
+	}
+	if err := r.config.Journal.Install(snap); err != nil {
+		fmt.Println("Journal Install Error:", err)
+		return protocol.InstallSnapshot_Response{Term: r.term}
+	}
+	fmt.Println("Installed snapshot at entry", snap.LastSeq, "from", req.Leader)
+	r.log = nil
+	r.lastIndex, r.lastTerm = snap.LastSeq, snap.LastTerm
+	r.commit = max(r.commit, snap.LastSeq)
+	r.snapshot = &snap
+	r.applying.Broadcast()
+	return protocol.InstallSnapshot_Response{Term: r.term}
+}
+
+/* Applying */
+
+// applyLoop applies committed entries to the tables in log order
+func (r *Raft) applyLoop() {
+	for {
+		r.lock.Lock()
+		for r.applied >= r.commit && r.snapshot == nil {
+			r.applying.Wait()
+		}
+
+		if snap := r.snapshot; snap != nil {
+			r.snapshot = nil
+			r.lock.Unlock()
+			r.config.Install(*snap, func() { r.markApplied(snap.LastSeq) })
+			continue
+		}
+
+		entry := r.entry(r.applied + 1)
+		p := r.waiting[entry.Seq]
+		delete(r.waiting, entry.Seq)
+		r.lock.Unlock()
+
+		if p != nil && p.term == entry.Term {
+			p.apply(entry, func() { r.markApplied(entry.Seq) })
+			p.done <- nil
+			continue
+		}
+		if p != nil {
+			p.done <- protocol.Errorf(protocol.ErrInternal, "the change was overwritten by another leader")
+		}
+		if entry.Op == OpNoop {
+			r.markApplied(entry.Seq)
+			continue
+		}
+		r.config.Apply(entry, func() { r.markApplied(entry.Seq) })
+	}
+}
+
+func (r *Raft) markApplied(index uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.applied = max(r.applied, index)
+
+	// A new leader's own first entry is applied, so is everything before it
+	if r.state == leader && !r.ready && r.termAt(r.applied) == r.term {
+		r.ready = true
+		fmt.Println("Leader for term", r.term, "is ready")
+		go r.config.OnLeader()
+	}
+}
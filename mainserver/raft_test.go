@@ -0,0 +1,185 @@
+package mainserver
+
+import (
+	"DistributedFileSystem/protocol"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func newTestRaft(t *testing.T, dir string, peers ...string) *Raft {
+	t.Helper()
+	journal, err := OpenJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.Replay(func(Snapshot) {}, func(LogEntry) {}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { journal.Close() })
+	r, err := NewRaft(RaftConfig{
+		ID:       "localhost:9100",
+		Peers:    peers,
+		Dir:      dir,
+		Journal:  journal,
+		Apply:    func(_ LogEntry, applied func()) { applied() },
+		Install:  func(_ Snapshot, applied func()) { applied() },
+		OnLeader: func() {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// rawEntries encodes entries the way a leader sends them
+func rawEntries(t *testing.T, entries ...LogEntry) []json.RawMessage {
+	t.Helper()
+	var raw []json.RawMessage
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw = append(raw, data)
+	}
+	return raw
+}
+
+func TestRaftVotes(t *testing.T) {
+	dir := t.TempDir()
+	r := newTestRaft(t, dir, "localhost:9101", "localhost:9102")
+
+	votes := []struct {
+		req     protocol.Vote_Request
+		granted bool
+	}{
+		{protocol.Vote_Request{Term: 1, Candidate: "a"}, true},
+		{protocol.Vote_Request{Term: 1, Candidate: "a"}, true},  // Asking again
+		{protocol.Vote_Request{Term: 1, Candidate: "b"}, false}, // One vote per term
+		{protocol.Vote_Request{Term: 2, Candidate: "b"}, true},
+		{protocol.Vote_Request{Term: 1, Candidate: "c"}, false}, // Stale term
+	}
+	for i, vote := range votes {
+		resp := r.HandleVote(vote.req)
+		if resp.Granted != vote.granted {
+			t.Fatalf("vote %d for %s in term %d: granted %v, expected %v", i, vote.req.Candidate, vote.req.Term, resp.Granted, vote.granted)
+		}
+	}
+	if term := r.Term(); term != 2 {
+		t.Fatalf("term %d after the votes, expected 2", term)
+	}
+
+	// The vote survives a restart
+	restarted, err := NewRaft(RaftConfig{ID: "localhost:9100", Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted.term != 2 || restarted.votedFor != "b" {
+		t.Fatalf("restarted in term %d having voted for %q, expected term 2 and b", restarted.term, restarted.votedFor)
+	}
+
+	// Only a candidate with a log at least as complete gets a vote
+	resp := r.HandleAppendEntries(protocol.AppendEntries_Request{
+		Term:    2,
+		Leader:  "b",
+		Entries: rawEntries(t, LogEntry{Seq: 1, Term: 2, Op: OpNoop}, LogEntry{Seq: 2, Term: 2, Op: OpMkdir, Filename: "/d"}),
+	})
+	if !resp.Success {
+		t.Fatalf("append rejected: %+v", resp)
+	}
+	logs := []struct {
+		req     protocol.Vote_Request
+		granted bool
+	}{
+		{protocol.Vote_Request{Term: 3, Candidate: "c", LastIndex: 5, LastTerm: 1}, false}, // Older last term
+		{protocol.Vote_Request{Term: 4, Candidate: "c", LastIndex: 1, LastTerm: 2}, false}, // Shorter
+		{protocol.Vote_Request{Term: 5, Candidate: "c", LastIndex: 2, LastTerm: 2}, true},
+	}
+	for i, vote := range logs {
+		resp := r.HandleVote(vote.req)
+		if resp.Granted != vote.granted {
+			t.Fatalf("vote %d for a log ending at %d in term %d: granted %v, expected %v", i, vote.req.LastIndex, vote.req.LastTerm, resp.Granted, vote.granted)
+		}
+	}
+}
+
+func TestRaftAppendEntriesReplacesConflicts(t *testing.T) {
+	r := newTestRaft(t, t.TempDir(), "localhost:9101", "localhost:9102")
+
+	resp := r.HandleAppendEntries(protocol.AppendEntries_Request{
+		Term:   1,
+		Leader: "a",
+		Entries: rawEntries(t,
+			LogEntry{Seq: 1, Term: 1, Op: OpNoop},
+			LogEntry{Seq: 2, Term: 1, Op: OpMkdir, Filename: "/a"},
+			LogEntry{Seq: 3, Term: 1, Op: OpMkdir, Filename: "/b"},
+		),
+		Commit: 1,
+	})
+	if !resp.Success || resp.Match != 3 || r.commit != 1 {
+		t.Fatalf("first append: %+v, commit %d", resp, r.commit)
+	}
+
+	// Entries that do not follow on from the log are refused with a hint
+	resp = r.HandleAppendEntries(protocol.AppendEntries_Request{Term: 1, Leader: "a", PrevIndex: 5, PrevTerm: 1})
+	if resp.Success || resp.Match != 3 {
+		t.Fatalf("append after a gap: %+v", resp)
+	}
+	resp = r.HandleAppendEntries(protocol.AppendEntries_Request{Term: 2, Leader: "b", PrevIndex: 3, PrevTerm: 2})
+	if resp.Success || resp.Match != 0 {
+		t.Fatalf("append after a different term: %+v", resp)
+	}
+
+	// A new leader overwrites what the old one did not commit
+	resp = r.HandleAppendEntries(protocol.AppendEntries_Request{
+		Term:      2,
+		Leader:    "b",
+		PrevIndex: 1,
+		PrevTerm:  1,
+		Entries:   rawEntries(t, LogEntry{Seq: 2, Term: 2, Op: OpNoop}),
+		Commit:    2,
+	})
+	if !resp.Success || resp.Match != 2 {
+		t.Fatalf("append of the new leader: %+v", resp)
+	}
+	if r.last() != 2 || r.termAt(2) != 2 || r.commit != 2 {
+		t.Fatalf("log ends at %d in term %d with commit %d, expected 2, 2 and 2", r.last(), r.termAt(2), r.commit)
+	}
+	if seq := r.config.Journal.LastSeq(); seq != 2 {
+		t.Fatalf("journal ends at %d, expected 2", seq)
+	}
+
+	// The deposed leader is told the new term
+	resp = r.HandleAppendEntries(protocol.AppendEntries_Request{Term: 1, Leader: "a", PrevIndex: 3, PrevTerm: 1})
+	if resp.Success || resp.Term != 2 {
+		t.Fatalf("append of the old leader: %+v", resp)
+	}
+}
+
+func TestRaftSingleServerLeads(t *testing.T) {
+	r := newTestRaft(t, t.TempDir())
+	r.Start()
+
+	deadline := time.Now().Add(5 * electionTimeout)
+	for {
+		if addr, leading := r.Leader(); leading && addr == "localhost:9100" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no leader elected")
+		}
+		time.Sleep(raftHeartbeat)
+	}
+
+	var applied []LogEntry
+	if err := r.Record(LogEntry{Op: OpMkdir, Filename: "/d"}, func(entry LogEntry, markApplied func()) {
+		applied = append(applied, entry)
+		markApplied()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 || applied[0].Filename != "/d" || applied[0].Term != r.Term() {
+		t.Fatalf("applied %+v, expected /d in term %d", applied, r.Term())
+	}
+}
@@ -0,0 +1,88 @@
+package mainserver
+
+import (
+	"DistributedFileSystem/protocol"
+	"fmt"
+	"slices"
+)
+
+/*
+Shard Rebuilds
+A shard of an erasure-coded chunk has a single location, so once that node
+dies, loses the shard or finds it corrupt, the shard is gone. It is rebuilt
+by a node holding no other shard of the chunk, which reads enough of the
+other shards to reconstruct it and stores the result.
+*/
+
+// rebuildShards rebuilds the shards one after the other, moving them off from
+// if it is non-empty
+func (ms *MainServer) rebuildShards(ids []string, from string) {
+	for _, id := range ids {
+		if err := ms.rebuildShard(id, from, 0); err != nil {
+			fmt.Println("Rebuild of shard", id, "Failed:", err)
+		}
+	}
+}
+
+// rebuildShard reconstructs a shard on a storage server holding no other
+// shard of its chunk, reading the others at no more than rate bytes per
+// second unless it is 0, and records it there instead of on from, if from is
+// non-empty. A shard that is no longer in the file table, is already being
+// rebuilt, or is still held elsewhere than on from, is skipped.
+func (ms *MainServer) rebuildShard(id string, from string, rate int64) error {
+	if !ms.leading() {
+		return protocol.NotLeader("")
+	}
+	chunk, index, target, err := ms.startRebuild(id, from)
+	if target == "" {
+		return err
+	}
+	defer func() {
+		ms.rebuildLock.Lock()
+		delete(ms.rebuilding, id)
+		ms.rebuildLock.Unlock()
+	}()
+	shard := chunk.Shards[index]
+	if err := ms.rebuildOn(target, chunk, index, rate); err != nil {
+		ms.Storage.Reserve(target, -shard.Size)
+		return err
+	}
+	fmt.Println("Rebuilt shard", shard.ID, "of chunk", chunk.ID, "on", target)
+	ms.moveReplica(shard, from, target)
+	return nil
+}
+
+// startRebuild picks and reserves a server for a shard to be rebuilt on,
+// avoiding every server that holds or is getting a shard of its chunk, and
+// marks the shard as being rebuilt there. It returns no server if the
+// shard needs no rebuild, one is already in progress, or no server has room.
+func (ms *MainServer) startRebuild(id string, from string) (protocol.Chunkinfo, int, string, error) {
+	ms.rebuildLock.Lock()
+	defer ms.rebuildLock.Unlock()
+	chunk, index, exists := ms.FileTable.FindShard(id)
+	if !exists {
+		return chunk, index, "", nil
+	}
+	if _, busy := ms.rebuilding[id]; busy {
+		return chunk, index, "", nil
+	}
+	shard := chunk.Shards[index]
+	if slices.ContainsFunc(shard.Locations, func(location string) bool {
+		return location != from
+	}) {
+		return chunk, index, "", nil
+	}
+
+	avoid := append(chunk.Holders(), from)
+	for _, other := range chunk.Shards {
+		if target, busy := ms.rebuilding[other.ID]; busy {
+			avoid = append(avoid, target)
+		}
+	}
+	targets := ms.reserveStorage(shard.ID, shard.Size, 1, avoid)
+	if targets == nil {
+		return chunk, index, "", protocol.Errorf(protocol.ErrNoSpace, "no storage available")
+	}
+	ms.rebuilding[id] = targets[0]
+	return chunk, index, targets[0], nil
+}
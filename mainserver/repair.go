@@ -0,0 +1,82 @@
+package mainserver
+
+import (
+	"DistributedFileSystem/protocol"
+	"fmt"
+	"slices"
+)
+
+// handleCorruption drops the replicas a storage server found corrupt and
+// copies each affected chunk from a surviving replica to a new server, or
+// rebuilds a corrupt shard from the other shards of its chunk.
+// A chunk with no surviving replica, or too few shards, marks its file
+// corrupt. The new copy goes to a different server than addr when possible,
+// as its disk is suspect.
+func (ms *MainServer) handleCorruption(addr string, ids []string) {
+	var shards []string
+	for _, id := range ids {
+		chunk, exists := ms.dropReplica(id, addr)
+		if !exists {
+			continue
+		}
+		if _, _, coded := ms.FileTable.FindShard(id); coded {
+			shards = append(shards, id)
+			continue
+		}
+		if len(chunk.Locations) == 0 {
+			fmt.Println("Chunk", id, "has no intact replica left")
+			continue
+		}
+		go func() {
+			if err := ms.repairChunk(chunk, addr); err != nil {
+				fmt.Println("Repair of chunk", chunk.ID, "Failed:", err)
+			}
+		}()
+	}
+	if len(shards) > 0 {
+		go ms.rebuildShards(shards, "")
+	}
+}
+
+// dropReplica removes addr from a chunk's locations and returns the chunk as updated
+func (ms *MainServer) dropReplica(id string, addr string) (protocol.Chunkinfo, bool) {
+	var dropped protocol.Chunkinfo
+	file, _ := ms.FileTable.UpdateChunk(id, func(file *protocol.Fileinfo, chunk *protocol.Chunkinfo) bool {
+		if !slices.Contains(chunk.Locations, addr) {
+			return false
+		}
+		chunk.Locations = slices.DeleteFunc(chunk.Locations, func(location string) bool {
+			return location == addr
+		})
+		if slices.ContainsFunc(file.Chunks, func(chunk protocol.Chunkinfo) bool {
+			return !chunk.Readable()
+		}) {
+			file.Corrupt = true
+		}
+		dropped = *chunk
+		return true
+	})
+	if dropped.ID == "" {
+		return protocol.Chunkinfo{}, false
+	}
+	ms.Storage.ChangeMem(addr, +dropped.Size)
+	fmt.Println("Dropped replica of chunk", id, "of", file.Filename, "on", addr)
+	return dropped, true
+}
+
+// repairChunk adds one replica of the chunk on a server that does not hold
+// it yet, avoiding the servers in avoid unless there is no other choice
+func (ms *MainServer) repairChunk(chunk protocol.Chunkinfo, avoid ...string) error {
+	targets := ms.reserveStorage(chunk.ID, chunk.Size, 1, append(slices.Clone(chunk.Locations), avoid...))
+	if targets == nil {
+		targets = ms.reserveStorage(chunk.ID, chunk.Size, 1, chunk.Locations)
+	}
+	if targets == nil {
+		return protocol.Errorf(protocol.ErrNoSpace, "no storage available")
+	}
+	if err := ms.copyChunk(chunk, chunk.Locations, targets[0], 0); err != nil {
+		return err
+	}
+	ms.moveReplica(chunk, "", targets[0])
+	return nil
+}
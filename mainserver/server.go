@@ -1,33 +1,553 @@
 package mainserver
 
 import (
+	"DistributedFileSystem/erasure"
 	"DistributedFileSystem/protocol"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"path"
+	"slices"
+	"sync"
+	"time"
 )
 
 /*
 Server Definition
 A server has a listener for requests
-A file table that maps fileNames to fileinfo struct which contains storage address
+A file table that maps fileNames to fileinfo struct which lists the file's chunks and their storage addresses
 A map of storages along with their available memory.
+A journal that makes both tables survive restarts (optional).
+Raft, replicating the journal to the other main servers (optional).
 */
 
 type MainServer struct {
-	listener  net.Listener
-	FileTable *FileTable
-	Storage   *StorageList
+	listener    net.Listener
+	FileTable   *FileTable
+	Storage     *StorageList
+	journal     *Journal
+	raft        *Raft // Nil unless started with peers
+	replication int
+	chunkSize   int64
+	heartbeat   time.Duration
+
+	paths     *PathLocks // Serializes operations on the same name
+	allocLock sync.Mutex // Held from picking storage until its memory is reserved
+	placement Placement  // Picks the storage servers for new chunks
+
+	// Shards being rebuilt and the server each goes to, so two rebuilds of
+	// one chunk never pick the same server
+	rebuildLock sync.Mutex
+	rebuilding  map[string]string
+
+	healing           chan struct{} // Asks for a re-replication pass
+	repairConcurrency int
+	repairRate        int64
+
+	balancer *Balancer // Moves chunks between nodes while a balance is in progress
+
+	leases       *Leases // Uploads that are not committed yet
+	leaseTimeout time.Duration
+
+	nodes        *protocol.Pool // Connections to the storage servers
+	nodeTimeout  time.Duration
+	storageAddrs []string // Probed by every new leader
+}
+
+type Config struct {
+	Addr         string    // Address to listen on
+	StorageAddrs []string  // Storage servers to probe on startup
+	MetaDir      string    // Directory to persist metadata in, empty keeps it in memory
+	Peers        []string  // Every main server replicating the metadata, Addr among them
+	Replication  int       // Number of storage servers every chunk is placed on
+	ChunkSize    int64     // Size files are split into
+	Placement    Placement // Picks storage servers for chunks, nil for the ones with the most free space
+
+	// Storage servers heartbeat this often. One that is silent for
+	// suspectAfter intervals is probed, and declared dead after deadAfter.
+	HeartbeatInterval time.Duration
+
+	// An upload whose chunks are not all stored and committed within this
+	// long of the last progress is aborted
+	LeaseTimeout time.Duration
+
+	// How long a storage server may take to connect to and to answer a
+	// request to delete a chunk
+	NodeTimeout time.Duration
+
+	// Once a storage server is declared dead, at most RepairConcurrency of
+	// the chunks it held are copied to other servers at once, together at
+	// no more than RepairRate bytes per second. A zero RepairRate is unlimited.
+	RepairConcurrency int
+	RepairRate        int64
 }
 
-func NewMainServer(addr string, storagelist []string) (*MainServer, error) {
-	listener, err := net.Listen("tcp", addr)
-	fmt.Println("Established Listener at address: ", addr)
+const (
+	suspectAfter = 3
+	deadAfter    = 10
+
+	// Deleting a chunk twice is harmless, so a delete whose connection
+	// fails is retried
+	deleteAttempts = 3
+)
+
+// NewMainServer creates a main server. If config.MetaDir is non-empty, metadata is
+// recovered from and persisted to that directory.
+func NewMainServer(config Config) (*MainServer, error) {
+	if config.Replication < 1 {
+		return nil, fmt.Errorf("replication factor must be at least 1, got %d", config.Replication)
+	}
+	if config.ChunkSize < 1 {
+		return nil, fmt.Errorf("chunk size must be positive, got %d", config.ChunkSize)
+	}
+	if config.HeartbeatInterval <= 0 {
+		return nil, fmt.Errorf("heartbeat interval must be positive, got %v", config.HeartbeatInterval)
+	}
+	if config.LeaseTimeout <= 0 {
+		return nil, fmt.Errorf("lease timeout must be positive, got %v", config.LeaseTimeout)
+	}
+	if config.NodeTimeout <= 0 {
+		return nil, fmt.Errorf("node timeout must be positive, got %v", config.NodeTimeout)
+	}
+	if config.RepairConcurrency < 1 {
+		return nil, fmt.Errorf("repair concurrency must be at least 1, got %d", config.RepairConcurrency)
+	}
+	if config.RepairRate < 0 {
+		return nil, fmt.Errorf("repair rate must not be negative, got %d", config.RepairRate)
+	}
+	if len(config.Peers) > 0 {
+		if config.MetaDir == "" {
+			return nil, fmt.Errorf("replicating metadata among peers needs a metadata directory")
+		}
+		if !slices.Contains(config.Peers, config.Addr) {
+			return nil, fmt.Errorf("peers %v do not include this server's address %s", config.Peers, config.Addr)
+		}
+	}
+	if config.Placement == nil {
+		config.Placement = mostFree{}
+	}
+	listener, err := net.Listen("tcp", config.Addr)
+	fmt.Println("Established Listener at address: ", config.Addr)
 	if err != nil {
 		fmt.Println("Main Server Create Failed", err)
 		return nil, err
 	}
-	return &MainServer{listener, NewFileTable(), NewStorage(storagelist)}, nil
+	ms := &MainServer{
+		listener:    listener,
+		FileTable:   NewFileTable(),
+		Storage:     NewStorage(),
+		replication: config.Replication,
+		chunkSize:   config.ChunkSize,
+		heartbeat:   config.HeartbeatInterval,
+		paths:       NewPathLocks(),
+		placement:   config.Placement,
+
+		leases:       NewLeases(),
+		leaseTimeout: config.LeaseTimeout,
+
+		nodes:        &protocol.Pool{DialTimeout: config.NodeTimeout, WriteTimeout: config.NodeTimeout},
+		nodeTimeout:  config.NodeTimeout,
+		storageAddrs: config.StorageAddrs,
+
+		healing:           make(chan struct{}, 1),
+		repairConcurrency: config.RepairConcurrency,
+		repairRate:        config.RepairRate,
+
+		balancer:   NewBalancer(),
+		rebuilding: make(map[string]string),
+	}
+
+	switch {
+	case len(config.Peers) > 0:
+		err = ms.recoverRaft(config.MetaDir, config.Addr, config.Peers)
+	case config.MetaDir != "":
+		err = ms.recover(config.MetaDir)
+	}
+	if err != nil {
+		fmt.Println("Metadata Recovery Failed", err)
+		listener.Close()
+		return nil, err
+	}
+
+	// A replicated server probes once it is elected leader
+	if ms.raft == nil {
+		for _, addr := range config.StorageAddrs {
+			ms.probeStorage(addr)
+		}
+	}
+	go ms.monitorLoop()
+	go ms.leaseLoop()
+	go ms.healLoop()
+	return ms, nil
+}
+
+// probeStorage registers a storage server and reconciles the file table
+// against the block report it sends back
+func (ms *MainServer) probeStorage(addr string) {
+	fmt.Println("Establishing connection with storage server at address:", addr)
+	report, err := ms.getBlockReport(addr)
+	if err != nil {
+		fmt.Println("Block Report Error from", addr, err)
+		ms.Storage.Add(addr, -1)
+		return
+	}
+	if err := ms.register(addr, report); err != nil {
+		fmt.Println("Register of", addr, "Failed:", err)
+	}
+}
+
+// register adds a storage server that proved to be alive by sending its block report
+func (ms *MainServer) register(addr string, report protocol.BlockReport_Response) error {
+	if err := ms.Storage.Add(addr, report.Availmem); err != nil {
+		return err
+	}
+	ms.Storage.Heartbeat(addr, protocol.Heartbeat_Request{
+		Addr:      addr,
+		Availmem:  report.Availmem,
+		Capacity:  report.Capacity,
+		FileCount: len(report.Files),
+	})
+	fmt.Println("Server", addr, "is available with memory:", report.Availmem, "holding", len(report.Files), "files")
+	ms.reconcile(addr, report)
+	return nil
+}
+
+// monitorLoop tracks storage server liveness. A node whose heartbeats are
+// overdue is probed directly, which also keeps nodes started without
+// -main_addr alive, and is declared dead once it has been silent too long.
+// The chunks of a dead node are then copied elsewhere.
+func (ms *MainServer) monitorLoop() {
+	ticker := time.NewTicker(ms.heartbeat)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !ms.leading() {
+			continue
+		}
+		for addr, node := range ms.Storage.ListNodes() {
+			silent := time.Since(node.LastHeartbeat)
+			if silent < suspectAfter*ms.heartbeat {
+				continue
+			}
+			if mem := ms.getAvailableMemory(addr, ms.heartbeat); mem >= 0 {
+				ms.revive(addr, node)
+				ms.Storage.Touch(addr)
+				continue
+			}
+			if silent >= deadAfter*ms.heartbeat {
+				if ms.Storage.SetStatus(addr, protocol.NodeDead) {
+					ms.triggerHeal()
+				}
+			} else {
+				ms.Storage.SetStatus(addr, protocol.NodeSuspect)
+			}
+		}
+	}
+}
+
+// revive catches up with a node that answers again after it was declared
+// dead. Its block report shows which of its chunks were copied elsewhere in
+// the meantime.
+func (ms *MainServer) revive(addr string, node protocol.Nodeinfo) {
+	if node.Status == protocol.NodeDead {
+		fmt.Println("Storage server", addr, "is back, reconciling its chunks")
+		go ms.probeStorage(addr)
+	}
+}
+
+// reconcile makes the file table agree with what a storage server actually holds.
+// Chunk copies the table does not know about are added as replicas, unless
+// the chunk has all of its live replicas already, and replicas the node no
+// longer has are dropped and restored elsewhere. Chunks that belong to no
+// file are deleted when the table is authoritative, i.e. recovered from a journal.
+func (ms *MainServer) reconcile(addr string, report protocol.BlockReport_Response) {
+	live := ms.liveNodes()
+	var unwanted []protocol.Blockinfo // Deleted from addr
+	held := make(map[string]bool, len(report.Files))
+	for _, block := range report.Files {
+		held[block.Filename] = true
+
+		// A shard is only ever kept once
+		wanted := ms.replication
+		if _, _, coded := ms.FileTable.FindShard(block.Filename); coded {
+			wanted = 1
+		}
+		surplus := false
+		_, exists := ms.FileTable.UpdateChunk(block.Filename, func(file *protocol.Fileinfo, chunk *protocol.Chunkinfo) bool {
+			if slices.Contains(chunk.Locations, addr) {
+				return false
+			}
+			if chunk.Size != block.Size {
+				fmt.Println("Chunk", chunk.ID, "on", addr, "has size", block.Size, ", recorded", chunk.Size, ", leaving it untouched")
+				return false
+			}
+			copies := 0
+			for _, location := range chunk.Locations {
+				if live(location) {
+					copies++
+				}
+			}
+			if copies >= wanted {
+				surplus = true
+				return false
+			}
+			fmt.Println("Adopting replica of chunk", chunk.ID, "of", file.Filename, "on", addr)
+			chunk.Locations = append(chunk.Locations, addr)
+			return true
+		})
+		if surplus {
+			// Copied elsewhere while the node was away
+			fmt.Println("Deleting surplus replica of chunk", block.Filename, "on", addr)
+			unwanted = append(unwanted, block)
+			continue
+		}
+		if !exists && !ms.leased(block.Filename) {
+			if ms.journal == nil {
+				fmt.Println("Untracked chunk", block.Filename, "on", addr)
+			} else {
+				fmt.Println("Deleting orphaned chunk", block.Filename, "on", addr)
+				unwanted = append(unwanted, block)
+			}
+		}
+	}
+
+	dropped := false
+	for _, file := range ms.FileTable.ListFiles() {
+		lost := false
+		ms.FileTable.UpdateFile(file.Filename, func(file *protocol.Fileinfo) bool {
+			changed := false
+			for i := range file.Chunks {
+				chunk := &file.Chunks[i]
+				for _, block := range protocol.Blocks(file.Chunks[i : i+1]) {
+					if !slices.Contains(block.Locations, addr) || held[block.ID] {
+						continue
+					}
+					fmt.Println("Chunk", block.ID, "of", file.Filename, "is missing from", addr, ", dropping that replica")
+					block.Locations = slices.DeleteFunc(block.Locations, func(location string) bool {
+						return location == addr
+					})
+					changed = true
+				}
+				lost = lost || !chunk.Readable()
+			}
+			dropped = dropped || changed
+			return changed
+		})
+		if lost {
+			fmt.Println("File", file.Filename, "lost every replica of a chunk, or too many shards, dropping it")
+			if _, err := ms.FileTable.RemoveFile(file.Filename); err != nil {
+				fmt.Println("Drop of", file.Filename, "Failed:", err)
+			}
+		}
+	}
+	if dropped {
+		ms.triggerHeal()
+	}
+	if len(unwanted) > 0 {
+		// The node may only accept requests once its registration is answered
+		go ms.deleteBlocks(addr, unwanted)
+	}
+}
+
+// deleteBlocks deletes chunk copies from a storage server and returns their space
+func (ms *MainServer) deleteBlocks(addr string, blocks []protocol.Blockinfo) {
+	for _, block := range blocks {
+		if ms.DeleteRequest(addr, block.Filename) {
+			ms.Storage.ChangeMem(addr, +block.Size)
+		}
+	}
+}
+
+// recover replays the journal in metaDir and starts persisting new mutations
+func (ms *MainServer) recover(metaDir string) error {
+	journal, err := OpenJournal(metaDir)
+	if err != nil {
+		return err
+	}
+	if err := journal.Replay(ms.restore, ms.apply); err != nil {
+		journal.Close()
+		return err
+	}
+	fmt.Println("Recovered", len(ms.FileTable.files), "files and", len(ms.Storage.nodes), "storage servers")
+	ms.suspectAll()
+
+	ms.journal = journal
+	ms.FileTable.recorder = journal
+	ms.Storage.recorder = journal
+	go ms.compactLoop()
+	return nil
+}
+
+// recoverRaft loads the snapshot in metaDir and joins the other main servers.
+// The journal's entries are only applied once Raft finds them committed.
+func (ms *MainServer) recoverRaft(metaDir string, addr string, peers []string) error {
+	journal, err := OpenJournal(metaDir)
+	if err != nil {
+		return err
+	}
+	var last Snapshot
+	var entries []LogEntry
+	restore := func(snap Snapshot) {
+		last = snap
+		ms.restore(snap)
+	}
+	keep := func(entry LogEntry) {
+		entries = append(entries, entry)
+	}
+	if err := journal.Replay(restore, keep); err != nil {
+		journal.Close()
+		return err
+	}
+
+	raft, err := NewRaft(RaftConfig{
+		ID:        addr,
+		Peers:     slices.DeleteFunc(slices.Clone(peers), func(peer string) bool { return peer == addr }),
+		Dir:       metaDir,
+		Journal:   journal,
+		LastIndex: last.LastSeq,
+		LastTerm:  last.LastTerm,
+		Entries:   entries,
+		Apply:     ms.applyCommitted,
+		Install:   ms.install,
+		OnLeader:  ms.onLeader,
+	})
+	if err != nil {
+		journal.Close()
+		return err
+	}
+	fmt.Println("Recovered", len(ms.FileTable.files), "files and", len(ms.Storage.nodes), "storage servers from the snapshot")
+
+	ms.journal = journal
+	ms.raft = raft
+	ms.FileTable.recorder = raft
+	ms.Storage.recorder = raft
+	raft.Start()
+	go ms.compactLoop()
+	return nil
+}
+
+// restore loads a snapshot into empty tables
+func (ms *MainServer) restore(snap Snapshot) {
+	for _, dir := range snap.Dirs {
+		ms.FileTable.apply(LogEntry{Op: OpMkdir, Filename: dir})
+	}
+	for name, file := range snap.Files {
+		ms.FileTable.apply(LogEntry{Op: OpAddFile, Filename: name, File: file})
+	}
+	for addr, node := range snap.Nodes {
+		ms.Storage.nodes[addr] = node
+	}
+}
+
+// apply performs a mutation on whichever table it belongs to
+func (ms *MainServer) apply(entry LogEntry) {
+	ms.applyCommitted(entry, func() {})
+}
+
+// applyCommitted applies an entry under its table's lock, and calls applied
+// before releasing it so a snapshot never counts an entry it does not hold
+func (ms *MainServer) applyCommitted(entry LogEntry, applied func()) {
+	switch entry.Op {
+	case OpAddFile, OpRemoveFile, OpMkdir, OpRmdir, OpRename:
+		ms.FileTable.lock.Lock()
+		defer ms.FileTable.lock.Unlock()
+		ms.FileTable.apply(entry)
+	case OpAddNode, OpRemoveNode, OpChangeMem:
+		ms.Storage.lock.Lock()
+		defer ms.Storage.lock.Unlock()
+		ms.Storage.apply(entry)
+	}
+	applied()
+}
+
+// install replaces both tables with a snapshot sent by the leader
+func (ms *MainServer) install(snap Snapshot, applied func()) {
+	ms.FileTable.lock.Lock()
+	defer ms.FileTable.lock.Unlock()
+	ms.Storage.lock.Lock()
+	defer ms.Storage.lock.Unlock()
+	empty := NewFileTable()
+	ms.FileTable.files, ms.FileTable.dirs = empty.files, empty.dirs
+	ms.FileTable.children, ms.FileTable.chunks = empty.children, empty.chunks
+	ms.Storage.nodes = make(map[string]*protocol.Nodeinfo)
+	ms.restore(snap)
+	applied()
+}
+
+// suspectAll makes every recovered node prove it is still alive
+func (ms *MainServer) suspectAll() {
+	ms.Storage.lock.Lock()
+	defer ms.Storage.lock.Unlock()
+	for _, node := range ms.Storage.nodes {
+		node.Status = protocol.NodeSuspect
+		node.LastHeartbeat = time.Now()
+		node.Reserved = 0
+	}
+}
+
+// onLeader takes over from the previous leader. What only the previous
+// leader knew, which nodes are alive and which uploads are in progress, is
+// rebuilt from the storage servers.
+func (ms *MainServer) onLeader() {
+	ms.suspectAll()
+	ms.leases.lock.Lock()
+	clear(ms.leases.leases)
+	ms.leases.lock.Unlock()
+	for _, addr := range ms.storageAddrs {
+		ms.probeStorage(addr)
+	}
+}
+
+// leading reports whether this server acts on requests, which it always
+// does unless it replicates and is not the leader
+func (ms *MainServer) leading() bool {
+	if ms.raft == nil {
+		return true
+	}
+	_, leading := ms.raft.Leader()
+	return leading
+}
+
+// compactLoop snapshots the tables periodically, or sooner if the journal grows large
+func (ms *MainServer) compactLoop() {
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ms.journal.compact:
+		}
+		if err := ms.compact(); err != nil {
+			fmt.Println("Journal Compaction Error:", err)
+		}
+	}
+}
+
+func (ms *MainServer) compact() error {
+	// Hold both tables so the snapshot matches the journal position
+	ms.FileTable.lock.RLock()
+	defer ms.FileTable.lock.RUnlock()
+	ms.Storage.lock.RLock()
+	defer ms.Storage.lock.RUnlock()
+	snapshot := func(index, term uint64) Snapshot {
+		dirs := make([]string, 0, len(ms.FileTable.dirs))
+		for dir := range ms.FileTable.dirs {
+			if dir != "/" {
+				dirs = append(dirs, dir)
+			}
+		}
+		// Parents sort before their children
+		slices.Sort(dirs)
+		return Snapshot{LastSeq: index, LastTerm: term, Files: ms.FileTable.files, Dirs: dirs, Nodes: ms.Storage.nodes}
+	}
+	if ms.raft != nil {
+		return ms.raft.Compact(snapshot)
+	}
+	return ms.journal.Compact(snapshot(ms.journal.Applied(), 0))
 }
 
 func (ms *MainServer) Start() {
@@ -37,80 +557,206 @@ func (ms *MainServer) Start() {
 			fmt.Println("Main Server Accept Error:", err)
 			continue
 		}
-		ms.handleConnection(conn)
+		go ms.handleConnection(conn)
 	}
 }
 
-func (ms *MainServer) FindStorage(reqMem int64) (StorageAddr string) {
+// FindStorage returns count distinct storage servers outside exclude that can
+// each hold reqMem bytes of the chunk or shard with ID key, as picked by the
+// placement policy. It returns nil if there are not enough such servers.
+func (ms *MainServer) FindStorage(key string, reqMem int64, count int, exclude []string) []string {
 	ms.Storage.lock.RLock()
 	defer ms.Storage.lock.RUnlock()
 
-	// Find the largest storage
-	maxMem := int64(0)
-	var maxAddr string
-	for addr, mem := range ms.Storage.nodes {
-		if maxMem < mem {
-			maxMem = mem
-			maxAddr = addr
+	// Collect every live storage that can store the file
+	var candidates []Candidate
+	for addr, node := range ms.Storage.nodes {
+		if node.Status != protocol.NodeAlive || node.Draining || slices.Contains(exclude, addr) {
+			continue
+		}
+		if node.Availmem-node.Reserved >= reqMem {
+			candidates = append(candidates, Candidate{
+				Addr:     addr,
+				Free:     node.Availmem - node.Reserved,
+				Capacity: node.Capacity,
+				Load:     node.Load,
+				Reserved: node.Reserved,
+			})
 		}
 	}
-	// Check if it can store the file
-	if reqMem > maxMem {
-		return ""
-	} else {
-		return maxAddr
+	if len(candidates) < count {
+		return nil
 	}
+	slices.SortFunc(candidates, func(a, b Candidate) int {
+		return cmp.Compare(a.Addr, b.Addr)
+	})
+	return ms.placement.Place(key, candidates, count)
 }
 
-func (ms *MainServer) DeleteRequest(address string, filename string) (success bool) {
-	// Establish Connection with storage server
-	conn, err := net.Dial("tcp", address)
-	if err != nil {
+// reserveStorage picks storage like FindStorage and reserves reqMem bytes on
+// each server it returns, so concurrent allocations never count the same
+// free space twice
+func (ms *MainServer) reserveStorage(key string, reqMem int64, count int, exclude []string) []string {
+	ms.allocLock.Lock()
+	defer ms.allocLock.Unlock()
+	addrs := ms.FindStorage(key, reqMem, count, exclude)
+	for _, addr := range addrs {
+		ms.Storage.Reserve(addr, reqMem)
+	}
+	return addrs
+}
+
+// reserveOn reserves reqMem bytes on a particular storage server if it is
+// alive, not draining and has room for them
+func (ms *MainServer) reserveOn(addr string, reqMem int64) bool {
+	ms.allocLock.Lock()
+	defer ms.allocLock.Unlock()
+	node, exists := ms.Storage.GetNode(addr)
+	if !exists || node.Status != protocol.NodeAlive || node.Draining || node.Availmem-node.Reserved < reqMem {
 		return false
 	}
-	defer conn.Close()
+	ms.Storage.Reserve(addr, reqMem)
+	return true
+}
 
-	// Setup Encoder Decoder
-	encoder := json.NewEncoder(conn)
-	decoder := json.NewDecoder(conn)
+// settleReplica turns the reservation for a replica that was stored into used memory
+func (ms *MainServer) settleReplica(addr string, size int64) {
+	ms.Storage.Reserve(addr, -size)
+	ms.Storage.ChangeMem(addr, -size)
+}
 
-	// Build Request
-	req := protocol.Delete_Request{Filename: filename}
-	payload, err := json.Marshal(req)
-	if err != nil {
-		return false
+// allocateChunks splits a file of the given size into chunks and places each
+// on ms.replication storage servers, or with a scheme the shards of each on
+// as many distinct servers, reserving their memory as it goes.
+// It returns nil, cancelling any reservation, if some chunk does not fit.
+func (ms *MainServer) allocateChunks(size int64, scheme *protocol.Erasure) []protocol.Chunkinfo {
+	var chunks []protocol.Chunkinfo
+	for offset := int64(0); offset < size || len(chunks) == 0; offset += ms.chunkSize {
+		chunk := protocol.Chunkinfo{
+			ID:   newChunkID(),
+			Size: min(ms.chunkSize, size-offset),
+		}
+		if scheme == nil {
+			chunk.Locations = ms.reserveStorage(chunk.ID, chunk.Size, ms.replication, nil)
+		} else {
+			chunk.Shards, chunk.DataShards = ms.allocateShards(chunk.ID, chunk.Size, *scheme), scheme.Data
+		}
+		if chunk.Locations == nil && chunk.Shards == nil {
+			ms.cancelChunks(chunks)
+			return nil
+		}
+		chunks = append(chunks, chunk)
 	}
+	return chunks
+}
 
-	// Send Request
-	if err := encoder.Encode(protocol.Message{Type: protocol.DeleteReqM, Payload: payload}); err != nil {
-		return false
+// allocateShards places every shard of the chunk with ID id and the given
+// size on a storage server of its own, or returns nil if there are not enough of them
+func (ms *MainServer) allocateShards(id string, size int64, scheme protocol.Erasure) []protocol.Chunkinfo {
+	shardSize := erasure.ShardSize(size, scheme.Data)
+	addrs := ms.reserveStorage(id, shardSize, scheme.Data+scheme.Parity, nil)
+	if addrs == nil {
+		return nil
 	}
+	shards := make([]protocol.Chunkinfo, len(addrs))
+	for i, addr := range addrs {
+		shards[i] = protocol.Chunkinfo{ID: newChunkID(), Size: shardSize, Locations: []string{addr}}
+	}
+	return shards
+}
 
-	// Wait For Response
-	var resp protocol.Message
-	if err := decoder.Decode(&resp); err != nil {
-		return false
+// cancelChunks gives back the memory reserved for every replica or shard of the chunks
+func (ms *MainServer) cancelChunks(chunks []protocol.Chunkinfo) {
+	for _, block := range protocol.Blocks(chunks) {
+		for _, addr := range block.Locations {
+			ms.Storage.Reserve(addr, -block.Size)
+		}
 	}
+}
 
-	// Unmarshal Response
-	var deleteResp protocol.Delete_Response
-	if err := json.Unmarshal(resp.Payload, &deleteResp); err != nil {
-		return false
+// releaseChunks gives back the memory used by every replica or shard of the chunks
+func (ms *MainServer) releaseChunks(chunks []protocol.Chunkinfo) {
+	for _, block := range protocol.Blocks(chunks) {
+		for _, addr := range block.Locations {
+			ms.Storage.ChangeMem(addr, +block.Size)
+		}
+	}
+}
+
+func newChunkID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// deleteChunks releases and deletes every chunk replica or shard of a file
+// that was removed from the file table. It returns false if some node failed
+// to delete.
+func (ms *MainServer) deleteChunks(file protocol.Fileinfo) bool {
+	ms.releaseChunks(file.Chunks)
+
+	// Notify every StorageList Server holding a chunk replica or shard
+	success := true
+	for _, block := range protocol.Blocks(file.Chunks) {
+		for _, addr := range block.Locations {
+			if !ms.DeleteRequest(addr, block.ID) {
+				fmt.Println("Deletion of chunk", block.ID, "Failed on", addr)
+				success = false
+			}
+		}
 	}
+	return success
+}
 
-	return deleteResp.Success
+// DeleteRequest deletes a chunk replica from a storage server, retrying
+// with a growing pause if the connection fails
+func (ms *MainServer) DeleteRequest(address string, filename string) (success bool) {
+	for attempt := 1; ; attempt++ {
+		success, err := ms.deleteFrom(address, filename)
+		if err == nil {
+			return success
+		}
+		var resp *protocol.Error_Response
+		if errors.As(err, &resp) || attempt == deleteAttempts {
+			fmt.Println("Delete of", filename, "on", address, "Failed:", err)
+			return false
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+func (ms *MainServer) deleteFrom(address string, filename string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ms.nodeTimeout)
+	defer cancel()
+	var resp protocol.Delete_Response
+	err := ms.nodes.Call(ctx, address, protocol.DeleteReqM, protocol.Delete_Request{Filename: filename}, protocol.DeleteAckN, &resp)
+	// A chunk that is already gone needs no deleting
+	if protocol.CodeOf(err) == protocol.ErrNotFound {
+		return true, nil
+	}
+	return resp.Success, err
 }
 
 func (ms *MainServer) handleConnection(conn net.Conn) {
 	defer conn.Close()
-	encoder := json.NewEncoder(conn)
-	decoder := json.NewDecoder(conn)
-
-	var msg protocol.Message
-	err := decoder.Decode(&msg)
-	if err != nil {
+	if err := protocol.Serve(conn, ms.handleRequest); err != nil {
 		fmt.Println("Main Server Decode Error:", err)
-		return
+	}
+}
+
+// handleRequest answers one request, every one of them may be multiplexed
+func (ms *MainServer) handleRequest(msg protocol.Message, encoder protocol.Encoder, conn net.Conn) {
+	if ms.raft != nil {
+		switch msg.Type {
+		case protocol.VoteReq, protocol.AppendEntriesReq, protocol.InstallSnapshotReq:
+			ms.handleRaft(msg, encoder)
+			return
+		}
+		// Only the leader acts, the others point to it
+		if leader, leading := ms.raft.Leader(); !leading {
+			sendError(encoder, protocol.NotLeader(leader))
+			return
+		}
 	}
 
 	switch msg.Type {
@@ -120,29 +766,78 @@ func (ms *MainServer) handleConnection(conn net.Conn) {
 			fmt.Println("Main Server Decode Error:", err)
 			return
 		}
+		request.Filename = NormalizePath(request.Filename)
 		fmt.Println("Received Upload Request of file", request.Filename, "with size", request.Size)
+		unlock := ms.paths.Lock(request.Filename)
+		defer unlock()
 
 		// Check Duplication
-		file, exists := ms.Storage.nodes[request.Filename]
+		if err := ms.FileTable.CheckCreate(request.Filename); err != nil {
+			sendError(encoder, err)
+			return
+		}
+		if ms.uploading(request.Filename) {
+			sendError(encoder, protocol.Errorf(protocol.ErrExists, "%s is already being uploaded", request.Filename))
+			return
+		}
 
-		// Allocate StorageList
-		storageaddr := ms.FindStorage(request.Size)
+		if request.Erasure != nil {
+			if request.Stream {
+				sendError(encoder, protocol.Errorf(protocol.ErrInvalid, "streamed uploads cannot be erasure-coded"))
+				return
+			}
+			if _, err := erasure.New(request.Erasure.Data, request.Erasure.Parity); err != nil {
+				sendError(encoder, protocol.Errorf(protocol.ErrInvalid, "erasure scheme %s: %v", request.Erasure, err))
+				return
+			}
+		}
 
-		if exists {
-			fmt.Println("Main Server File Exists: ", file)
-			storageaddr = ""
-		} else {
-			fmt.Println("Storage Address:", storageaddr)
-			ms.FileTable.AddFile(request.Filename, protocol.Fileinfo{
-				Filename: request.Filename,
-				Size:     request.Size,
-				Location: storageaddr,
-			})
-			ms.Storage.ChangeMem(storageaddr, -request.Size)
+		// Create any missing parents now, the file is only added to them once committed
+		if err := ms.FileTable.Mkdir(path.Dir(request.Filename), true); err != nil {
+			sendError(encoder, err)
+			return
+		}
+
+		// A streamed upload allocates its chunks as it goes
+		if request.Stream {
+			lease, err := ms.openLease(protocol.Fileinfo{Filename: request.Filename}, true)
+			if err != nil {
+				sendError(encoder, err)
+				return
+			}
+			payload, err := json.Marshal(protocol.Upload_Response{Lease: lease, ChunkSize: ms.chunkSize})
+			if err != nil {
+				fmt.Println("Main Server Marshal Error:", err)
+				return
+			}
+			err = encoder.Encode(protocol.Message{Type: protocol.UploadResp, Payload: payload})
+			if err != nil {
+				fmt.Println("Main Server Encode Error:", err)
+				return
+			}
+			return
+		}
+
+		// Allocate StorageList, the file is listed once every chunk is stored
+		chunks := ms.allocateChunks(request.Size, request.Erasure)
+		fmt.Println("Allocated", len(chunks), "chunks")
+		if chunks == nil {
+			sendError(encoder, protocol.Errorf(protocol.ErrNoSpace, "no storage available for %d bytes", request.Size))
+			return
+		}
+		lease, err := ms.openLease(protocol.Fileinfo{
+			Filename: request.Filename,
+			Size:     request.Size,
+			Checksum: request.Checksum,
+			Chunks:   chunks,
+		}, false)
+		if err != nil {
+			sendError(encoder, err)
+			return
 		}
 
 		// Build Response
-		resp := protocol.Upload_Response{StorageAddr: storageaddr}
+		resp := protocol.Upload_Response{Lease: lease, Chunks: chunks}
 		payload, err := json.Marshal(resp)
 		if err != nil {
 			fmt.Println("Main Server Marshal Error:", err)
@@ -156,26 +851,102 @@ func (ms *MainServer) handleConnection(conn net.Conn) {
 			return
 		}
 
+	case protocol.UploadConfirmReq:
+		var request protocol.Upload_Confirm
+		if err := json.Unmarshal(msg.Payload, &request); err != nil {
+			fmt.Println("Main Server Decode Error:", err)
+			return
+		}
+
+		if err := ms.confirmReplica(request); err != nil {
+			fmt.Println("Confirmation of chunk", request.Filename, "on", request.Addr, "Failed:", err)
+			sendError(encoder, err)
+			return
+		}
+
+		// Build Response
+		payload, err := json.Marshal(protocol.Commit_Response{Success: true})
+		if err != nil {
+			fmt.Println("Main Server Marshal Error:", err)
+			return
+		}
+		err = encoder.Encode(protocol.Message{Type: protocol.UploadConfirmAck, Payload: payload})
+		if err != nil {
+			fmt.Println("Main Server Encode Error:", err)
+			return
+		}
+
+	case protocol.UploadCommitReq:
+		var request protocol.Upload_Commit
+		if err := json.Unmarshal(msg.Payload, &request); err != nil {
+			fmt.Println("Main Server Decode Error:", err)
+			return
+		}
+		fmt.Println("Received Upload Commit of lease", request.Lease, "Abort:", request.Abort)
+
+		if err := ms.commitLease(request); err != nil {
+			fmt.Println("Commit of lease", request.Lease, "Failed:", err)
+			sendError(encoder, err)
+			return
+		}
+
+		// Build Response
+		payload, err := json.Marshal(protocol.Commit_Response{Success: true})
+		if err != nil {
+			fmt.Println("Main Server Marshal Error:", err)
+			return
+		}
+		err = encoder.Encode(protocol.Message{Type: protocol.UploadCommitResp, Payload: payload})
+		if err != nil {
+			fmt.Println("Main Server Encode Error:", err)
+			return
+		}
+
+	case protocol.AllocateReq:
+		var request protocol.Allocate_Request
+		if err := json.Unmarshal(msg.Payload, &request); err != nil {
+			fmt.Println("Main Server Decode Error:", err)
+			return
+		}
+
+		chunk, err := ms.allocateChunk(request.Lease, request.Size)
+		if err != nil {
+			fmt.Println("Allocation under lease", request.Lease, "Failed:", err)
+			sendError(encoder, err)
+			return
+		}
+
+		// Build Response
+		payload, err := json.Marshal(protocol.Allocate_Response{Chunk: chunk})
+		if err != nil {
+			fmt.Println("Main Server Marshal Error:", err)
+			return
+		}
+		err = encoder.Encode(protocol.Message{Type: protocol.AllocateResp, Payload: payload})
+		if err != nil {
+			fmt.Println("Main Server Encode Error:", err)
+			return
+		}
+
 	case protocol.DownloadReq:
 		var request protocol.Download_Request
 		if err := json.Unmarshal(msg.Payload, &request); err != nil {
 			fmt.Println("Main Server Decode Error:", err)
 			return
 		}
+		request.Filename = NormalizePath(request.Filename)
 
 		// Look for file
 		file, exists := ms.FileTable.GetFile(request.Filename)
 		fmt.Println("Received Download Request of file", request.Filename, "Found?", exists)
-		var addr string
 		if !exists {
-			addr = ""
-		} else {
-			addr = file.Location
-			fmt.Println("Storage Address:", addr)
+			sendError(encoder, protocol.Errorf(protocol.ErrNotFound, "%s does not exist", request.Filename))
+			return
 		}
+		fmt.Println("Chunks:", len(file.Chunks))
 
 		// Build Response
-		resp := protocol.Download_Response{StorageAddr: addr}
+		resp := protocol.Download_Response{Chunks: file.Chunks, Checksum: file.Checksum}
 		payload, err := json.Marshal(resp)
 		if err != nil {
 			fmt.Println("Main Server Marshal Error:", err)
@@ -195,71 +966,369 @@ func (ms *MainServer) handleConnection(conn net.Conn) {
 			fmt.Println("Main Server Decode Error:", err)
 			return
 		}
+		request.Filename = NormalizePath(request.Filename)
+		unlock := ms.paths.Lock(request.Filename)
+		defer unlock()
 
-		// Look for file
-		file, exists := ms.FileTable.GetFile(request.Filename)
-		mem := file.Size
-		fmt.Println("Received Delete Request of file", request.Filename, "Found?", exists)
-		var addr string
-		if !exists {
-			// Build Response
-			resp := protocol.Delete_Response{Success: false}
-			payload, err := json.Marshal(resp)
-			if err != nil {
-				fmt.Println("Main Server Marshal Error:", err)
-				return
-			}
+		// Remove File From Table
+		file, err := ms.FileTable.RemoveFile(request.Filename)
+		fmt.Println("Received Delete Request of file", request.Filename, "Found?", err == nil)
+		if err != nil {
+			sendError(encoder, err)
+			return
+		}
+		fmt.Println("Chunks:", len(file.Chunks))
 
-			// Encode Response
-			err = encoder.Encode(protocol.Message{Type: protocol.DeleteAckM, Payload: payload})
-			if err != nil {
-				fmt.Println("Main Server Encode Error:", err)
-				return
-			}
-		} else {
-			addr = file.Location
-			fmt.Println("Location:", addr)
+		// The file is gone either way, Success is false if some replica remains on a node
+		success := ms.deleteChunks(file)
 
-			// Remove File From Table
-			ms.FileTable.RemoveFile(request.Filename)
+		// Build Response
+		resp := protocol.Delete_Response{Success: success}
+		payload, err := json.Marshal(resp)
+		if err != nil {
+			fmt.Println("Main Server Marshal Error:", err)
+			return
+		}
 
-			ms.Storage.ChangeMem(addr, +mem)
+		// Encode Response
+		err = encoder.Encode(protocol.Message{Type: protocol.DeleteAckM, Payload: payload})
+		if err != nil {
+			fmt.Println("Main Server Encode Error:", err)
+			return
+		}
 
-			// Notify StorageList Server
-			success := ms.DeleteRequest(addr, request.Filename)
+		fmt.Println("Deletion Successful")
 
-			// Build Response
-			resp := protocol.Delete_Response{Success: success}
-			payload, err := json.Marshal(resp)
-			if err != nil {
-				fmt.Println("Main Server Marshal Error:", err)
-				return
+	case protocol.LookupReq:
+		files := make(map[string]protocol.Fileinfo)
+		for _, file := range ms.FileTable.ListFiles() {
+			files[file.Filename] = file
+		}
+		resp := protocol.Lookup_Response{Files: files, Nodes: ms.Storage.ListNodes()}
+		if ms.raft != nil {
+			resp.Leader, _ = ms.raft.Leader()
+			resp.Term = ms.raft.Term()
+		}
+		fmt.Println("Lookup Request Received")
+		payload, err := json.Marshal(resp)
+		if err != nil {
+			fmt.Println("Main Server Marshal Error:", err)
+			return
+		}
+		err = encoder.Encode(protocol.Message{Type: protocol.LookupResp, Payload: payload})
+		if err != nil {
+			fmt.Println("Main Server Encode Error:", err)
+			return
+		}
+
+	case protocol.MkdirReq:
+		var request protocol.Mkdir_Request
+		if err := json.Unmarshal(msg.Payload, &request); err != nil {
+			fmt.Println("Main Server Decode Error:", err)
+			return
+		}
+		request.Path = NormalizePath(request.Path)
+		fmt.Println("Received Mkdir Request of", request.Path)
+		unlock := ms.paths.Lock(request.Path)
+		defer unlock()
+
+		if err := ms.FileTable.Mkdir(request.Path, request.Parents); err != nil {
+			sendError(encoder, err)
+			return
+		}
+
+		// Build Response
+		payload, err := json.Marshal(protocol.Dir_Response{Success: true})
+		if err != nil {
+			fmt.Println("Main Server Marshal Error:", err)
+			return
+		}
+		err = encoder.Encode(protocol.Message{Type: protocol.MkdirResp, Payload: payload})
+		if err != nil {
+			fmt.Println("Main Server Encode Error:", err)
+			return
+		}
+
+	case protocol.RmdirReq:
+		var request protocol.Rmdir_Request
+		if err := json.Unmarshal(msg.Payload, &request); err != nil {
+			fmt.Println("Main Server Decode Error:", err)
+			return
+		}
+		request.Path = NormalizePath(request.Path)
+		fmt.Println("Received Rmdir Request of", request.Path, "Recursive?", request.Recursive)
+		unlock := ms.paths.Lock(request.Path)
+		defer unlock()
+
+		// Remove the directory, then the chunks of every file that was in it
+		removed, err := ms.FileTable.Rmdir(request.Path, request.Recursive)
+		resp := protocol.Dir_Response{Success: true}
+		for _, file := range removed {
+			if !ms.deleteChunks(file) {
+				resp.Message = "some chunks could not be deleted from storage servers"
 			}
+		}
+		if err != nil {
+			sendError(encoder, err)
+			return
+		}
 
-			// Encode Response
-			err = encoder.Encode(protocol.Message{Type: protocol.DeleteAckM, Payload: payload})
-			if err != nil {
-				fmt.Println("Main Server Encode Error:", err)
-				return
+		// Build Response
+		payload, err := json.Marshal(resp)
+		if err != nil {
+			fmt.Println("Main Server Marshal Error:", err)
+			return
+		}
+		err = encoder.Encode(protocol.Message{Type: protocol.RmdirResp, Payload: payload})
+		if err != nil {
+			fmt.Println("Main Server Encode Error:", err)
+			return
+		}
+
+	case protocol.ListReq:
+		var request protocol.List_Request
+		if err := json.Unmarshal(msg.Payload, &request); err != nil {
+			fmt.Println("Main Server Decode Error:", err)
+			return
+		}
+		request.Path = NormalizePath(request.Path)
+		fmt.Println("Received List Request of", request.Path, "Recursive?", request.Recursive)
+
+		entries, err := ms.FileTable.List(request.Path, request.Recursive)
+		if err != nil {
+			sendError(encoder, err)
+			return
+		}
+
+		// Build Response
+		payload, err := json.Marshal(protocol.List_Response{Entries: entries})
+		if err != nil {
+			fmt.Println("Main Server Marshal Error:", err)
+			return
+		}
+		err = encoder.Encode(protocol.Message{Type: protocol.ListResp, Payload: payload})
+		if err != nil {
+			fmt.Println("Main Server Encode Error:", err)
+			return
+		}
+
+	case protocol.RenameReq:
+		var request protocol.Rename_Request
+		if err := json.Unmarshal(msg.Payload, &request); err != nil {
+			fmt.Println("Main Server Decode Error:", err)
+			return
+		}
+		request.Source = NormalizePath(request.Source)
+		request.Destination = NormalizePath(request.Destination)
+		fmt.Println("Received Rename Request of", request.Source, "to", request.Destination, "Overwrite?", request.Overwrite)
+		unlock := ms.paths.Lock(request.Source, request.Destination)
+		defer unlock()
+
+		// Rename, then delete the chunks of the file it replaced
+		replaced, err := ms.FileTable.Rename(request.Source, request.Destination, request.Overwrite)
+		if err != nil {
+			sendError(encoder, err)
+			return
+		}
+		resp := protocol.Rename_Response{Success: true}
+		for _, file := range replaced {
+			if !ms.deleteChunks(file) {
+				resp.Message = "some chunks of the replaced file could not be deleted from storage servers"
 			}
+		}
+
+		// Build Response
+		payload, err := json.Marshal(resp)
+		if err != nil {
+			fmt.Println("Main Server Marshal Error:", err)
+			return
+		}
+		err = encoder.Encode(protocol.Message{Type: protocol.RenameResp, Payload: payload})
+		if err != nil {
+			fmt.Println("Main Server Encode Error:", err)
+			return
+		}
 
-			ms.FileTable.RemoveFile(request.Filename)
+	case protocol.HeartbeatReq:
+		var request protocol.Heartbeat_Request
+		if err := json.Unmarshal(msg.Payload, &request); err != nil {
+			fmt.Println("Main Server Decode Error:", err)
+			return
+		}
 
-			fmt.Println("Deletion Successful")
+		if node, exists := ms.Storage.GetNode(request.Addr); exists {
+			ms.revive(request.Addr, node)
+		}
+		known := ms.Storage.Heartbeat(request.Addr, request)
+		if !known {
+			fmt.Println("Heartbeat from unknown storage server", request.Addr)
 		}
 
-	case protocol.LookupReq:
-		resp := protocol.Lookup_Response{Files: ms.FileTable.files}
-		fmt.Println("Lookup Request Received")
+		payload, err := json.Marshal(protocol.Heartbeat_Response{Known: known})
+		if err != nil {
+			fmt.Println("Main Server Marshal Error:", err)
+			return
+		}
+		err = encoder.Encode(protocol.Message{Type: protocol.HeartbeatAck, Payload: payload})
+		if err != nil {
+			fmt.Println("Main Server Encode Error:", err)
+			return
+		}
+
+	case protocol.RegisterReq:
+		var request protocol.Register_Request
+		if err := json.Unmarshal(msg.Payload, &request); err != nil {
+			fmt.Println("Main Server Decode Error:", err)
+			return
+		}
+		fmt.Println("Received Register Request from storage server", request.Addr)
+
+		// A decommissioned node may only come back by restarting
+		if request.Rejoin && ms.Storage.Retired(request.Addr) {
+			fmt.Println("Refusing rejoin of decommissioned storage server", request.Addr)
+			sendError(encoder, protocol.Errorf(protocol.ErrPermissionDenied, "%s was decommissioned", request.Addr))
+			return
+		}
+		if err := ms.register(request.Addr, request.Report); err != nil {
+			fmt.Println("Register of", request.Addr, "Failed:", err)
+			sendError(encoder, err)
+			return
+		}
+
+		payload, err := json.Marshal(protocol.Register_Response{Success: true})
+		if err != nil {
+			fmt.Println("Main Server Marshal Error:", err)
+			return
+		}
+		err = encoder.Encode(protocol.Message{Type: protocol.RegisterAck, Payload: payload})
+		if err != nil {
+			fmt.Println("Main Server Encode Error:", err)
+			return
+		}
+
+	case protocol.DecommissionReq, protocol.DeregisterReq:
+		var request protocol.Decommission_Request
+		if err := json.Unmarshal(msg.Payload, &request); err != nil {
+			fmt.Println("Main Server Decode Error:", err)
+			return
+		}
+		fmt.Println("Received Decommission Request for storage server", request.Addr)
+
+		moved, err := ms.Decommission(request.Addr)
+		if err != nil {
+			fmt.Println("Decommission of", request.Addr, "Failed:", err)
+			sendError(encoder, err)
+			return
+		}
+
+		// Build Response
+		payload, err := json.Marshal(protocol.Decommission_Response{Success: true, Moved: moved})
+		if err != nil {
+			fmt.Println("Main Server Marshal Error:", err)
+			return
+		}
+
+		respType := protocol.DecommissionResp
+		if msg.Type == protocol.DeregisterReq {
+			respType = protocol.DeregisterAck
+		}
+		err = encoder.Encode(protocol.Message{Type: respType, Payload: payload})
+		if err != nil {
+			fmt.Println("Main Server Encode Error:", err)
+			return
+		}
+
+	case protocol.BalanceReq:
+		var request protocol.Balance_Request
+		if err := json.Unmarshal(msg.Payload, &request); err != nil {
+			fmt.Println("Main Server Decode Error:", err)
+			return
+		}
+		fmt.Println("Received Balance Request, threshold", request.Threshold, "dry run", request.DryRun, "stop", request.Stop)
+
+		resp, err := ms.Balance(request)
+		if err != nil {
+			fmt.Println("Balance Failed:", err)
+			sendError(encoder, err)
+			return
+		}
+
+		// Build Response
 		payload, err := json.Marshal(resp)
 		if err != nil {
 			fmt.Println("Main Server Marshal Error:", err)
 			return
 		}
-		err = encoder.Encode(protocol.Message{Type: protocol.LookupResp, Payload: payload})
+		err = encoder.Encode(protocol.Message{Type: protocol.BalanceResp, Payload: payload})
 		if err != nil {
 			fmt.Println("Main Server Encode Error:", err)
 			return
 		}
+
+	case protocol.CorruptReportReq:
+		var request protocol.CorruptReport_Request
+		if err := json.Unmarshal(msg.Payload, &request); err != nil {
+			fmt.Println("Main Server Decode Error:", err)
+			return
+		}
+		fmt.Println("Received Corruption Report of", len(request.Files), "chunks from", request.Addr)
+
+		ms.handleCorruption(request.Addr, request.Files)
+
+		err := encoder.Encode(protocol.Message{Type: protocol.CorruptReportAck})
+		if err != nil {
+			fmt.Println("Main Server Encode Error:", err)
+			return
+		}
+
+	default:
+		sendError(encoder, protocol.Errorf(protocol.ErrInvalid, "unknown message type %s", msg.Type))
+	}
+}
+
+// handleRaft answers a message from another main server
+func (ms *MainServer) handleRaft(msg protocol.Message, encoder protocol.Encoder) {
+	var resp any
+	var respType protocol.MessageType
+	switch msg.Type {
+	case protocol.VoteReq:
+		var request protocol.Vote_Request
+		if err := json.Unmarshal(msg.Payload, &request); err != nil {
+			fmt.Println("Main Server Decode Error:", err)
+			return
+		}
+		resp, respType = ms.raft.HandleVote(request), protocol.VoteResp
+	case protocol.AppendEntriesReq:
+		var request protocol.AppendEntries_Request
+		if err := json.Unmarshal(msg.Payload, &request); err != nil {
+			fmt.Println("Main Server Decode Error:", err)
+			return
+		}
+		resp, respType = ms.raft.HandleAppendEntries(request), protocol.AppendEntriesResp
+	case protocol.InstallSnapshotReq:
+		var request protocol.InstallSnapshot_Request
+		if err := json.Unmarshal(msg.Payload, &request); err != nil {
+			fmt.Println("Main Server Decode Error:", err)
+			return
+		}
+		resp, respType = ms.raft.HandleInstallSnapshot(request), protocol.InstallSnapshotAck
+	}
+
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		fmt.Println("Main Server Marshal Error:", err)
+		return
+	}
+	err = encoder.Encode(protocol.Message{Type: respType, Payload: payload})
+	if err != nil {
+		fmt.Println("Main Server Encode Error:", err)
+		return
+	}
+}
+
+// sendError answers a request with an Error message
+func sendError(encoder protocol.Encoder, err error) {
+	if err := encoder.Encode(protocol.ErrorMessage(err)); err != nil {
+		fmt.Println("Main Server Encode Error:", err)
 	}
 }
@@ -2,81 +2,247 @@ package mainserver
 
 import (
 	"DistributedFileSystem/protocol"
-	"encoding/json"
+	"context"
 	"fmt"
-	"net"
 	"sync"
+	"time"
 )
 
 type StorageList struct {
-	lock  sync.RWMutex
-	nodes map[string]int64 // Address -> Available Mem
+	lock     sync.RWMutex
+	nodes    map[string]*protocol.Nodeinfo // Address -> Available Mem and Liveness
+	retired  map[string]bool               // Decommissioned since startup
+	recorder Recorder                      // Nil keeps changes in memory only
 }
 
-func getAvailableMemory(address string) int64 {
-	conn, err := net.Dial("tcp", address)
-	if err != nil {
+// getAvailableMemory asks a storage server for its free space, -1 if it
+// does not answer within timeout
+func (ms *MainServer) getAvailableMemory(address string, timeout time.Duration) int64 {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var resp protocol.MemLookup_Response
+	if err := ms.nodes.Call(ctx, address, protocol.MemLookupReq, nil, protocol.MemLookupResp, &resp); err != nil {
 		return -1
 	}
-	defer conn.Close()
+	return resp.Availmem
+}
 
-	encoder := json.NewEncoder(conn)
-	decoder := json.NewDecoder(conn)
+// getBlockReport asks a storage server for every file it holds
+func (ms *MainServer) getBlockReport(address string) (protocol.BlockReport_Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ms.nodeTimeout)
+	defer cancel()
+	var report protocol.BlockReport_Response
+	err := ms.nodes.Call(ctx, address, protocol.BlockReportReq, nil, protocol.BlockReportResp, &report)
+	return report, err
+}
 
-	// Ask for memory on server
-	err = encoder.Encode(protocol.Message{
-		Type: protocol.MemLookupReq,
-	})
-	if err != nil {
-		return -1
+// replicateChunk asks source to upload its copy of a chunk to target, at no
+// more than rate bytes per second unless it is 0. It gives up once the copy
+// takes longer than the node timeout plus sending the chunk at that rate.
+func (ms *MainServer) replicateChunk(source, target string, chunk protocol.Chunkinfo, rate int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), protocol.TransferTimeout(ms.nodeTimeout, chunk.Size, rate))
+	defer cancel()
+	var resp protocol.Replicate_Response
+	req := protocol.Replicate_Request{Filename: chunk.ID, Target: target, Rate: rate}
+	if err := ms.nodes.Call(ctx, source, protocol.ReplicateReq, req, protocol.ReplicateAck, &resp); err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("%s could not copy chunk %s to %s", source, chunk.ID, target)
 	}
+	return nil
+}
 
-	// Get Response
-	var msg protocol.Message
-	err = decoder.Decode(&msg)
-	if err != nil {
-		return -1
+// rebuildOn asks target to reconstruct shard index of an erasure-coded chunk
+// from its other shards, read at no more than rate bytes per second unless it
+// is 0, and store it. It gives up once that takes longer than the node
+// timeout plus reading those shards at that rate.
+func (ms *MainServer) rebuildOn(target string, chunk protocol.Chunkinfo, index int, rate int64) error {
+	read := chunk.Shards[index].Size * int64(chunk.DataShards)
+	ctx, cancel := context.WithTimeout(context.Background(), protocol.TransferTimeout(ms.nodeTimeout, read, rate))
+	defer cancel()
+	var resp protocol.Rebuild_Response
+	req := protocol.Rebuild_Request{Chunk: chunk, Index: index, Rate: rate}
+	if err := ms.nodes.Call(ctx, target, protocol.RebuildReq, req, protocol.RebuildAck, &resp); err != nil {
+		return err
 	}
-	if msg.Type != protocol.MemLookupResp {
-		return -1
+	if !resp.Success {
+		return fmt.Errorf("%s could not rebuild shard %s", target, chunk.Shards[index].ID)
 	}
+	return nil
+}
 
-	var resp protocol.MemLookup_Response
-	err = json.Unmarshal(msg.Payload, &resp)
-	if err != nil {
-		return -1
+func NewStorage() *StorageList {
+	return &StorageList{
+		nodes:   make(map[string]*protocol.Nodeinfo),
+		retired: make(map[string]bool),
 	}
+}
 
-	return resp.Availmem
+func (ft *StorageList) GetNode(address string) (protocol.Nodeinfo, bool) {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
+	node, exists := ft.nodes[address]
+	if !exists {
+		return protocol.Nodeinfo{}, false
+	}
+	return *node, true
 }
 
-func NewStorage(storagelist []string) *StorageList {
-	nodes := make(map[string]int64)
-	for _, addr := range storagelist {
-		fmt.Println("Establishing connection with storage server at address:", addr)
-		nodes[addr] = getAvailableMemory(addr)
-		fmt.Println("Server", addr, "is available with memory:", nodes[addr])
+func (ft *StorageList) ListNodes() map[string]protocol.Nodeinfo {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
+	nodes := make(map[string]protocol.Nodeinfo, len(ft.nodes))
+	for addr, node := range ft.nodes {
+		nodes[addr] = *node
 	}
+	return nodes
+}
 
-	return &StorageList{
-		nodes: nodes,
+// Heartbeat records a heartbeat from a node and marks it alive.
+// Liveness is not journaled, it is rebuilt from heartbeats after a restart.
+// Availmem only changes through the journal, by the node registering and by
+// the chunks stored on it and deleted from it, so every main server counts
+// the same. The free space the node reports is kept apart as Reported.
+// It returns false if the node is not in the storage list.
+func (ft *StorageList) Heartbeat(address string, hb protocol.Heartbeat_Request) bool {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	node, exists := ft.nodes[address]
+	if !exists {
+		return false
 	}
+	node.Reported = hb.Availmem
+	node.Capacity = hb.Capacity
+	node.FileCount = hb.FileCount
+	node.Load = hb.Load
+	ft.touch(address, node)
+	return true
 }
 
-func (ft *StorageList) Add(address string, mem int64) {
+// Touch marks a node alive without changing its statistics
+func (ft *StorageList) Touch(address string) {
 	ft.lock.Lock()
-	ft.nodes[address] = mem
-	ft.lock.Unlock()
+	defer ft.lock.Unlock()
+	if node, exists := ft.nodes[address]; exists {
+		ft.touch(address, node)
+	}
 }
 
-func (ft *StorageList) Remove(address string) {
+func (ft *StorageList) touch(address string, node *protocol.Nodeinfo) {
+	if node.Status != protocol.NodeAlive {
+		fmt.Println("Storage server", address, "is", protocol.NodeAlive)
+	}
+	node.Status = protocol.NodeAlive
+	node.LastHeartbeat = time.Now()
+}
+
+// SetDraining marks a node as being decommissioned, returning false if it is unknown
+func (ft *StorageList) SetDraining(address string, draining bool) bool {
 	ft.lock.Lock()
-	delete(ft.nodes, address)
-	ft.lock.Unlock()
+	defer ft.lock.Unlock()
+	node, exists := ft.nodes[address]
+	if !exists {
+		return false
+	}
+	node.Draining = draining
+	return true
 }
 
-func (ft *StorageList) ChangeMem(address string, amt int64) {
+// SetStatus changes a node's liveness, returning false if it was already in that state
+func (ft *StorageList) SetStatus(address string, status protocol.NodeStatus) bool {
 	ft.lock.Lock()
-	ft.nodes[address] += amt
+	defer ft.lock.Unlock()
+	node, exists := ft.nodes[address]
+	if !exists || node.Status == status {
+		return false
+	}
+	fmt.Println("Storage server", address, "is", status, ", last heard from at", node.LastHeartbeat.Format(time.RFC3339))
+	node.Status = status
+	return true
+}
+
+func (ft *StorageList) Add(address string, mem int64) error {
+	return ft.record(LogEntry{Op: OpAddNode, Address: address, Amount: mem})
+}
+
+func (ft *StorageList) Remove(address string) error {
+	return ft.record(LogEntry{Op: OpRemoveNode, Address: address})
+}
+
+// Retire removes a decommissioned node and remembers it was removed
+func (ft *StorageList) Retire(address string) error {
+	if err := ft.Remove(address); err != nil {
+		return err
+	}
+	ft.lock.Lock()
+	ft.retired[address] = true
 	ft.lock.Unlock()
+	return nil
+}
+
+func (ft *StorageList) Retired(address string) bool {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
+	return ft.retired[address]
+}
+
+// Reserve sets aside amt bytes on a node for a transfer in progress, or gives
+// them back if amt is negative. Reservations are not journaled, as the
+// transfers they belong to do not survive a restart either.
+func (ft *StorageList) Reserve(address string, amt int64) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	if node, exists := ft.nodes[address]; exists {
+		node.Reserved += amt
+	}
+}
+
+func (ft *StorageList) ChangeMem(address string, amt int64) error {
+	return ft.record(LogEntry{Op: OpChangeMem, Address: address, Amount: amt})
+}
+
+// record makes a mutation durable and applies it, see FileTable.record.
+// Nothing is checked before recording, so unlike the file table there is no
+// need to run one change at a time.
+func (ft *StorageList) record(entry LogEntry) error {
+	if ft.recorder == nil {
+		ft.applyLocked(entry, func() {})
+		return nil
+	}
+	err := ft.recorder.Record(entry, ft.applyLocked)
+	if err != nil {
+		fmt.Println("Metadata Record Error:", err)
+	}
+	return err
+}
+
+// applyLocked applies an entry under the table lock, and calls applied
+// before releasing it
+func (ft *StorageList) applyLocked(entry LogEntry, applied func()) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	ft.apply(entry)
+	applied()
+}
+
+// apply performs a journaled mutation. Callers hold ft.lock.
+func (ft *StorageList) apply(entry LogEntry) {
+	switch entry.Op {
+	case OpAddNode:
+		delete(ft.retired, entry.Address)
+		node, exists := ft.nodes[entry.Address]
+		if !exists {
+			// Unproven until it heartbeats or answers a probe
+			node = &protocol.Nodeinfo{Status: protocol.NodeSuspect, LastHeartbeat: time.Now()}
+			ft.nodes[entry.Address] = node
+		}
+		node.Availmem = entry.Amount
+	case OpRemoveNode:
+		delete(ft.nodes, entry.Address)
+	case OpChangeMem:
+		if node, exists := ft.nodes[entry.Address]; exists {
+			node.Availmem += entry.Amount
+		}
+	}
 }
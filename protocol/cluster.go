@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Cluster calls the leader among a group of main servers that replicate each
+// other. It remembers the leader, follows the redirects of other main servers
+// and moves on to the next address when one cannot be reached. A single
+// address works the same, as a lone main server is always its own leader.
+// It is safe for concurrent use.
+type Cluster struct {
+	pool  *Pool
+	addrs []string
+
+	lock   sync.Mutex
+	leader string // Address requests go to first
+}
+
+const (
+	// How long to wait before asking again while no leader is elected
+	electionWait = 200 * time.Millisecond
+	// Redirects followed per address before giving up on finding the leader
+	redirectsPerAddr = 3
+)
+
+func NewCluster(pool *Pool, addrs []string) *Cluster {
+	var leader string
+	if len(addrs) > 0 {
+		leader = addrs[0]
+	}
+	return &Cluster{pool: pool, addrs: addrs, leader: leader}
+}
+
+// Leader returns the address the next request goes to
+func (c *Cluster) Leader() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.leader
+}
+
+// Call is Pool.Call to the leader. A request only reaches the leader once,
+// as other main servers refuse it without acting on it.
+func (c *Cluster) Call(ctx context.Context, reqType MessageType, req any, respType MessageType, resp any) error {
+	for redirects := 0; ; redirects++ {
+		addr := c.Leader()
+		err := c.pool.Call(ctx, addr, reqType, req, respType, resp)
+		var refused *Error_Response
+		switch {
+		case errors.As(err, &refused) && refused.Code == ErrNotLeader:
+			c.follow(addr, refused.Leader)
+		case errors.Is(err, ErrNotSent) && len(c.addrs) > 1:
+			c.follow(addr, "")
+		default:
+			return err
+		}
+		if redirects >= redirectsPerAddr*len(c.addrs) || ctx.Err() != nil {
+			return err
+		}
+
+		// Without a hint the leader is down or an election is under way
+		if refused == nil || refused.Leader == "" {
+			select {
+			case <-time.After(electionWait):
+			case <-ctx.Done():
+				return err
+			}
+		}
+	}
+}
+
+// follow moves away from addr to the leader it named, or to the next
+// address if it named none. A concurrent call may have moved already.
+func (c *Cluster) follow(addr string, hint string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.leader != addr {
+		return
+	}
+	if hint != "" {
+		c.leader = hint
+		return
+	}
+	if i := slices.Index(c.addrs, addr); i >= 0 {
+		c.leader = c.addrs[(i+1)%len(c.addrs)]
+	} else if len(c.addrs) > 0 {
+		c.leader = c.addrs[0]
+	}
+}
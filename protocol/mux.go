@@ -0,0 +1,374 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Multiplexing
+A connection whose first message carries an ID stays open for further
+requests, which may be sent without waiting for earlier ones to be answered.
+Every request on it carries an ID of its own, and every reply the ID of its
+request. Replies come in whatever order the requests finish. Requests
+followed by raw data, uploads and downloads of chunks, cannot be multiplexed
+and still get a connection of their own.
+*/
+
+// Encoder sends the reply to a request
+type Encoder interface {
+	Encode(v any) error
+}
+
+// Handler answers a single request through encoder. conn is the request's
+// own connection, for raw data to follow it, or nil if it was multiplexed.
+type Handler func(msg Message, encoder Encoder, conn net.Conn)
+
+const (
+	// Requests of one multiplexed connection handled at once, further ones
+	// wait to be read
+	maxInFlight = 64
+	// A pooled connection nobody has used for this long is closed
+	idleTimeout = time.Minute
+)
+
+// Serve reads the requests on conn and handles each with handle, in
+// parallel if conn is multiplexed. It returns once conn is closed by the
+// other side and every request is answered.
+func Serve(conn net.Conn, handle Handler) error {
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+
+	var msg Message
+	if err := decoder.Decode(&msg); err != nil {
+		if err == io.EOF {
+			// Closed before it was used
+			return nil
+		}
+		return err
+	}
+	if msg.ID == 0 {
+		handle(msg, encoder, conn)
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	writer := &muxWriter{encoder: encoder}
+	slots := make(chan struct{}, maxInFlight)
+	for {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(msg Message) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			reply := &reply{writer: writer, id: msg.ID}
+			handle(msg, reply, nil)
+			// The caller waits for an answer, even to a request that failed early
+			if !reply.sent {
+				reply.Encode(ErrorMessage(Errorf(ErrInternal, "%s failed without an answer", msg.Type)))
+			}
+		}(msg)
+
+		msg = Message{}
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if msg.ID == 0 {
+			return fmt.Errorf("%s without an ID on a multiplexed connection", msg.Type)
+		}
+	}
+}
+
+// muxWriter serializes the replies of a multiplexed connection
+type muxWriter struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+}
+
+// reply sends the answer to one multiplexed request, tagged with its ID
+type reply struct {
+	writer *muxWriter
+	id     uint64
+	sent   bool
+}
+
+func (r *reply) Encode(v any) error {
+	msg, ok := v.(Message)
+	if !ok {
+		return fmt.Errorf("cannot multiplex a %T", v)
+	}
+	if r.sent {
+		return fmt.Errorf("request %d is already answered", r.id)
+	}
+	r.sent = true
+	msg.ID = r.id
+	r.writer.lock.Lock()
+	defer r.writer.lock.Unlock()
+	return r.writer.encoder.Encode(msg)
+}
+
+// ErrNotSent wraps failures that happened before a request left the caller,
+// so the request is safe to send again whatever it does
+var ErrNotSent = errors.New("request not sent")
+
+// MinTransferRate is the slowest, in bytes per second, a chunk transfer
+// without a rate limit is expected to go
+const MinTransferRate = 1 << 20
+
+// TransferTimeout is how long moving size bytes may take at rate bytes per
+// second, or at MinTransferRate if rate is 0, plus timeout for connecting
+// and answering
+func TransferTimeout(timeout time.Duration, size int64, rate int64) time.Duration {
+	if rate <= 0 {
+		rate = MinTransferRate
+	}
+	return timeout + time.Duration(size)*time.Second/time.Duration(rate)
+}
+
+// Pool keeps a multiplexed connection to every address it calls, opened on
+// first use, again once it breaks, and closed after a minute unused. It is
+// safe for concurrent use. The zero Pool waits forever.
+type Pool struct {
+	DialTimeout  time.Duration // Longest connecting to an address may take
+	WriteTimeout time.Duration // Longest sending a request may block
+
+	lock    sync.Mutex
+	conns   map[string]*muxConn
+	dialing map[string]chan struct{} // Closed once the dial to an address is done
+}
+
+// Call sends a request of reqType to addr and decodes its reply of respType
+// into resp, unless resp is nil. It waits for the reply until ctx is done.
+// An Error reply is returned as a *Error_Response.
+func (p *Pool) Call(ctx context.Context, addr string, reqType MessageType, req any, respType MessageType, resp any) error {
+	var payload json.RawMessage
+	if req != nil {
+		var err error
+		if payload, err = json.Marshal(req); err != nil {
+			return err
+		}
+	}
+	msg, err := p.roundTrip(ctx, addr, Message{Type: reqType, Payload: payload})
+	if err != nil {
+		return err
+	}
+	if err := msg.Err(); err != nil {
+		return err
+	}
+	if msg.Type != respType {
+		return fmt.Errorf("%s expected", respType)
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.Unmarshal(msg.Payload, resp)
+}
+
+func (p *Pool) roundTrip(ctx context.Context, addr string, msg Message) (Message, error) {
+	for {
+		conn, fresh, err := p.conn(ctx, addr)
+		if err != nil {
+			return Message{}, fmt.Errorf("%w: %w", ErrNotSent, err)
+		}
+		reply, err := conn.roundTrip(ctx, msg)
+		// A pooled connection may have broken while idle, the request
+		// never went out on it so try a new one
+		if !fresh && errors.Is(err, ErrNotSent) && ctx.Err() == nil {
+			continue
+		}
+		return reply, err
+	}
+}
+
+// conn returns the open connection to addr, dialing one if there is none.
+// fresh tells if it was just dialed.
+func (p *Pool) conn(ctx context.Context, addr string) (conn *muxConn, fresh bool, err error) {
+	p.lock.Lock()
+	for {
+		if conn := p.conns[addr]; conn != nil && conn.usable() {
+			p.lock.Unlock()
+			return conn, false, nil
+		}
+		// Wait for a dial already in progress rather than dialing twice
+		dialing := p.dialing[addr]
+		if dialing == nil {
+			break
+		}
+		p.lock.Unlock()
+		select {
+		case <-dialing:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		p.lock.Lock()
+	}
+	if p.conns == nil {
+		p.conns = make(map[string]*muxConn)
+		p.dialing = make(map[string]chan struct{})
+	}
+	dialing := make(chan struct{})
+	p.dialing[addr] = dialing
+	p.lock.Unlock()
+
+	// Dial without the lock, so an unreachable address holds up no other
+	dialer := net.Dialer{Timeout: p.DialTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.dialing, addr)
+	close(dialing)
+	if err != nil {
+		return nil, false, err
+	}
+	conn = &muxConn{
+		conn:         netConn,
+		encoder:      json.NewEncoder(netConn),
+		writeTimeout: p.WriteTimeout,
+		pending:      make(map[uint64]chan Message),
+	}
+	conn.idle = time.AfterFunc(idleTimeout, conn.closeIdle)
+	go conn.readLoop()
+	p.conns[addr] = conn
+	return conn, true, nil
+}
+
+// Close closes every connection, failing the calls waiting on them
+func (p *Pool) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for addr, conn := range p.conns {
+		conn.fail(net.ErrClosed)
+		delete(p.conns, addr)
+	}
+	return nil
+}
+
+// muxConn is one multiplexed connection of a Pool
+type muxConn struct {
+	conn         net.Conn
+	writeTimeout time.Duration
+
+	writeLock sync.Mutex
+	encoder   *json.Encoder
+
+	lock    sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan Message // Request ID -> Where its reply goes
+	idle    *time.Timer             // Runs while nothing is pending
+	err     error                   // Set once the connection broke
+}
+
+func (m *muxConn) usable() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.err == nil
+}
+
+func (m *muxConn) roundTrip(ctx context.Context, msg Message) (Message, error) {
+	replies := make(chan Message, 1)
+	m.lock.Lock()
+	if m.err != nil {
+		m.lock.Unlock()
+		return Message{}, fmt.Errorf("%w: %w", ErrNotSent, m.err)
+	}
+	m.nextID++
+	msg.ID = m.nextID
+	m.pending[msg.ID] = replies
+	m.idle.Stop()
+	m.lock.Unlock()
+	defer m.done(msg.ID)
+
+	m.writeLock.Lock()
+	if m.writeTimeout > 0 {
+		m.conn.SetWriteDeadline(time.Now().Add(m.writeTimeout))
+	}
+	err := m.encoder.Encode(msg)
+	m.writeLock.Unlock()
+	if err != nil {
+		m.fail(err)
+		return Message{}, err
+	}
+
+	select {
+	case reply, ok := <-replies:
+		if !ok {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			return Message{}, m.err
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+// done forgets a request, its reply is dropped if it still comes
+func (m *muxConn) done(id uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.pending, id)
+	if len(m.pending) == 0 && m.err == nil {
+		m.idle.Reset(idleTimeout)
+	}
+}
+
+func (m *muxConn) readLoop() {
+	decoder := json.NewDecoder(m.conn)
+	for {
+		var msg Message
+		if err := decoder.Decode(&msg); err != nil {
+			m.fail(err)
+			return
+		}
+		m.lock.Lock()
+		replies := m.pending[msg.ID]
+		delete(m.pending, msg.ID)
+		m.lock.Unlock()
+		if replies != nil {
+			replies <- msg
+		}
+	}
+}
+
+// closeIdle closes the connection unless a request was sent on it since
+// the idle timer fired. Both happen under m.lock, so a request either finds
+// the connection failed and is not sent, or keeps it open.
+func (m *muxConn) closeIdle() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.pending) == 0 {
+		m.failLocked(errors.New("connection closed after being idle"))
+	}
+}
+
+// fail closes the connection, failing every call waiting on it with err
+func (m *muxConn) fail(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.failLocked(err)
+}
+
+// Callers hold m.lock.
+func (m *muxConn) failLocked(err error) {
+	if m.err != nil {
+		return
+	}
+	m.err = err
+	m.idle.Stop()
+	m.conn.Close()
+	for id, replies := range m.pending {
+		close(replies)
+		delete(m.pending, id)
+	}
+}
@@ -0,0 +1,175 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveTest answers requests with handle on a local address until the test
+// ends, and counts the connections it accepted
+func serveTest(t *testing.T, handle Handler) (string, *atomic.Int32) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	accepted := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				Serve(conn, handle)
+			}()
+		}
+	}()
+	return listener.Addr().String(), accepted
+}
+
+// echo answers a request with its own payload under type respType
+func echo(encoder Encoder, msg Message, respType MessageType) {
+	encoder.Encode(Message{Type: respType, Payload: msg.Payload})
+}
+
+func testCall(t *testing.T, pool *Pool, addr string, reqType MessageType, req string, respType MessageType) (string, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var resp string
+	err := pool.Call(ctx, addr, reqType, req, respType, &resp)
+	return resp, err
+}
+
+func TestMuxOutOfOrderReplies(t *testing.T) {
+	release := make(chan struct{})
+	addr, accepted := serveTest(t, func(msg Message, encoder Encoder, conn net.Conn) {
+		if msg.Type == "SLOW_REQ" {
+			<-release
+		}
+		echo(encoder, msg, msg.Type+"_ACK")
+	})
+	pool := &Pool{}
+	defer pool.Close()
+
+	type result struct {
+		resp string
+		err  error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		resp, err := testCall(t, pool, addr, "SLOW_REQ", "slow", "SLOW_REQ_ACK")
+		slow <- result{resp, err}
+	}()
+
+	// Requests sent after the slow one are answered before it
+	for _, req := range []string{"a", "b", "c"} {
+		resp, err := testCall(t, pool, addr, "FAST_REQ", req, "FAST_REQ_ACK")
+		if err != nil || resp != req {
+			t.Fatalf("fast call %s got %q, %v", req, resp, err)
+		}
+	}
+	select {
+	case r := <-slow:
+		t.Fatalf("slow call returned before it was answered: %q, %v", r.resp, r.err)
+	default:
+	}
+
+	close(release)
+	if r := <-slow; r.err != nil || r.resp != "slow" {
+		t.Fatalf("slow call got %q, %v", r.resp, r.err)
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Fatalf("%d connections used, expected 1", n)
+	}
+}
+
+func TestMuxUnansweredRequest(t *testing.T) {
+	addr, _ := serveTest(t, func(msg Message, encoder Encoder, conn net.Conn) {
+		if msg.Type == "ECHO_REQ" {
+			echo(encoder, msg, "ECHO_ACK")
+		}
+	})
+	pool := &Pool{}
+	defer pool.Close()
+
+	_, err := testCall(t, pool, addr, "SILENT_REQ", "x", "SILENT_ACK")
+	var resp *Error_Response
+	if !errors.As(err, &resp) || resp.Code != ErrInternal {
+		t.Fatalf("unanswered request failed with %v, expected %s", err, ErrInternal)
+	}
+
+	// The connection stays usable
+	if resp, err := testCall(t, pool, addr, "ECHO_REQ", "y", "ECHO_ACK"); err != nil || resp != "y" {
+		t.Fatalf("call after an unanswered one got %q, %v", resp, err)
+	}
+}
+
+func TestMuxIdleClose(t *testing.T) {
+	release := make(chan struct{})
+	addr, accepted := serveTest(t, func(msg Message, encoder Encoder, conn net.Conn) {
+		if msg.Type == "SLOW_REQ" {
+			<-release
+		}
+		echo(encoder, msg, msg.Type+"_ACK")
+	})
+	pool := &Pool{}
+	defer pool.Close()
+	if _, err := testCall(t, pool, addr, "ECHO_REQ", "a", "ECHO_REQ_ACK"); err != nil {
+		t.Fatal(err)
+	}
+	pool.lock.Lock()
+	conn := pool.conns[addr]
+	pool.lock.Unlock()
+
+	// A connection with a request in flight is not idle
+	slow := make(chan error, 1)
+	go func() {
+		_, err := testCall(t, pool, addr, "SLOW_REQ", "b", "SLOW_REQ_ACK")
+		slow <- err
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		conn.lock.Lock()
+		pending := len(conn.pending)
+		conn.lock.Unlock()
+		if pending > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slow request never sent")
+		}
+	}
+	conn.closeIdle()
+	if !conn.usable() {
+		t.Fatal("connection with a pending request closed as idle")
+	}
+	close(release)
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+
+	// Once idle it closes, and a request on it is refused as not sent
+	conn.closeIdle()
+	if conn.usable() {
+		t.Fatal("idle connection left open")
+	}
+	if _, err := conn.roundTrip(context.Background(), Message{Type: "ECHO_REQ"}); !errors.Is(err, ErrNotSent) {
+		t.Fatalf("request on a closed idle connection failed with %v, expected %v", err, ErrNotSent)
+	}
+
+	// The pool dials a new connection for the next call
+	if resp, err := testCall(t, pool, addr, "ECHO_REQ", "c", "ECHO_REQ_ACK"); err != nil || resp != "c" {
+		t.Fatalf("call after idle close got %q, %v", resp, err)
+	}
+	if n := accepted.Load(); n != 2 {
+		t.Fatalf("%d connections used, expected 2", n)
+	}
+}
@@ -2,6 +2,10 @@ package protocol
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
 )
 
 type MessageType string
@@ -12,17 +16,59 @@ const (
 	DownloadReq MessageType = "CLIENT_DOWNLOAD_REQ"
 	LookupReq   MessageType = "CLIENT_LOOKUP_REQ"
 
-	UploadResp   MessageType = "MAIN_UPLOAD_RESP"
-	DownloadResp MessageType = "MAIN_DOWNLOAD_RESP"
-	DeleteReqM   MessageType = "MAIN_DELETE_REQ"
-	DeleteAckM   MessageType = "MAIN_DELETE_ACK"
-	LookupResp   MessageType = "MAIN_LOOKUP_RESP"
-	MemLookupReq MessageType = "MAIN_MEM_LOOKUP_REQ"
+	UploadCommitReq MessageType = "CLIENT_UPLOAD_COMMIT_REQ"
+	AllocateReq     MessageType = "CLIENT_ALLOCATE_REQ"
+	MkdirReq        MessageType = "CLIENT_MKDIR_REQ"
+	RmdirReq        MessageType = "CLIENT_RMDIR_REQ"
+	ListReq         MessageType = "CLIENT_LIST_REQ"
+	RenameReq       MessageType = "CLIENT_RENAME_REQ"
+	DecommissionReq MessageType = "CLIENT_DECOMMISSION_REQ"
+	BalanceReq      MessageType = "CLIENT_BALANCE_REQ"
 
-	UploadAck     MessageType = "NODE_UPLOAD_ACK"
-	DownloadAck   MessageType = "NODE_DOWNLOAD_ACK"
-	DeleteAckN    MessageType = "NODE_DELETE_ACK"
-	MemLookupResp MessageType = "NODE_MEM_LOOKUP_RESP"
+	UploadResp       MessageType = "MAIN_UPLOAD_RESP"
+	DownloadResp     MessageType = "MAIN_DOWNLOAD_RESP"
+	DeleteReqM       MessageType = "MAIN_DELETE_REQ"
+	DeleteAckM       MessageType = "MAIN_DELETE_ACK"
+	LookupResp       MessageType = "MAIN_LOOKUP_RESP"
+	MemLookupReq     MessageType = "MAIN_MEM_LOOKUP_REQ"
+	BlockReportReq   MessageType = "MAIN_BLOCK_REPORT_REQ"
+	HeartbeatAck     MessageType = "MAIN_HEARTBEAT_ACK"
+	RegisterAck      MessageType = "MAIN_REGISTER_ACK"
+	DeregisterAck    MessageType = "MAIN_DEREGISTER_ACK"
+	ReplicateReq     MessageType = "MAIN_REPLICATE_REQ"
+	RebuildReq       MessageType = "MAIN_REBUILD_REQ"
+	CorruptReportAck MessageType = "MAIN_CORRUPT_REPORT_ACK"
+
+	UploadCommitResp MessageType = "MAIN_UPLOAD_COMMIT_RESP"
+	UploadConfirmAck MessageType = "MAIN_UPLOAD_CONFIRM_ACK"
+	AllocateResp     MessageType = "MAIN_ALLOCATE_RESP"
+	MkdirResp        MessageType = "MAIN_MKDIR_RESP"
+	RmdirResp        MessageType = "MAIN_RMDIR_RESP"
+	ListResp         MessageType = "MAIN_LIST_RESP"
+	RenameResp       MessageType = "MAIN_RENAME_RESP"
+	DecommissionResp MessageType = "MAIN_DECOMMISSION_RESP"
+	BalanceResp      MessageType = "MAIN_BALANCE_RESP"
+
+	UploadAck        MessageType = "NODE_UPLOAD_ACK"
+	UploadDone       MessageType = "NODE_UPLOAD_DONE"
+	UploadConfirmReq MessageType = "NODE_UPLOAD_CONFIRM_REQ"
+	DownloadAck      MessageType = "NODE_DOWNLOAD_ACK"
+	DeleteAckN       MessageType = "NODE_DELETE_ACK"
+	MemLookupResp    MessageType = "NODE_MEM_LOOKUP_RESP"
+	BlockReportResp  MessageType = "NODE_BLOCK_REPORT_RESP"
+	HeartbeatReq     MessageType = "NODE_HEARTBEAT_REQ"
+	RegisterReq      MessageType = "NODE_REGISTER_REQ"
+	DeregisterReq    MessageType = "NODE_DEREGISTER_REQ"
+	CorruptReportReq MessageType = "NODE_CORRUPT_REPORT_REQ"
+	ReplicateAck     MessageType = "NODE_REPLICATE_ACK"
+	RebuildAck       MessageType = "NODE_REBUILD_ACK"
+
+	VoteReq            MessageType = "MAIN_VOTE_REQ"
+	VoteResp           MessageType = "MAIN_VOTE_RESP"
+	AppendEntriesReq   MessageType = "MAIN_APPEND_ENTRIES_REQ"
+	AppendEntriesResp  MessageType = "MAIN_APPEND_ENTRIES_RESP"
+	InstallSnapshotReq MessageType = "MAIN_INSTALL_SNAPSHOT_REQ"
+	InstallSnapshotAck MessageType = "MAIN_INSTALL_SNAPSHOT_ACK"
 
 	Error MessageType = "ERROR"
 )
@@ -30,46 +76,239 @@ const (
 type Message struct {
 	Type    MessageType     `json:"type"`
 	Payload json.RawMessage `json:"payload"`
+	ID      uint64          `json:"id,omitempty"` // Only on multiplexed connections
+}
+
+/*
+Errors
+Any request can be answered with an Error message instead of its usual
+response. Its Code says what went wrong so callers can branch on the cause.
+*/
+
+type ErrorCode string
+
+const (
+	ErrNotFound         ErrorCode = "NOT_FOUND"
+	ErrExists           ErrorCode = "EXISTS"
+	ErrNoSpace          ErrorCode = "NO_SPACE"
+	ErrNodeUnavailable  ErrorCode = "NODE_UNAVAILABLE"
+	ErrChecksumMismatch ErrorCode = "CHECKSUM_MISMATCH"
+	ErrPermissionDenied ErrorCode = "PERMISSION_DENIED"
+	ErrInvalid          ErrorCode = "INVALID"    // The request cannot apply, e.g. rmdir of a file
+	ErrNotLeader        ErrorCode = "NOT_LEADER" // Sent to a main server that is not the leader, nothing was done
+	ErrInternal         ErrorCode = "INTERNAL"   // Anything without a more specific code
+)
+
+// Error Response, also usable as a Go error. Leader is where a NOT_LEADER
+// request should go instead, empty while no leader is known.
+type Error_Response struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	Leader  string    `json:"leader,omitempty"`
+}
+
+func (e *Error_Response) Error() string {
+	return e.Message
+}
+
+// Errorf creates an error carrying code
+func Errorf(code ErrorCode, format string, args ...any) error {
+	return &Error_Response{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// NotLeader creates the error a main server answers with when it cannot
+// act on a request because it is not the leader
+func NotLeader(leader string) error {
+	if leader == "" {
+		return &Error_Response{Code: ErrNotLeader, Message: "no leader elected yet"}
+	}
+	return &Error_Response{Code: ErrNotLeader, Message: "not the leader, " + leader + " is", Leader: leader}
+}
+
+// CodeOf returns the code carried by err, ErrInternal if it carries none,
+// or "" if err is nil
+func CodeOf(err error) ErrorCode {
+	if err == nil {
+		return ""
+	}
+	var resp *Error_Response
+	if errors.As(err, &resp) {
+		return resp.Code
+	}
+	return ErrInternal
+}
+
+// ErrorMessage wraps err into an Error message
+func ErrorMessage(err error) Message {
+	resp := Error_Response{Code: CodeOf(err), Message: err.Error()}
+	var coded *Error_Response
+	if errors.As(err, &coded) {
+		resp.Leader = coded.Leader
+	}
+	payload, _ := json.Marshal(resp)
+	return Message{Type: Error, Payload: payload}
+}
+
+// Err returns the error an Error message carries, or nil for any other message
+func (msg Message) Err() error {
+	if msg.Type != Error {
+		return nil
+	}
+	var resp Error_Response
+	if err := json.Unmarshal(msg.Payload, &resp); err != nil {
+		return err
+	}
+	return &resp
 }
 
 /*
 Upload Process
 Client -> Main for allocation
-Main -> Client for address
-Client -> Node for upload
-Node -> Client for confirmation
+Main -> Client for a lease, chunk IDs and replica addresses
+Client -> Node for upload, once per chunk replica
+Node -> Client for confirmation, with the offset to continue a session from
+Client -> Node for data
+Node -> Main to confirm the chunk replica was stored under the lease
+Node -> Client once the data is verified, stored and confirmed
+Client -> Main to commit the lease
+Main -> Client once the file is visible
+The file only becomes visible once every chunk replica is confirmed. A lease
+that is not committed in time expires, and its chunks are deleted.
+A chunk upload that names a Session keeps its partial data on the node if the
+connection drops, and sending the same request again resumes it.
+A streamed upload does not know its size in advance. Its lease starts with no
+chunks, the client allocates them one at a time as it fills them, and the file
+is only committed once the client commits the lease.
+An erasure-coded upload gets chunks made of shards instead of replicas. The
+client encodes each chunk into its shards and sends each shard to its one
+location like a chunk replica.
 */
 
-// Client Upload Request
+// Client Upload Request, Filename is the chunk ID when sent to a node.
+// Checksum is the hex SHA-256 of the file, or of the chunk when sent to a node.
+// Lease is set when a client sends a chunk to a node, which then confirms it
+// to its main server.
+// Session makes a chunk upload resumable. Stream opens a streamed upload,
+// Size and Checksum are then unknown. Erasure stores the file erasure-coded
+// rather than replicated.
 type Upload_Request struct {
+	Filename string   `json:"filename"`
+	Size     int64    `json:"size"`
+	Checksum string   `json:"checksum,omitempty"`
+	Lease    string   `json:"lease,omitempty"`
+	Session  string   `json:"session,omitempty"`
+	Stream   bool     `json:"stream,omitempty"`
+	Erasure  *Erasure `json:"erasure,omitempty"`
+}
+
+// Erasure coding scheme, every chunk is cut into Data shards and Parity
+// more are computed, each stored on a different node. Any Data of them
+// are enough to read the chunk.
+type Erasure struct {
+	Data   int `json:"data"`
+	Parity int `json:"parity"`
+}
+
+func (e Erasure) String() string {
+	return fmt.Sprintf("%d+%d", e.Data, e.Parity)
+}
+
+// ParseErasure parses a scheme written as data+parity, like 6+3
+func ParseErasure(s string) (Erasure, error) {
+	var e Erasure
+	if _, err := fmt.Sscanf(s, "%d+%d", &e.Data, &e.Parity); err != nil || e.String() != s {
+		return e, fmt.Errorf("erasure scheme %q is not of the form data+parity, like 6+3", s)
+	}
+	return e, nil
+}
+
+// Node Upload Ack, Offset is how much of the session's data the node already
+// holds. The sender skips that much and sends the rest.
+type Upload_Ack struct {
+	Offset int64 `json:"offset"`
+}
+
+// Main Server Upload Response, the client sends each chunk to every address of it.
+// A streamed upload gets no chunks, but the size to allocate them in.
+type Upload_Response struct {
+	Lease     string      `json:"lease"`
+	Chunks    []Chunkinfo `json:"chunks"`
+	ChunkSize int64       `json:"chunk_size,omitempty"`
+}
+
+// Client Allocate Request, adds the next chunk of Size bytes to a streamed upload
+type Allocate_Request struct {
+	Lease string `json:"lease"`
+	Size  int64  `json:"size"`
+}
+
+// Main Allocate Response
+type Allocate_Response struct {
+	Chunk Chunkinfo `json:"chunk"`
+}
+
+// Node Upload Confirm, Filename is the chunk ID
+type Upload_Confirm struct {
+	Lease    string `json:"lease"`
+	Addr     string `json:"addr"`
 	Filename string `json:"filename"`
 	Size     int64  `json:"size"`
 }
 
-// Main Server Upload Response
-type Upload_Response struct {
-	StorageAddr string `json:"storage_addr"`
+// Client Upload Commit, sent once every chunk was uploaded, or with Abort to
+// give the upload up early if one failed. Checksum is that of a streamed file.
+type Upload_Commit struct {
+	Lease    string `json:"lease"`
+	Checksum string `json:"checksum,omitempty"`
+	Abort    bool   `json:"abort,omitempty"`
+}
+
+// Main Upload Confirm and Commit Response
+type Commit_Response struct {
+	Success bool `json:"success"`
 }
 
 /*
 Download Process
 Client -> Main for request
-Main -> Client for address
-Client -> Node for request
+Main -> Client for chunk list
+Client -> Node for request, once per chunk the wanted range covers, trying the next replica on failure
 Node -> Client for download
+An erasure-coded chunk is read from the data shards the range covers. If one
+of them fails, enough other shards are read to reconstruct it.
 */
+
+// Client Download Request, Filename is the chunk ID when sent to a node.
+// Offset and Length select a range of the chunk, a zero Length reads to its end.
 type Download_Request struct {
 	Filename string `json:"filename"`
+	Offset   int64  `json:"offset,omitempty"`
+	Length   int64  `json:"length,omitempty"`
+}
+
+// Node Upload Done, sent after the data was received
+type Upload_Done struct {
+	Success bool `json:"success"`
 }
 
+// Node Download Ack, Size and Checksum are those of the whole file and
+// Length bytes of it follow, starting at the requested offset
+type Download_Ack struct {
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+	Length   int64  `json:"length"`
+}
+
+// Main Server Download Response, chunks are in file order
 type Download_Response struct {
-	StorageAddr string `json:"storage_addr"`
+	Chunks   []Chunkinfo `json:"chunks"`
+	Checksum string      `json:"checksum"`
 }
 
 /*
 Delete Process
 Client -> Main for request
-Main -> Node for deletion
+Main -> Node for deletion, once per chunk replica
 Node -> Main for confirmation
 Main -> Client for confirmation
 */
@@ -90,18 +329,378 @@ Client -> Main for request
 Main -> Client for result
 */
 
+// A fixed-size piece of a file, stored under its ID on every location.
+// An erasure-coded chunk has no locations but Shards, each stored like a
+// chunk of its own. The first DataShards of them hold the chunk's data,
+// zero-padded to a multiple of their size, and the rest hold parity.
+type Chunkinfo struct {
+	ID         string      `json:"id"`
+	Size       int64       `json:"size"`
+	Locations  []string    `json:"locations"`
+	Shards     []Chunkinfo `json:"shards,omitempty"`
+	DataShards int         `json:"data_shards,omitempty"`
+}
+
+// Coded reports whether the chunk is erasure-coded rather than replicated
+func (chunk Chunkinfo) Coded() bool {
+	return len(chunk.Shards) > 0
+}
+
+// Readable reports whether the chunk can still be read, from a replica or
+// from enough shards
+func (chunk Chunkinfo) Readable() bool {
+	if !chunk.Coded() {
+		return len(chunk.Locations) > 0
+	}
+	stored := 0
+	for _, shard := range chunk.Shards {
+		if len(shard.Locations) > 0 {
+			stored++
+		}
+	}
+	return stored >= chunk.DataShards
+}
+
+// Holders returns every storage server holding a replica or shard of the chunk
+func (chunk Chunkinfo) Holders() []string {
+	holders := slices.Clone(chunk.Locations)
+	for _, shard := range chunk.Shards {
+		holders = append(holders, shard.Locations...)
+	}
+	return holders
+}
+
+// Blocks returns what storage servers hold of the chunks: every replicated
+// chunk and every shard of an erasure-coded one. They point into chunks.
+func Blocks(chunks []Chunkinfo) []*Chunkinfo {
+	var blocks []*Chunkinfo
+	for i := range chunks {
+		if !chunks[i].Coded() {
+			blocks = append(blocks, &chunks[i])
+			continue
+		}
+		for j := range chunks[i].Shards {
+			blocks = append(blocks, &chunks[i].Shards[j])
+		}
+	}
+	return blocks
+}
+
 type Fileinfo struct {
-	Filename string `json:"filename"`
-	Size     int64  `json:"size"`
-	Location string `json:"location"`
+	Filename string      `json:"filename"`
+	Size     int64       `json:"size"`
+	Checksum string      `json:"checksum"` // Hex SHA-256 of the whole file
+	Chunks   []Chunkinfo `json:"chunks"`
+	Corrupt  bool        `json:"corrupt"` // Some chunk has no intact replica, or too few shards, left
 }
 
-// Main Lookup Response
+type NodeStatus string
+
+const (
+	NodeAlive   NodeStatus = "ALIVE"
+	NodeSuspect NodeStatus = "SUSPECT" // Missed heartbeats, not allocated to
+	NodeDead    NodeStatus = "DEAD"
+)
+
+type Nodeinfo struct {
+	Availmem      int64      `json:"availmem"`
+	Capacity      int64      `json:"capacity"`
+	FileCount     int        `json:"file_count"`
+	Load          int64      `json:"load"`
+	Status        NodeStatus `json:"status"`
+	LastHeartbeat time.Time  `json:"last_heartbeat"`
+	Draining      bool       `json:"draining"` // Being decommissioned, not allocated to
+	Reserved      int64      `json:"reserved"` // Promised to transfers in progress, not yet stored
+	Reported      int64      `json:"reported"` // Free space as of the last heartbeat, Availmem is the main server's own count
+}
+
+// Main Lookup Response, Leader is set when the main servers replicate each other
 type Lookup_Response struct {
-	Files map[string]Fileinfo `json:"files"`
+	Files  map[string]Fileinfo `json:"files"`
+	Nodes  map[string]Nodeinfo `json:"nodes"`
+	Leader string              `json:"leader,omitempty"`
+	Term   uint64              `json:"term,omitempty"`
 }
 
 // Mem Lookup Response
 type MemLookup_Response struct {
 	Availmem int64 `json:"availmem"`
 }
+
+/*
+Block Report Process
+Main -> Node for request
+Node -> Main for every file it holds
+*/
+
+type Blockinfo struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+}
+
+// Node Block Report Response
+type BlockReport_Response struct {
+	Availmem int64       `json:"availmem"`
+	Capacity int64       `json:"capacity"`
+	Files    []Blockinfo `json:"files"`
+}
+
+/*
+Directory Process
+Client -> Main for mkdir, rmdir or list
+Main -> Client for result
+Paths are absolute, relative ones are taken from the root.
+*/
+
+// Client Mkdir Request, Parents creates missing parents like mkdir -p
+type Mkdir_Request struct {
+	Path    string `json:"path"`
+	Parents bool   `json:"parents"`
+}
+
+// Client Rmdir Request, Recursive removes a non-empty directory with everything in it
+type Rmdir_Request struct {
+	Path      string `json:"path"`
+	Recursive bool   `json:"recursive"`
+}
+
+// Main Mkdir and Rmdir Response, Message warns about a partial cleanup
+type Dir_Response struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// Client List Request, Recursive lists the whole subtree
+type List_Request struct {
+	Path      string `json:"path"`
+	Recursive bool   `json:"recursive"`
+}
+
+type DirEntry struct {
+	Path  string `json:"path"`
+	IsDir bool   `json:"is_dir"`
+	Size  int64  `json:"size"`
+}
+
+// Main List Response, entries are sorted by path
+type List_Response struct {
+	Entries []DirEntry `json:"entries"`
+}
+
+/*
+Rename Process
+Client -> Main for request
+Main -> Client for result
+Only metadata changes, chunks stay where they are. A replaced file's chunks are deleted.
+*/
+
+// Client Rename Request, moves a file or directory. Overwrite replaces an
+// existing Destination of the same kind, an empty one if it is a directory.
+type Rename_Request struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Overwrite   bool   `json:"overwrite"`
+}
+
+// Main Rename Response, Message warns about a partial cleanup
+type Rename_Response struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+/*
+Heartbeat Process
+Node -> Main periodically
+Main -> Node for acknowledgement
+*/
+
+// Node Heartbeat, Load is the number of transfers in progress
+type Heartbeat_Request struct {
+	Addr      string `json:"addr"`
+	Availmem  int64  `json:"availmem"`
+	Capacity  int64  `json:"capacity"`
+	FileCount int    `json:"file_count"`
+	Load      int64  `json:"load"`
+}
+
+// Main Heartbeat Response, Known is false if the node is not in the storage list
+type Heartbeat_Response struct {
+	Known bool `json:"known"`
+}
+
+/*
+Register Process
+Node -> Main with its block report when it starts
+Main -> Node for confirmation
+*/
+
+// Node Register Request, Rejoin is set when re-registering after a
+// heartbeat was not recognized rather than on startup
+type Register_Request struct {
+	Addr   string               `json:"addr"`
+	Report BlockReport_Response `json:"report"`
+	Rejoin bool                 `json:"rejoin"`
+}
+
+// Main Register Response, a decommissioned node is refused a rejoin with an Error
+type Register_Response struct {
+	Success bool `json:"success"`
+}
+
+/*
+Decommission Process
+Client -> Main for request, or Node -> Main to deregister itself
+Main -> Source Node to copy every chunk on the node elsewhere
+Source Node -> Target Node for upload
+Source Node -> Main for confirmation
+Main -> Client or Node once the node is drained and removed
+*/
+
+type Decommission_Request struct {
+	Addr string `json:"addr"`
+}
+
+type Decommission_Response struct {
+	Success bool `json:"success"`
+	Moved   int  `json:"moved"` // Chunk replicas copied off the node
+}
+
+/*
+Balance Process
+Client -> Main to plan moving chunk replicas and shards from fuller nodes to
+emptier ones, until every node is within Threshold of the mean utilization
+Main -> Client with the plan, which it then carries out unless DryRun
+Main -> Source Node to copy each chunk to its target, as for a decommission
+Main -> Source Node to delete its copy, once reads of it have had time to finish
+A request with Stop ends the balance in progress after its current move instead
+*/
+
+type Balance_Request struct {
+	Threshold float64 `json:"threshold"` // Fraction of capacity, e.g. 0.1
+	DryRun    bool    `json:"dry_run,omitempty"`
+	Stop      bool    `json:"stop,omitempty"`
+}
+
+// A chunk replica or shard moved from one node to another
+type Move struct {
+	Chunk string `json:"chunk"`
+	Size  int64  `json:"size"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+type Balance_Response struct {
+	Success     bool               `json:"success"`
+	Mean        float64            `json:"mean"`                  // Used fraction of the capacity of all nodes
+	Utilization map[string]float64 `json:"utilization,omitempty"` // Used fraction of each node's capacity
+	Moves       []Move             `json:"moves,omitempty"`       // Planned
+	Running     bool               `json:"running"`               // A balance is in progress
+	Moved       int                `json:"moved"`                 // By the balance that was stopped
+}
+
+// Main Replicate Request, the node uploads its copy of the chunk to Target,
+// at no more than Rate bytes per second unless it is 0
+type Replicate_Request struct {
+	Filename string `json:"filename"`
+	Target   string `json:"target"`
+	Rate     int64  `json:"rate,omitempty"`
+}
+
+type Replicate_Response struct {
+	Success bool `json:"success"`
+}
+
+/*
+Re-replication Process
+Main -> Surviving Node to copy a chunk to a new node, once a node holding
+another replica is declared dead, as for a decommission
+Main -> New Node to rebuild a shard that was on the dead node, as below
+*/
+
+/*
+Corruption Report Process
+Node -> Main with the files its scrubber quarantined
+Main -> Node for acknowledgement
+Main -> Surviving Node to copy each chunk to a new node
+*/
+
+type CorruptReport_Request struct {
+	Addr  string   `json:"addr"`
+	Files []string `json:"files"`
+}
+
+/*
+Rebuild Process
+Main -> Node chosen to hold a lost shard of an erasure-coded chunk
+Node -> Other Nodes for download of enough other shards of the chunk
+Node -> Main once it reconstructed and stored the shard
+*/
+
+// Main Rebuild Request, the node stores shard Index of Chunk. It reads the
+// other shards at no more than Rate bytes per second unless it is 0.
+type Rebuild_Request struct {
+	Chunk Chunkinfo `json:"chunk"`
+	Index int       `json:"index"`
+	Rate  int64     `json:"rate,omitempty"`
+}
+
+type Rebuild_Response struct {
+	Success bool `json:"success"`
+}
+
+/*
+Consensus Process
+Main servers started with peers replicate every metadata change through Raft.
+Candidate -> Main for a vote, with how far its log goes
+Main -> Candidate granting or refusing it
+Leader -> Main for appending entries, empty ones as heartbeats
+Main -> Leader with how much of the log matches
+Leader -> Main for a snapshot, when the entries it needs were compacted away
+Main -> Leader once it is installed
+Any message with a higher Term makes its receiver a follower in that term.
+*/
+
+// Main Vote Request
+type Vote_Request struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+// Main Vote Response
+type Vote_Response struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// Main Append Entries Request, Entries are journal entries following the one
+// at PrevIndex, and Commit is the leader's commit index
+type AppendEntries_Request struct {
+	Term      uint64            `json:"term"`
+	Leader    string            `json:"leader"`
+	PrevIndex uint64            `json:"prev_index"`
+	PrevTerm  uint64            `json:"prev_term"`
+	Entries   []json.RawMessage `json:"entries"`
+	Commit    uint64            `json:"commit"`
+}
+
+// Main Append Entries Response. On success Match is the last index known to
+// match the leader's log, otherwise the last one that still might.
+type AppendEntries_Response struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	Match   uint64 `json:"match"`
+}
+
+// Main Install Snapshot Request, Snapshot is the leader's metadata snapshot
+type InstallSnapshot_Request struct {
+	Term     uint64          `json:"term"`
+	Leader   string          `json:"leader"`
+	Snapshot json.RawMessage `json:"snapshot"`
+}
+
+// Main Install Snapshot Ack
+type InstallSnapshot_Response struct {
+	Term uint64 `json:"term"`
+}
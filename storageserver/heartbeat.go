@@ -0,0 +1,81 @@
+package storageserver
+
+import (
+	"DistributedFileSystem/protocol"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// heartbeatLoop reports this node's free space, file count and load to the main server
+func (s *StorageServer) heartbeatLoop() {
+	ticker := time.NewTicker(s.heartbeat)
+	defer ticker.Stop()
+	for range ticker.C {
+		known, err := s.sendHeartbeat()
+		if err != nil {
+			fmt.Println("Heartbeat Error", err)
+			continue
+		}
+		if !known {
+			fmt.Println("Main server", s.main.Leader(), "does not know this node, registering")
+			if err := s.register(true); err != nil {
+				fmt.Println("Register Error", err)
+				if err == errRefused {
+					fmt.Println("Node was decommissioned, stopping heartbeats")
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *StorageServer) sendHeartbeat() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.heartbeat)
+	defer cancel()
+	var resp protocol.Heartbeat_Response
+	req := protocol.Heartbeat_Request{
+		Addr:      s.addr,
+		Availmem:  s.GetAvailableMemory(),
+		Capacity:  s.GetCapacityMemory(),
+		FileCount: s.storage.FileCount(),
+		Load:      s.load.Load(),
+	}
+	err := s.main.Call(ctx, protocol.HeartbeatReq, req, protocol.HeartbeatAck, &resp)
+	return resp.Known, err
+}
+
+var errRefused = errors.New("registration refused")
+
+// register joins the cluster by sending the main server a block report
+func (s *StorageServer) register(rejoin bool) error {
+	req := protocol.Register_Request{
+		Addr:   s.addr,
+		Report: s.blockReport(),
+		Rejoin: rejoin,
+	}
+	err := s.callMain(mainTimeout, protocol.RegisterReq, req, protocol.RegisterAck, nil)
+	if protocol.CodeOf(err) == protocol.ErrPermissionDenied {
+		return errRefused
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("Registered with main server", s.main.Leader())
+	return nil
+}
+
+// Deregister asks the main server to move every file off this node and
+// forget it. It blocks until the drain is finished, or until it took longer
+// than moving every stored byte at the minimum transfer rate should.
+func (s *StorageServer) Deregister() (protocol.Decommission_Response, error) {
+	var resp protocol.Decommission_Response
+	req := protocol.Decommission_Request{Addr: s.addr}
+	var stored int64
+	for _, size := range s.storage.List() {
+		stored += size
+	}
+	err := s.callMain(protocol.TransferTimeout(mainTimeout, stored, 0), protocol.DeregisterReq, req, protocol.DeregisterAck, &resp)
+	return resp, err
+}
@@ -0,0 +1,121 @@
+package storageserver
+
+import (
+	"DistributedFileSystem/erasure"
+	"DistributedFileSystem/protocol"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// rebuild reconstructs shard index of an erasure-coded chunk from the first
+// of its other shards that can be read, and stores it. The shards are read
+// at no more than rate bytes per second unless it is 0.
+func (s *StorageServer) rebuild(chunk protocol.Chunkinfo, index int, rate int64) error {
+	code, err := erasure.New(chunk.DataShards, len(chunk.Shards)-chunk.DataShards)
+	if err != nil {
+		return protocol.Errorf(protocol.ErrInvalid, "chunk %s: %v", chunk.ID, err)
+	}
+	if index < 0 || index >= len(chunk.Shards) {
+		return protocol.Errorf(protocol.ErrInvalid, "chunk %s has no shard %d", chunk.ID, index)
+	}
+	target := chunk.Shards[index]
+	if err := checkName(target.ID); err != nil {
+		return err
+	}
+
+	shards := make([][]byte, len(chunk.Shards))
+	found := 0
+	start, read := time.Now(), int64(0)
+	for i, shard := range chunk.Shards {
+		if found == chunk.DataShards {
+			break
+		}
+		if i == index {
+			continue
+		}
+		for _, addr := range shard.Locations {
+			data, err := fetch(addr, shard)
+			if err != nil {
+				fmt.Println("Fetch of shard", shard.ID, "from", addr, "Failed:", err)
+				continue
+			}
+			shards[i] = data
+			found++
+			read += shard.Size
+			throttle(start, read, rate)
+			break
+		}
+	}
+	if found < chunk.DataShards {
+		return protocol.Errorf(protocol.ErrNodeUnavailable, "read %d shards of chunk %s, %d are needed", found, chunk.ID, chunk.DataShards)
+	}
+	if err := code.Reconstruct(shards); err != nil {
+		return err
+	}
+	return s.storage.Upload(target.ID, target.Size, "", bytes.NewReader(shards[index]))
+}
+
+// fetch downloads a whole shard from another storage server, checking it
+// against the checksum that server recorded for it
+func fetch(addr string, shard protocol.Chunkinfo) ([]byte, error) {
+	// Connect to source server
+	conn, err := dialPeer(addr, shard.Size, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+
+	// Send Download Request
+	payload, err := json.Marshal(protocol.Download_Request{Filename: shard.ID})
+	if err != nil {
+		return nil, err
+	}
+	err = encoder.Encode(protocol.Message{
+		Type:    protocol.DownloadReq,
+		Payload: payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var msg protocol.Message
+	if err := decoder.Decode(&msg); err != nil {
+		return nil, err
+	}
+	if err := msg.Err(); err != nil {
+		return nil, err
+	}
+	if msg.Type != protocol.DownloadAck {
+		return nil, fmt.Errorf("DownloadAck expected")
+	}
+	var ack protocol.Download_Ack
+	if err := json.Unmarshal(msg.Payload, &ack); err != nil {
+		return nil, err
+	}
+	if ack.Size != shard.Size || ack.Length != shard.Size {
+		return nil, fmt.Errorf("shard has %d bytes, expected %d", ack.Size, shard.Size)
+	}
+
+	// File data follows the newline ending the ack
+	data := io.MultiReader(decoder.Buffered(), conn)
+	var newline [1]byte
+	if _, err := io.ReadFull(data, newline[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, shard.Size)
+	if _, err := io.ReadFull(data, buf); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(buf)
+	if checksum := hex.EncodeToString(sum[:]); ack.Checksum != "" && checksum != ack.Checksum {
+		return nil, protocol.Errorf(protocol.ErrChecksumMismatch, "checksum mismatch on %s, expected %s, received %s", shard.ID, ack.Checksum, checksum)
+	}
+	return buf, nil
+}
@@ -0,0 +1,185 @@
+package storageserver
+
+import (
+	"DistributedFileSystem/protocol"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+Scrubber
+Periodically re-reads every stored file at a limited rate and compares it
+against the checksum recorded on upload. Corrupt copies are moved into the
+quarantine directory and reported to the main server so it can restore them
+from another replica.
+*/
+
+const (
+	quarantineDir = ".quarantine"
+	scrubBlock    = 64 << 10
+)
+
+func (s *StorageServer) scrubLoop() {
+	ticker := time.NewTicker(s.scrubInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.scrub()
+	}
+}
+
+// scrub verifies every file once, quarantining and reporting the corrupt ones
+func (s *StorageServer) scrub() {
+	var corrupt []string
+	checked := 0
+	for filename := range s.storage.List() {
+		ok, err := s.storage.Verify(filename, s.scrubRate)
+		if err != nil {
+			// Deleted or rewritten while scrubbing
+			continue
+		}
+		checked++
+		if ok {
+			continue
+		}
+		fmt.Println("Scrubber found corrupt file", filename)
+		if err := s.storage.Quarantine(filename); err != nil {
+			fmt.Println("Quarantine Error", err)
+			continue
+		}
+		corrupt = append(corrupt, filename)
+	}
+	fmt.Println("Scrubbed", checked, "files,", len(corrupt), "corrupt")
+
+	if len(corrupt) > 0 && s.main != nil {
+		if err := s.reportCorrupt(corrupt); err != nil {
+			fmt.Println("Corruption Report Error", err)
+		}
+	}
+}
+
+func (s *StorageServer) reportCorrupt(files []string) error {
+	req := protocol.CorruptReport_Request{Addr: s.addr, Files: files}
+	return s.callMain(mainTimeout, protocol.CorruptReportReq, req, protocol.CorruptReportAck, nil)
+}
+
+// Verify re-reads a file at no more than rate bytes per second and reports
+// whether it still matches its recorded checksum. Files without a recorded
+// checksum always match.
+func (storage *Storage) Verify(filename string, rate int64) (bool, error) {
+	path, err := storage.resolve(filename)
+	if err != nil {
+		return false, err
+	}
+	fileLock := storage.getLock(filename)
+	fileLock.RLock()
+	defer fileLock.RUnlock()
+
+	checksum := storage.Checksum(filename)
+	if checksum == "" {
+		return true, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	reader := &throttledReader{reader: file, rate: rate, start: time.Now()}
+	if _, err := io.Copy(hash, reader); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)) == checksum, nil
+}
+
+// Quarantine moves a file and its checksum out of the storage. It no
+// longer counts against available memory.
+func (storage *Storage) Quarantine(filename string) error {
+	path, err := storage.resolve(filename)
+	if err != nil {
+		return err
+	}
+	fileLock := storage.getLock(filename)
+	fileLock.Lock()
+	defer fileLock.Unlock()
+
+	target := filepath.Join(storage.path, quarantineDir, filename)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(path, target); err != nil {
+		return err
+	}
+	os.Rename(path+checksumSuffix, target+checksumSuffix)
+
+	storage.lock.Lock()
+	storage.available += info.Size()
+	delete(storage.files, filepath.ToSlash(filename))
+	delete(storage.checksums, filepath.ToSlash(filename))
+	storage.lock.Unlock()
+	return nil
+}
+
+// throttledReader limits the average read rate in bytes per second
+type throttledReader struct {
+	reader io.Reader
+	rate   int64
+	start  time.Time
+	read   int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > scrubBlock {
+		p = p[:scrubBlock]
+	}
+	n, err := t.reader.Read(p)
+	t.read += int64(n)
+	throttle(t.start, t.read, t.rate)
+	return n, err
+}
+
+// throttledWriter limits the average write rate in bytes per second
+type throttledWriter struct {
+	writer  io.Writer
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		block := p[:min(len(p), scrubBlock)]
+		m, err := t.writer.Write(block)
+		n += m
+		t.written += int64(m)
+		if err != nil {
+			return n, err
+		}
+		throttle(t.start, t.written, t.rate)
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// throttle sleeps until done bytes since start are back within rate bytes
+// per second on average. A rate of 0 is unlimited.
+func throttle(start time.Time, done int64, rate int64) {
+	if rate <= 0 {
+		return
+	}
+	due := time.Duration(float64(done) / float64(rate) * float64(time.Second))
+	if wait := due - time.Since(start); wait > 0 {
+		time.Sleep(wait)
+	}
+}
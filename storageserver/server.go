@@ -2,14 +2,44 @@ package storageserver
 
 import (
 	"DistributedFileSystem/protocol"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
 type StorageServer struct {
-	listener *net.TCPListener
-	storage  *Storage
+	listener  *net.TCPListener
+	storage   *Storage
+	addr      string
+	heartbeat time.Duration
+	load      atomic.Int64      // Transfers in progress
+	main      *protocol.Cluster // Leader among the main servers, nil if none is configured
+
+	scrubInterval time.Duration
+	scrubRate     int64
+
+	sessionTimeout time.Duration
+}
+
+type Config struct {
+	Addr      string   // Address to listen on, also how the main server knows this node
+	Dir       string   // Directory to store files in
+	Mem       int64    // Capacity in bytes
+	MainAddrs []string // Main servers to heartbeat to, their leader is found. None disables heartbeats
+
+	HeartbeatInterval time.Duration
+
+	// Every file is re-read and checked against its checksum this often,
+	// at no more than ScrubRate bytes per second. Zero disables scrubbing.
+	ScrubInterval time.Duration
+	ScrubRate     int64
+
+	// Partial data of a resumable upload is dropped once nobody has sent
+	// any of it for this long. Zero keeps it until the node restarts.
+	SessionTimeout time.Duration
 }
 
 func (s *StorageServer) GetPath() string {
@@ -17,15 +47,19 @@ func (s *StorageServer) GetPath() string {
 }
 
 func (s *StorageServer) GetAvailableMemory() int64 {
-	return s.storage.available
+	return s.storage.getAvailableMemory()
 }
 
 func (s *StorageServer) GetCapacityMemory() int64 {
-	return s.storage.capacity
+	return s.storage.getCapacity()
 }
 
-func NewStorageServer(addr, dir string, mem int64) (*StorageServer, error) {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+func NewStorageServer(config Config) (*StorageServer, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := NewStorage(config.Dir, config.Mem)
 	if err != nil {
 		return nil, err
 	}
@@ -33,13 +67,38 @@ func NewStorageServer(addr, dir string, mem int64) (*StorageServer, error) {
 	if err != nil {
 		return nil, err
 	}
+	pool := &protocol.Pool{DialTimeout: config.HeartbeatInterval, WriteTimeout: config.HeartbeatInterval}
+	var main *protocol.Cluster
+	if len(config.MainAddrs) > 0 {
+		main = protocol.NewCluster(pool, config.MainAddrs)
+	}
 	return &StorageServer{
-		listener: listener,
-		storage:  NewStorage(dir, mem),
+		listener:  listener,
+		storage:   storage,
+		addr:      config.Addr,
+		heartbeat: config.HeartbeatInterval,
+		main:      main,
+
+		scrubInterval: config.ScrubInterval,
+		scrubRate:     config.ScrubRate,
+
+		sessionTimeout: config.SessionTimeout,
 	}, nil
 }
 
 func (s *StorageServer) Start() {
+	if s.main != nil {
+		if err := s.register(false); err != nil {
+			fmt.Println("Register Error", err)
+		}
+		go s.heartbeatLoop()
+	}
+	if s.scrubInterval > 0 {
+		go s.scrubLoop()
+	}
+	if s.sessionTimeout > 0 {
+		go s.sessionLoop()
+	}
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
@@ -52,13 +111,16 @@ func (s *StorageServer) Start() {
 
 func (s *StorageServer) handleConnection(conn net.Conn) {
 	defer conn.Close()
-	decoder := json.NewDecoder(conn)
-	encoder := json.NewEncoder(conn)
-
-	var msg protocol.Message
-	err := decoder.Decode(&msg)
-	if err != nil {
+	if err := protocol.Serve(conn, s.handleRequest); err != nil {
 		fmt.Println("Decode Error", err)
+	}
+}
+
+// handleRequest answers one request. Uploads and downloads carry raw data
+// after their messages, so they need a connection of their own.
+func (s *StorageServer) handleRequest(msg protocol.Message, encoder protocol.Encoder, conn net.Conn) {
+	if conn == nil && (msg.Type == protocol.UploadReq || msg.Type == protocol.DownloadReq) {
+		sendError(encoder, protocol.Errorf(protocol.ErrInvalid, "%s cannot be multiplexed", msg.Type))
 		return
 	}
 
@@ -73,28 +135,93 @@ func (s *StorageServer) handleConnection(conn net.Conn) {
 		}
 		fmt.Println("Received Upload Request with File", req.Filename, "with size", req.Size)
 
-		if s.GetAvailableMemory() < req.Size {
+		if err := checkName(req.Filename); err != nil {
+			fmt.Println("Upload Refused", err)
+			sendError(encoder, err)
+			return
+		}
+		// Only the configured main server is trusted with confirmations
+		if req.Lease != "" && s.main == nil {
+			err := protocol.Errorf(protocol.ErrInvalid, "%s has no main server to confirm uploads to, it needs -main_addr", s.addr)
+			fmt.Println("Upload Refused", err)
+			sendError(encoder, err)
+			return
+		}
+
+		// A session continues from whatever it already holds
+		var sess *session
+		var offset int64
+		if req.Session != "" {
+			sess, offset, err = s.storage.OpenSession(req.Session, req.Filename, req.Size)
+			if err != nil {
+				fmt.Println("Upload Refused", err)
+				sendError(encoder, err)
+				return
+			}
+			if offset > 0 {
+				fmt.Println("Resuming session", req.Session, "at offset", offset)
+			}
+		} else if s.GetAvailableMemory() < req.Size {
 			fmt.Println("Not enough available memory")
+			sendError(encoder, protocol.Errorf(protocol.ErrNoSpace, "%s has %d bytes available, %d needed", s.addr, s.GetAvailableMemory(), req.Size))
 			return
 		}
 
 		// Send Response
+		payload, err := json.Marshal(protocol.Upload_Ack{Offset: offset})
+		if err != nil {
+			fmt.Println("Marshal Error", err)
+			return
+		}
 		err = encoder.Encode(protocol.Message{
-			Type: protocol.UploadAck,
+			Type:    protocol.UploadAck,
+			Payload: payload,
 		})
 
 		if err != nil {
 			fmt.Println("Encode Error", err)
+			if sess != nil {
+				sess.lock.Unlock()
+			}
 			return
 		}
 
 		// Receive File Data
-		if err := s.storage.Upload(req.Filename, req.Size, conn); err != nil {
+		s.load.Add(1)
+		defer s.load.Add(-1)
+		if sess != nil {
+			err = s.storage.Resume(sess, req.Checksum, conn)
+		} else {
+			err = s.storage.Upload(req.Filename, req.Size, req.Checksum, conn)
+		}
+		if err == nil && req.Lease != "" {
+			// The upload only counts once the main server knows about it
+			if err = s.confirmUpload(req); err != nil {
+				s.storage.Delete(req.Filename)
+			}
+		}
+		if err != nil {
 			fmt.Println("Upload Error", err)
+			sendError(encoder, err)
 			return
 		}
 		fmt.Println("Upload Successful")
 
+		// Confirm the data was verified and stored
+		payload, err = json.Marshal(protocol.Upload_Done{Success: true})
+		if err != nil {
+			fmt.Println("Marshal Error", err)
+			return
+		}
+		err = encoder.Encode(protocol.Message{
+			Type:    protocol.UploadDone,
+			Payload: payload,
+		})
+		if err != nil {
+			fmt.Println("Encode Error", err)
+			return
+		}
+
 	case protocol.DownloadReq:
 		var req protocol.Download_Request
 
@@ -104,11 +231,38 @@ func (s *StorageServer) handleConnection(conn net.Conn) {
 			fmt.Println("Decode Error", err)
 			return
 		}
-		fmt.Println("Received Download Request with File", req.Filename)
+		fmt.Println("Received Download Request with File", req.Filename, "at offset", req.Offset, "length", req.Length)
+
+		size, exists := s.storage.Size(req.Filename)
+		if !exists {
+			fmt.Println("Download Error, no such file", req.Filename)
+			sendError(encoder, protocol.Errorf(protocol.ErrNotFound, "%s does not hold %s", s.addr, req.Filename))
+			return
+		}
+
+		// A range past the end is cut short at the end
+		if req.Offset < 0 || req.Length < 0 || req.Offset > size {
+			sendError(encoder, protocol.Errorf(protocol.ErrInvalid, "range at %d of length %d is outside %s of size %d", req.Offset, req.Length, req.Filename, size))
+			return
+		}
+		length := size - req.Offset
+		if req.Length > 0 {
+			length = min(req.Length, length)
+		}
+		payload, err := json.Marshal(protocol.Download_Ack{
+			Size:     size,
+			Checksum: s.storage.Checksum(req.Filename),
+			Length:   length,
+		})
+		if err != nil {
+			fmt.Println("Marshal Error", err)
+			return
+		}
 
 		// Send Response
 		err = encoder.Encode(protocol.Message{
-			Type: protocol.DownloadAck,
+			Type:    protocol.DownloadAck,
+			Payload: payload,
 		})
 
 		if err != nil {
@@ -117,20 +271,30 @@ func (s *StorageServer) handleConnection(conn net.Conn) {
 		}
 
 		// Perform Download
-		if err := s.storage.Download(req.Filename, conn); err != nil {
+		s.load.Add(1)
+		defer s.load.Add(-1)
+		if err := s.storage.Download(req.Filename, req.Offset, length, conn); err != nil {
 			fmt.Println("Download Error", err)
 			return
 		}
 
 	case protocol.DeleteReqM:
 		var req protocol.Delete_Request
-		fmt.Println("Received Delete Request with File", req.Filename)
 		// Unmarshal Request
 		err := json.Unmarshal(msg.Payload, &req)
 		if err != nil {
 			fmt.Println("Unmarshal Error", err)
 			return
 		}
+		fmt.Println("Received Delete Request with File", req.Filename)
+
+		// Perform Deletion
+		if err := s.storage.Delete(req.Filename); err != nil {
+			fmt.Println("Delete Error", err)
+			sendError(encoder, err)
+			return
+		}
+		fmt.Println("Deletion Successful, Available Memory", s.GetAvailableMemory())
 
 		payload, err := json.Marshal(protocol.Delete_Response{
 			Success: true,
@@ -150,13 +314,6 @@ func (s *StorageServer) handleConnection(conn net.Conn) {
 			fmt.Println("Encode Error", err)
 			return
 		}
-
-		// Perform Deletion
-		if err := s.storage.Delete(req.Filename); err != nil {
-			fmt.Println("Delete Error", err)
-			return
-		}
-		fmt.Println("Deletion Successful, Available Memory", s.GetAvailableMemory())
 	case protocol.MemLookupReq:
 		fmt.Println("Received MemLookup request, Current memory:", s.GetAvailableMemory(), ", Capacity:", s.GetCapacityMemory())
 		payload, err := json.Marshal(protocol.MemLookup_Response{
@@ -177,5 +334,236 @@ func (s *StorageServer) handleConnection(conn net.Conn) {
 			fmt.Println("Encode Error", err)
 			return
 		}
+	case protocol.BlockReportReq:
+		report := s.blockReport()
+		fmt.Println("Received Block Report request, Reporting", len(report.Files), "files")
+		payload, err := json.Marshal(report)
+		if err != nil {
+			fmt.Println("Marshal Error", err)
+			return
+		}
+
+		// Send Response
+		err = encoder.Encode(protocol.Message{
+			Type:    protocol.BlockReportResp,
+			Payload: payload,
+		})
+
+		if err != nil {
+			fmt.Println("Encode Error", err)
+			return
+		}
+
+	case protocol.ReplicateReq:
+		var req protocol.Replicate_Request
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			fmt.Println("Unmarshal Error", err)
+			return
+		}
+		fmt.Println("Received Replicate Request of File", req.Filename, "to", req.Target)
+
+		s.load.Add(1)
+		err := s.replicate(req.Filename, req.Target, req.Rate)
+		s.load.Add(-1)
+		if err != nil {
+			fmt.Println("Replicate Error", err)
+			sendError(encoder, err)
+			return
+		}
+
+		payload, err := json.Marshal(protocol.Replicate_Response{Success: true})
+		if err != nil {
+			fmt.Println("Marshal Error", err)
+			return
+		}
+
+		// Send Response
+		err = encoder.Encode(protocol.Message{
+			Type:    protocol.ReplicateAck,
+			Payload: payload,
+		})
+
+		if err != nil {
+			fmt.Println("Encode Error", err)
+			return
+		}
+
+	case protocol.RebuildReq:
+		var req protocol.Rebuild_Request
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			fmt.Println("Unmarshal Error", err)
+			return
+		}
+		fmt.Println("Received Rebuild Request of shard", req.Index, "of chunk", req.Chunk.ID)
+
+		s.load.Add(1)
+		err := s.rebuild(req.Chunk, req.Index, req.Rate)
+		s.load.Add(-1)
+		if err != nil {
+			fmt.Println("Rebuild Error", err)
+			sendError(encoder, err)
+			return
+		}
+
+		payload, err := json.Marshal(protocol.Rebuild_Response{Success: true})
+		if err != nil {
+			fmt.Println("Marshal Error", err)
+			return
+		}
+
+		// Send Response
+		err = encoder.Encode(protocol.Message{
+			Type:    protocol.RebuildAck,
+			Payload: payload,
+		})
+
+		if err != nil {
+			fmt.Println("Encode Error", err)
+			return
+		}
+
+	default:
+		sendError(encoder, protocol.Errorf(protocol.ErrInvalid, "unknown message type %s", msg.Type))
+	}
+}
+
+func (s *StorageServer) sessionLoop() {
+	ticker := time.NewTicker(s.sessionTimeout / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.storage.ExpireSessions(s.sessionTimeout)
+	}
+}
+
+// sendError answers a request with an Error message
+func sendError(encoder protocol.Encoder, err error) {
+	if err := encoder.Encode(protocol.ErrorMessage(err)); err != nil {
+		fmt.Println("Encode Error", err)
+	}
+}
+
+func (s *StorageServer) blockReport() protocol.BlockReport_Response {
+	files := s.storage.List()
+	report := protocol.BlockReport_Response{
+		Availmem: s.GetAvailableMemory(),
+		Capacity: s.GetCapacityMemory(),
+		Files:    make([]protocol.Blockinfo, 0, len(files)),
+	}
+	for name, size := range files {
+		report.Files = append(report.Files, protocol.Blockinfo{Filename: name, Size: size})
+	}
+	return report
+}
+
+// replicate uploads the local copy of a file to another storage server, at
+// no more than rate bytes per second unless it is 0
+func (s *StorageServer) replicate(filename string, target string, rate int64) error {
+	size, exists := s.storage.Size(filename)
+	if !exists {
+		return protocol.Errorf(protocol.ErrNotFound, "no such file %s", filename)
+	}
+
+	// Connect to target server
+	conn, err := dialPeer(target, size, rate)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+
+	// Send Upload Request, the target verifies our recorded checksum
+	payload, err := json.Marshal(protocol.Upload_Request{
+		Filename: filename,
+		Size:     size,
+		Checksum: s.storage.Checksum(filename),
+	})
+	if err != nil {
+		return err
+	}
+	err = encoder.Encode(protocol.Message{
+		Type:    protocol.UploadReq,
+		Payload: payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	var msg protocol.Message
+	if err := decoder.Decode(&msg); err != nil {
+		return err
+	}
+	if err := msg.Err(); err != nil {
+		return err
+	}
+	if msg.Type != protocol.UploadAck {
+		return fmt.Errorf("UploadAck expected")
+	}
+
+	// Send File Data
+	if err := s.storage.Download(filename, 0, size, &throttledWriter{writer: conn, rate: rate, start: time.Now()}); err != nil {
+		return err
+	}
+
+	// Wait for the target to verify and store it
+	if err := decoder.Decode(&msg); err != nil {
+		return err
+	}
+	if err := msg.Err(); err != nil {
+		return err
+	}
+	if msg.Type != protocol.UploadDone {
+		return fmt.Errorf("UploadDone expected")
+	}
+	var done protocol.Upload_Done
+	if err := json.Unmarshal(msg.Payload, &done); err != nil {
+		return err
+	}
+	if !done.Success {
+		return fmt.Errorf("%s could not store %s", target, filename)
+	}
+	return nil
+}
+
+// peerTimeout is how long another storage server may take to accept a
+// connection and to answer, on top of the time the data itself takes
+const peerTimeout = 10 * time.Second
+
+// mainTimeout is how long the main server may take to answer a request that
+// does not wait on any data being moved
+const mainTimeout = 10 * time.Second
+
+// callMain sends a request to the main server and fails it if no reply
+// arrives within timeout
+func (s *StorageServer) callMain(timeout time.Duration, reqType protocol.MessageType, req any, respType protocol.MessageType, resp any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.main.Call(ctx, reqType, req, respType, resp)
+}
+
+// dialPeer connects to another storage server for a transfer of size bytes
+// at rate bytes per second, unlimited if 0, and fails the connection once
+// the transfer takes longer than it should
+func dialPeer(addr string, size int64, rate int64) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: peerTimeout}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(protocol.TransferTimeout(peerTimeout, size, rate))); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// confirmUpload tells the main server a chunk of a leased upload was stored
+func (s *StorageServer) confirmUpload(req protocol.Upload_Request) error {
+	confirm := protocol.Upload_Confirm{
+		Lease:    req.Lease,
+		Addr:     s.addr,
+		Filename: req.Filename,
+		Size:     req.Size,
 	}
+	return s.callMain(mainTimeout, protocol.UploadConfirmReq, confirm, protocol.UploadConfirmAck, nil)
 }
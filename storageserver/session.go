@@ -0,0 +1,199 @@
+package storageserver
+
+import (
+	"DistributedFileSystem/protocol"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+Upload Sessions
+An upload that names a session keeps its partial data in the staging
+directory when the connection drops, so the sender can reconnect and carry
+on from the offset the node reports instead of starting over. A session
+holds its full size reserved until it completes, fails verification or is
+abandoned for longer than the session timeout. Sessions live in memory, a
+restart discards them along with the rest of the staging directory.
+*/
+
+type session struct {
+	lock     sync.Mutex // Held while a connection writes to the session
+	id       string
+	filename string
+	size     int64
+	path     string    // Partial data in the staging directory
+	updated  time.Time // Guarded by Storage.lock
+}
+
+// OpenSession returns the session with id, creating it and reserving its
+// size if it is new, along with how many bytes of it are already stored.
+// The session is locked for the caller, who must hand it to Resume.
+func (storage *Storage) OpenSession(id string, filename string, size int64) (*session, int64, error) {
+	if _, err := storage.resolve(filename); err != nil {
+		return nil, 0, err
+	}
+	if err := checkName(id); err != nil {
+		return nil, 0, err
+	}
+
+	for {
+		sess, err := storage.session(id, filename, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !sess.lock.TryLock() {
+			return nil, 0, protocol.Errorf(protocol.ErrExists, "session %s is already receiving data", id)
+		}
+
+		// The session may have expired before it was locked
+		storage.lock.RLock()
+		current := storage.sessions[id] == sess
+		storage.lock.RUnlock()
+		if !current {
+			sess.lock.Unlock()
+			continue
+		}
+
+		var offset int64
+		if info, err := os.Stat(sess.path); err == nil {
+			offset = min(info.Size(), size)
+		}
+		return sess, offset, nil
+	}
+}
+
+// session looks up or creates the session with id
+func (storage *Storage) session(id string, filename string, size int64) (*session, error) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+	sess, exists := storage.sessions[id]
+	if !exists {
+		if size > storage.available {
+			return nil, protocol.Errorf(protocol.ErrNoSpace, "Not enough space to upload to %s", filename)
+		}
+		storage.available -= size
+		sess = &session{
+			id:       id,
+			filename: filename,
+			size:     size,
+			path:     filepath.Join(storage.path, stagingDir, "session-"+id),
+		}
+		storage.sessions[id] = sess
+	}
+	if sess.filename != filename || sess.size != size {
+		return nil, protocol.Errorf(protocol.ErrInvalid, "session %s is an upload of %d bytes to %s", id, sess.size, sess.filename)
+	}
+	sess.updated = time.Now()
+	return sess, nil
+}
+
+// Resume appends the rest of a session's data from reader. Once all of it
+// is stored and matches checksum, if one is given, the file is installed
+// and the session ends. If the data stops short the session is kept for
+// another attempt, if it does not verify the session is dropped.
+func (storage *Storage) Resume(sess *session, checksum string, reader io.Reader) error {
+	defer sess.lock.Unlock()
+	defer func() {
+		storage.lock.Lock()
+		sess.updated = time.Now()
+		storage.lock.Unlock()
+	}()
+
+	file, err := os.OpenFile(sess.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Hash what is already there, leaving the file positioned at its end
+	hash := sha256.New()
+	offset, err := io.Copy(hash, io.LimitReader(file, sess.size))
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(io.MultiWriter(file, hash), reader, sess.size-offset); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if checksum != "" && sum != checksum {
+		storage.endSession(sess, true)
+		return protocol.Errorf(protocol.ErrChecksumMismatch, "checksum mismatch on %s, expected %s, received %s", sess.filename, checksum, sum)
+	}
+
+	fileLock := storage.getLock(sess.filename)
+	fileLock.Lock()
+	defer fileLock.Unlock()
+
+	path := filepath.Join(storage.path, sess.filename)
+	var prevSize int64 = 0
+	if fileinfo, err := os.Stat(path); err == nil {
+		prevSize = fileinfo.Size()
+	}
+	if err := storage.install(sess.filename, file, sum); err != nil {
+		return err
+	}
+	storage.endSession(sess, false)
+
+	storage.lock.Lock()
+	storage.available += prevSize
+	storage.files[filepath.ToSlash(sess.filename)] = sess.size
+	storage.checksums[filepath.ToSlash(sess.filename)] = sum
+	fmt.Println("Upload Successful, Available Memory:", storage.available)
+	storage.lock.Unlock()
+	return nil
+}
+
+// endSession forgets a session, removing its partial data and returning its
+// reservation if unreserve is set. Callers hold the session's lock.
+func (storage *Storage) endSession(sess *session, unreserve bool) {
+	os.Remove(sess.path)
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+	delete(storage.sessions, sess.id)
+	if unreserve {
+		storage.available += sess.size
+	}
+}
+
+// ExpireSessions drops sessions nobody has written to for timeout
+func (storage *Storage) ExpireSessions(timeout time.Duration) {
+	storage.dropSessions("expired", func(sess *session) bool {
+		return time.Since(sess.updated) > timeout
+	})
+}
+
+// dropSessions ends every session that matches and is not receiving data.
+// match is called with Storage.lock held.
+func (storage *Storage) dropSessions(reason string, match func(*session) bool) {
+	storage.lock.RLock()
+	var matched []*session
+	for _, sess := range storage.sessions {
+		if match(sess) {
+			matched = append(matched, sess)
+		}
+	}
+	storage.lock.RUnlock()
+
+	for _, sess := range matched {
+		if !sess.lock.TryLock() {
+			continue
+		}
+		storage.lock.RLock()
+		current := storage.sessions[sess.id] == sess && match(sess)
+		storage.lock.RUnlock()
+		if current {
+			storage.endSession(sess, true)
+			fmt.Println("Upload session", sess.id, "of", sess.filename, reason)
+		}
+		sess.lock.Unlock()
+	}
+}
@@ -0,0 +1,142 @@
+package storageserver
+
+import (
+	"DistributedFileSystem/protocol"
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sendUpload starts an upload on a connection of its own to s and returns
+// the connection and the offset the server asks the data to start from
+func sendUpload(t *testing.T, s *StorageServer, req protocol.Upload_Request) (net.Conn, *json.Decoder, <-chan struct{}, int64) {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleConnection(server)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.NewEncoder(client).Encode(protocol.Message{Type: protocol.UploadReq, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	decoder := json.NewDecoder(client)
+	var msg protocol.Message
+	if err := decoder.Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Err(); err != nil {
+		t.Fatal(err)
+	}
+	var ack protocol.Upload_Ack
+	if err := json.Unmarshal(msg.Payload, &ack); err != nil {
+		t.Fatal(err)
+	}
+	return client, decoder, done, ack.Offset
+}
+
+func TestSessionResumesAtOffset(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewStorage(dir, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &StorageServer{storage: storage, addr: "localhost:9101"}
+	data := bytes.Repeat([]byte("0123456789"), 300)
+	req := protocol.Upload_Request{Filename: "chunk", Size: int64(len(data)), Checksum: checksumOf(data), Session: "s1"}
+
+	// The connection drops part way through
+	conn, _, done, offset := sendUpload(t, s, req)
+	if offset != 0 {
+		t.Fatalf("new session starts at %d", offset)
+	}
+	if _, err := conn.Write(data[:1200]); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	<-done
+	if _, exists := storage.Size("chunk"); exists {
+		t.Fatal("partial upload installed")
+	}
+	if available := storage.getAvailableMemory(); available != 10000-int64(len(data)) {
+		t.Fatalf("%d bytes available while the session is open, expected the whole upload reserved", available)
+	}
+
+	// Reconnecting picks up where the data stopped
+	conn, decoder, done, offset := sendUpload(t, s, req)
+	if offset != 1200 {
+		t.Fatalf("resumed at %d, expected 1200", offset)
+	}
+	if _, err := conn.Write(data[offset:]); err != nil {
+		t.Fatal(err)
+	}
+	var msg protocol.Message
+	if err := decoder.Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Err(); err != nil || msg.Type != protocol.UploadDone {
+		t.Fatalf("resumed upload got %s: %v", msg.Type, err)
+	}
+	conn.Close()
+	<-done
+
+	stored, err := os.ReadFile(filepath.Join(dir, "chunk"))
+	if err != nil || !bytes.Equal(stored, data) {
+		t.Fatalf("stored %d bytes that differ from the upload: %v", len(stored), err)
+	}
+	if storage.Checksum("chunk") != checksumOf(data) {
+		t.Fatalf("stored checksum %s, expected %s", storage.Checksum("chunk"), checksumOf(data))
+	}
+	if available := storage.getAvailableMemory(); available != 10000-int64(len(data)) {
+		t.Fatalf("%d bytes available, expected %d", available, 10000-len(data))
+	}
+	if entries, err := os.ReadDir(filepath.Join(dir, stagingDir)); err != nil || len(entries) != 0 {
+		t.Fatalf("finished session left %d staged files: %v", len(entries), err)
+	}
+}
+
+func TestSessionDroppedOnMismatch(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewStorage(dir, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &StorageServer{storage: storage, addr: "localhost:9101"}
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	req := protocol.Upload_Request{Filename: "chunk", Size: int64(len(data)), Checksum: checksumOf(data[1:]), Session: "s1"}
+
+	conn, decoder, done, _ := sendUpload(t, s, req)
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	var msg protocol.Message
+	if err := decoder.Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Err(); protocol.CodeOf(err) != protocol.ErrChecksumMismatch {
+		t.Fatalf("mismatched upload got %v, expected %s", err, protocol.ErrChecksumMismatch)
+	}
+	conn.Close()
+	<-done
+
+	// The session is gone, a new one starts over with its reservation returned
+	if available := storage.getAvailableMemory(); available != 10000 {
+		t.Fatalf("%d bytes available after the session was dropped, expected 10000", available)
+	}
+	conn, _, done, offset := sendUpload(t, s, req)
+	conn.Close()
+	<-done
+	if offset != 0 {
+		t.Fatalf("session restarted at %d, expected 0", offset)
+	}
+}
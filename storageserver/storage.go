@@ -1,10 +1,15 @@
 package storageserver
 
 import (
+	"DistributedFileSystem/protocol"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 )
 
@@ -14,20 +19,164 @@ type Storage struct {
 	capacity  int64
 	available int64
 	fileLocks map[string]*sync.RWMutex
+	files     map[string]int64  // Filename -> Size
+	checksums map[string]string // Filename -> Hex SHA-256
+	sessions  map[string]*session
 }
 
-func NewStorage(path string, mem int64) *Storage {
-	return &Storage{
+const (
+	// Every file's checksum is persisted next to it in a file with this suffix
+	checksumSuffix = ".sha256"
+	// Uploads are written here and only renamed into place once complete and verified
+	stagingDir = ".staging"
+)
+
+// NewStorage creates a storage rooted at path and takes inventory of any
+// files left there by a previous run, so available memory reflects them.
+func NewStorage(path string, mem int64) (*Storage, error) {
+	storage := &Storage{
 		path:      path,
 		fileLocks: make(map[string]*sync.RWMutex),
 		capacity:  mem,
 		available: mem,
+		files:     make(map[string]int64),
+		checksums: make(map[string]string),
+		sessions:  make(map[string]*session),
+	}
+	if err := storage.cleanStaging(); err != nil {
+		return nil, err
+	}
+	if err := storage.scan(); err != nil {
+		return nil, err
 	}
+	return storage, nil
 }
 
-func (storage *Storage) getLock(key string) *sync.RWMutex {
+// cleanStaging removes uploads that were cut short by a crash
+func (storage *Storage) cleanStaging() error {
+	staging := filepath.Join(storage.path, stagingDir)
+	entries, err := os.ReadDir(staging)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		fmt.Println("Removing", len(entries), "incomplete uploads from", staging)
+	}
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	return os.MkdirAll(staging, 0755)
+}
+
+func (storage *Storage) scan() error {
+	var used int64
+	err := filepath.WalkDir(storage.path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			// Files are stored flat, subdirectories hold staged or quarantined
+			// files rather than stored ones
+			if path != storage.path {
+				if !strings.HasPrefix(entry.Name(), ".") {
+					fmt.Println("Ignoring directory", path)
+				}
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(storage.path, path)
+		if err != nil {
+			return err
+		}
+		if name, ok := strings.CutSuffix(filepath.ToSlash(rel), checksumSuffix); ok {
+			checksum, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			storage.checksums[name] = string(checksum)
+			return nil
+		}
+		if err := checkName(rel); err != nil {
+			fmt.Println("Ignoring", path, err)
+			return nil
+		}
+		storage.files[filepath.ToSlash(rel)] = info.Size()
+		used += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	storage.available = storage.capacity - used
+	fmt.Println("Found", len(storage.files), "files using", used, "bytes, Available Memory:", storage.available)
+	return nil
+}
+
+func (storage *Storage) FileCount() int {
 	storage.lock.RLock()
 	defer storage.lock.RUnlock()
+	return len(storage.files)
+}
+
+func (storage *Storage) Size(filename string) (int64, bool) {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
+	size, exists := storage.files[filepath.ToSlash(filename)]
+	return size, exists
+}
+
+// Checksum returns the checksum recorded when the file was uploaded, if any
+func (storage *Storage) Checksum(filename string) string {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
+	return storage.checksums[filepath.ToSlash(filename)]
+}
+
+// List returns every stored file along with its size
+func (storage *Storage) List() map[string]int64 {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
+	files := make(map[string]int64, len(storage.files))
+	for name, size := range storage.files {
+		files[name] = size
+	}
+	return files
+}
+
+// checkName rejects names that are not a single plain file name, such as
+// ones that would escape the storage directory, reach into its hidden
+// staging or quarantine directories, or collide with a checksum sidecar.
+// The main server only ever sends chunk IDs.
+func checkName(filename string) error {
+	switch {
+	case filename == "":
+		return protocol.Errorf(protocol.ErrPermissionDenied, "empty file name")
+	case strings.ContainsAny(filename, `/\`+"\x00"):
+		return protocol.Errorf(protocol.ErrPermissionDenied, "file name %q must not contain a path", filename)
+	case strings.HasPrefix(filename, "."):
+		return protocol.Errorf(protocol.ErrPermissionDenied, "file name %q must not be hidden", filename)
+	case strings.HasSuffix(filename, checksumSuffix):
+		return protocol.Errorf(protocol.ErrPermissionDenied, "file name %q must not end in %s", filename, checksumSuffix)
+	}
+	return nil
+}
+
+// resolve returns where a file is kept, if its name is valid
+func (storage *Storage) resolve(filename string) (string, error) {
+	if err := checkName(filename); err != nil {
+		return "", err
+	}
+	return filepath.Join(storage.path, filename), nil
+}
+
+func (storage *Storage) getLock(key string) *sync.RWMutex {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
 
 	// Ensure Non Empty lock is returned
 	if _, ok := storage.fileLocks[key]; !ok {
@@ -41,68 +190,175 @@ func (storage *Storage) getCapacity() int64 {
 }
 
 func (storage *Storage) getAvailableMemory() int64 {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
 	return storage.available
 }
 
-func (storage *Storage) Upload(filename string, size int64, reader io.Reader) error {
+// Upload stores size bytes from reader under filename. If checksum is
+// non-empty the data must hash to it, otherwise nothing is kept.
+// The checksum of the data is persisted alongside it.
+// The data is written to the staging directory and synced, and only renamed
+// over filename once it is complete and verified, so a failed upload never
+// leaves a partial file behind or destroys the previous copy.
+func (storage *Storage) Upload(filename string, size int64, checksum string, reader io.Reader) error {
+	path, err := storage.resolve(filename)
+	if err != nil {
+		return err
+	}
 	fileLock := storage.getLock(filename)
 	fileLock.Lock()
 	defer fileLock.Unlock()
 
-	path := filepath.Join(storage.path, filename)
-
 	var prevSize int64 = 0
 	if fileinfo, err := os.Stat(path); err == nil {
 		prevSize = fileinfo.Size()
 	}
 
-	storage.lock.RLock()
-	if size-prevSize > storage.available {
-		fmt.Errorf("Not enough space to upload to %s", filename)
+	// The previous copy stays until the new one is in place, so reserve the full size
+	storage.lock.Lock()
+	if size > storage.available {
+		storage.lock.Unlock()
+		return protocol.Errorf(protocol.ErrNoSpace, "Not enough space to upload to %s", filename)
+	}
+	storage.available -= size
+	storage.lock.Unlock()
+
+	err = storage.stage(filename, size, &checksum, reader)
+	if err != nil {
+		storage.lock.Lock()
+		storage.available += size
+		storage.lock.Unlock()
+		return err
 	}
-	storage.lock.RUnlock()
 
-	file, err := os.Create(path)
+	storage.lock.Lock()
+	storage.available += prevSize
+	storage.files[filepath.ToSlash(filename)] = size
+	storage.checksums[filepath.ToSlash(filename)] = checksum
+	fmt.Println("Upload Successful, Available Memory:", storage.available)
+	storage.lock.Unlock()
+
+	return nil
+}
+
+// stage writes the data to a staging file and installs it
+func (storage *Storage) stage(filename string, size int64, checksum *string, reader io.Reader) error {
+	staging := filepath.Join(storage.path, stagingDir)
+	file, err := os.CreateTemp(staging, "upload-*")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(file.Name())
 	defer file.Close()
 
-	written, err := io.CopyN(file, reader, size)
+	// Hash the data as it is written
+	hash := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(file, hash), reader, size); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if *checksum != "" && sum != *checksum {
+		return protocol.Errorf(protocol.ErrChecksumMismatch, "checksum mismatch on %s, expected %s, received %s", filename, *checksum, sum)
+	}
+	*checksum = sum
+	return storage.install(filename, file, sum)
+}
+
+// install syncs a complete staged file and renames it over filename along
+// with a sidecar holding its checksum. A crash between the two renames
+// leaves a file whose sidecar does not match, which the scrubber catches.
+func (storage *Storage) install(filename string, file *os.File, sum string) error {
+	staging := filepath.Join(storage.path, stagingDir)
+	if err := file.Chmod(0644); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	sidecar, err := os.CreateTemp(staging, "checksum-*")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(sidecar.Name())
+	defer sidecar.Close()
+	if _, err := sidecar.WriteString(sum); err != nil {
+		return err
+	}
+	if err := sidecar.Chmod(0644); err != nil {
+		return err
+	}
+	if err := sidecar.Sync(); err != nil {
+		return err
+	}
+	if err := sidecar.Close(); err != nil {
+		return err
+	}
 
-	storage.lock.Lock()
-	storage.available -= (written - prevSize)
-	fmt.Println("Upload Successful, Available Memory:", storage.available)
-	storage.lock.Unlock()
+	path := filepath.Join(storage.path, filename)
+	if err := os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+	if err := os.Rename(sidecar.Name(), path+checksumSuffix); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
 
-	return err
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
 
-func (storage *Storage) Download(filename string, writer io.Writer) error {
+// Download writes length bytes of filename starting at offset to writer
+func (storage *Storage) Download(filename string, offset int64, length int64, writer io.Writer) error {
+	path, err := storage.resolve(filename)
+	if err != nil {
+		return err
+	}
 	fileLock := storage.getLock(filename)
 	fileLock.RLock()
 	defer fileLock.RUnlock()
-	path := filepath.Join(storage.path, filename)
 	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	_, err = io.Copy(writer, file)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.CopyN(writer, file, length)
 	return err
 }
 
 func (storage *Storage) Delete(filename string) error {
+	path, err := storage.resolve(filename)
+	if err != nil {
+		return err
+	}
+
+	// An unfinished upload of the file goes with it
+	storage.dropSessions("dropped", func(sess *session) bool {
+		return sess.filename == filename
+	})
+
 	fileLock := storage.getLock(filename)
 	fileLock.Lock()
 	defer fileLock.Unlock()
-	path := filepath.Join(storage.path, filename)
 
 	// Get Size
 	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return protocol.Errorf(protocol.ErrNotFound, "no such file %s", filename)
+	}
 	if err != nil {
 		return err
 	}
@@ -114,9 +370,12 @@ func (storage *Storage) Delete(filename string) error {
 	if err != nil {
 		return err
 	}
+	os.Remove(path + checksumSuffix)
 
 	storage.lock.Lock()
 	storage.available += size
+	delete(storage.files, filepath.ToSlash(filename))
+	delete(storage.checksums, filepath.ToSlash(filename))
 	storage.lock.Unlock()
 
 	return err
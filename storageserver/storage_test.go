@@ -0,0 +1,88 @@
+package storageserver
+
+import (
+	"DistributedFileSystem/protocol"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func checksumOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestNewStorageCleansStaging(t *testing.T) {
+	dir := t.TempDir()
+	stored := []byte("stored data")
+	staged := filepath.Join(dir, stagingDir)
+	files := map[string][]byte{
+		"chunk":                                 stored,
+		"chunk" + checksumSuffix:                []byte(checksumOf(stored)),
+		filepath.Join(stagingDir, "upload-1"):   []byte("cut short"),
+		filepath.Join(stagingDir, "checksum-1"): []byte("0000"),
+		filepath.Join(stagingDir, "session-1"):  []byte("partial"),
+	}
+	if err := os.MkdirAll(staged, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storage, err := NewStorage(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := os.ReadDir(staged); err != nil || len(entries) != 0 {
+		t.Fatalf("staging directory holds %d entries after startup: %v", len(entries), err)
+	}
+	if size, exists := storage.Size("chunk"); !exists || size != int64(len(stored)) {
+		t.Fatalf("stored chunk found %v with size %d", exists, size)
+	}
+	if storage.FileCount() != 1 {
+		t.Fatalf("%d files found, expected 1", storage.FileCount())
+	}
+	if available := storage.getAvailableMemory(); available != 1000-int64(len(stored)) {
+		t.Fatalf("%d bytes available, expected %d", available, 1000-len(stored))
+	}
+}
+
+func TestUploadKeepsPreviousCopy(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewStorage(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := []byte("old data")
+	if err := storage.Upload("chunk", int64(len(old)), checksumOf(old), bytes.NewReader(old)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither a checksum mismatch nor data that stops short replaces it
+	replacement := []byte("new data!")
+	err = storage.Upload("chunk", int64(len(replacement)), checksumOf(old), bytes.NewReader(replacement))
+	if protocol.CodeOf(err) != protocol.ErrChecksumMismatch {
+		t.Fatalf("mismatched upload got %v, expected %s", err, protocol.ErrChecksumMismatch)
+	}
+	if err := storage.Upload("chunk", int64(len(replacement)), "", bytes.NewReader(replacement[:4])); err == nil {
+		t.Fatal("upload of short data succeeded")
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "chunk")); err != nil || !bytes.Equal(data, old) {
+		t.Fatalf("stored copy is %q after failed uploads: %v", data, err)
+	}
+	if storage.Checksum("chunk") != checksumOf(old) {
+		t.Fatal("checksum changed by failed uploads")
+	}
+	if entries, err := os.ReadDir(filepath.Join(dir, stagingDir)); err != nil || len(entries) != 0 {
+		t.Fatalf("failed uploads left %d staged files: %v", len(entries), err)
+	}
+	if available := storage.getAvailableMemory(); available != 1000-int64(len(old)) {
+		t.Fatalf("%d bytes available, expected %d", available, 1000-len(old))
+	}
+}